@@ -0,0 +1,309 @@
+// Package auth provides the bearer token and HMAC request signing shared
+// by buckyd and its clients.
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// BearerScheme is the Authorization scheme for plain tokens.
+	BearerScheme = "Bearer"
+
+	// HMACScheme is the Authorization scheme for signed requests.  The
+	// credentials are NAME:TIMESTAMP:NONCE:SIGNATURE.
+	HMACScheme = "Bucky-HMAC"
+
+	// ContentHashHeader holds the hex encoded SHA-256 of the body of a
+	// signed request.
+	ContentHashHeader = "X-Bucky-Content-SHA256"
+)
+
+// MaxSkew is how far the timestamp of a signed request may be from the
+// server's clock.
+var MaxSkew = 5 * time.Minute
+
+// seen holds the signatures of the signed requests accepted while their
+// timestamps are within MaxSkew so none is accepted twice.
+var seen = &replayCache{expires: make(map[string]time.Time)}
+
+// replayCache records signatures until they expire.
+type replayCache struct {
+	lock    sync.Mutex
+	expires map[string]time.Time
+	swept   time.Time
+}
+
+// add records the signature and returns false if it was recorded before.
+// A timestamp may be MaxSkew ahead of now and is then accepted for
+// another MaxSkew, so signatures are kept for 2*MaxSkew.
+func (c *replayCache) add(sig string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now.Sub(c.swept) > MaxSkew {
+		for s, t := range c.expires {
+			if now.After(t) {
+				delete(c.expires, s)
+			}
+		}
+		c.swept = now
+	}
+	if t, ok := c.expires[sig]; ok && !now.After(t) {
+		return false
+	}
+	c.expires[sig] = now.Add(2 * MaxSkew)
+	return true
+}
+
+// Credential is a named secret with its permissions.
+type Credential struct {
+	Name   string
+	Secret string
+
+	// Write allows modifying and deleting metrics.  All credentials
+	// may read.
+	Write bool
+}
+
+// Credentials holds the credentials a server accepts keyed by name.
+type Credentials map[string]*Credential
+
+// LoadCredentials reads a credentials file.  Each line holds a name, a
+// permission of "read" or "write" and the secret separated by white
+// space.  Blank lines and lines starting with "#" are ignored.
+func LoadCredentials(path string) (Credentials, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	creds := make(Credentials)
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: Expected NAME PERMISSION SECRET", path, n)
+		}
+		c := &Credential{Name: fields[0], Secret: fields[2]}
+		switch fields[1] {
+		case "read":
+		case "write":
+			c.Write = true
+		default:
+			return nil, fmt.Errorf("%s:%d: Unknown permission %s", path, n, fields[1])
+		}
+		if strings.Contains(c.Name, ":") {
+			return nil, fmt.Errorf("%s:%d: Names may not contain \":\"", path, n)
+		}
+		if creds[c.Name] != nil {
+			return nil, fmt.Errorf("%s:%d: Duplicate name %s", path, n, c.Name)
+		}
+		creds[c.Name] = c
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// Signature returns the hex encoded HMAC-SHA256 of the request method,
+// host, request URI, timestamp, nonce and the hex encoded SHA-256 of the
+// body.
+func Signature(secret, method, host, uri string, timestamp int64, nonce, bodyHash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%s\n%s", method, host, uri, timestamp, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newNonce returns 16 random bytes hex encoded.  It makes the signatures
+// of identical requests made in the same second differ.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// bodyHash returns the hex encoded SHA-256 of body.
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// readBody reads and closes the body of the request and replaces it with
+// a reader of the same bytes.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
+
+// SetBearer sets the Authorization header of the request to the token.
+func SetBearer(r *http.Request, token string) {
+	r.Header.Set("Authorization", BearerScheme+" "+token)
+}
+
+// Sign sets the Authorization header of the request to an HMAC signature
+// made with the named secret.  The body is read into memory to be hashed.
+func Sign(r *http.Request, name, secret string, now time.Time) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		r.ContentLength = int64(len(body))
+	}
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	hash := bodyHash(body)
+	ts := now.Unix()
+	sig := Signature(secret, r.Method, host, r.URL.RequestURI(), ts, nonce, hash)
+	r.Header.Set(ContentHashHeader, hash)
+	r.Header.Set("Authorization", fmt.Sprintf("%s %s:%d:%s:%s", HMACScheme, name, ts, nonce, sig))
+	return nil
+}
+
+// ReadClientFile reads a client credentials file.  It holds a
+// "token TOKEN" line or a "key NAME SECRET" line, the latter returned as
+// NAME:SECRET.  Blank lines and lines starting with "#" are ignored.
+func ReadClientFile(path string) (token, key string, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(fields[0], "#"):
+			continue
+		case fields[0] == "token" && len(fields) == 2:
+			token = fields[1]
+		case fields[0] == "key" && len(fields) == 3:
+			key = fields[1] + ":" + fields[2]
+		default:
+			return "", "", fmt.Errorf("%s: Unknown line: %s", path, scanner.Text())
+		}
+	}
+	return token, key, scanner.Err()
+}
+
+// Transport is an http.RoundTripper that signs each request with Key, a
+// NAME:SECRET pair, or failing that sets Token as its bearer token.
+type Transport struct {
+	Base  http.RoundTripper
+	Token string
+	Key   string
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	if i := strings.Index(t.Key, ":"); i >= 0 {
+		if err := Sign(r, t.Key[:i], t.Key[i+1:], time.Now()); err != nil {
+			return nil, err
+		}
+	} else {
+		SetBearer(r, t.Token)
+	}
+	return t.Base.RoundTrip(r)
+}
+
+// Authenticate returns the credential the request was made with or an
+// error if the request has no valid credentials.  A signed request is
+// only accepted once.
+func (c Credentials) Authenticate(r *http.Request, now time.Time) (*Credential, error) {
+	header := r.Header.Get("Authorization")
+	i := strings.Index(header, " ")
+	if i < 0 {
+		return nil, fmt.Errorf("No credentials")
+	}
+	scheme, value := header[:i], strings.TrimSpace(header[i+1:])
+
+	switch {
+	case strings.EqualFold(scheme, BearerScheme):
+		for _, cred := range c {
+			if subtle.ConstantTimeCompare([]byte(cred.Secret), []byte(value)) == 1 {
+				return cred, nil
+			}
+		}
+		return nil, fmt.Errorf("Invalid token")
+	case strings.EqualFold(scheme, HMACScheme):
+		parts := strings.SplitN(value, ":", 4)
+		if len(parts) != 4 || parts[2] == "" {
+			return nil, fmt.Errorf("Malformed signature")
+		}
+		cred := c[parts[0]]
+		if cred == nil {
+			return nil, fmt.Errorf("Unknown key %s", parts[0])
+		}
+		ts, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed signature timestamp")
+		}
+		skew := now.Sub(time.Unix(ts, 0))
+		if skew > MaxSkew || skew < -MaxSkew {
+			return nil, fmt.Errorf("Signature timestamp outside of %s", MaxSkew)
+		}
+		uri := r.RequestURI
+		if uri == "" {
+			uri = r.URL.RequestURI()
+		}
+		hash := r.Header.Get(ContentHashHeader)
+		expected := Signature(cred.Secret, r.Method, r.Host, uri, ts, parts[2], hash)
+		if !hmac.Equal([]byte(expected), []byte(parts[3])) {
+			return nil, fmt.Errorf("Invalid signature")
+		}
+		// Only read the body of signed requests to check its hash
+		body, err := readBody(r)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading body: %s", err)
+		}
+		if !hmac.Equal([]byte(bodyHash(body)), []byte(hash)) {
+			return nil, fmt.Errorf("Body does not match signature")
+		}
+		if !seen.add(expected, now) {
+			return nil, fmt.Errorf("Replayed signature")
+		}
+		return cred, nil
+	}
+	return nil, fmt.Errorf("Unsupported authorization scheme %s", scheme)
+}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeCredentials(t *testing.T, content string) string {
+	fd, err := ioutil.TempFile("", "buckyauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString(content)
+	fd.Close()
+	return fd.Name()
+}
+
+func TestLoadCredentials(t *testing.T) {
+	path := writeCredentials(t, `
+# Comments and blank lines are skipped
+reader  read  s3cret
+admin   write t0ps3cret
+`)
+	defer os.Remove(path)
+
+	creds, err := LoadCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 2 {
+		t.Fatalf("Expected 2 credentials, got %d", len(creds))
+	}
+	if creds["reader"].Write || creds["reader"].Secret != "s3cret" {
+		t.Errorf("Bad reader credential: %v", creds["reader"])
+	}
+	if !creds["admin"].Write {
+		t.Errorf("admin should have write permission")
+	}
+
+	bad := []string{
+		"reader read",
+		"reader admin s3cret",
+		"a:b read s3cret",
+		"reader read a\nreader write b",
+	}
+	for _, content := range bad {
+		path := writeCredentials(t, content)
+		if _, err := LoadCredentials(path); err == nil {
+			t.Errorf("Accepted invalid credentials: %q", content)
+		}
+		os.Remove(path)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	creds := Credentials{
+		"reader": &Credential{Name: "reader", Secret: "s3cret"},
+		"admin":  &Credential{Name: "admin", Secret: "t0ps3cret", Write: true},
+	}
+	now := time.Now()
+	newRequest := func() *http.Request {
+		r, _ := http.NewRequest("DELETE", "http://localhost:4242/metrics/foo.bar?x=1", nil)
+		return r
+	}
+
+	r := newRequest()
+	if _, err := creds.Authenticate(r, now); err == nil {
+		t.Errorf("Request without credentials was accepted")
+	}
+
+	r = newRequest()
+	SetBearer(r, "s3cret")
+	if c, err := creds.Authenticate(r, now); err != nil || c.Name != "reader" {
+		t.Errorf("Bearer token not accepted: %v %v", c, err)
+	}
+	SetBearer(r, "wrong")
+	if _, err := creds.Authenticate(r, now); err == nil {
+		t.Errorf("Invalid bearer token was accepted")
+	}
+
+	r = newRequest()
+	Sign(r, "admin", "t0ps3cret", now)
+	if c, err := creds.Authenticate(r, now); err != nil || c.Name != "admin" {
+		t.Errorf("Signed request not accepted: %v %v", c, err)
+	}
+	if _, err := creds.Authenticate(r, now.Add(2*MaxSkew)); err == nil {
+		t.Errorf("Stale signature was accepted")
+	}
+
+	// The signature covers the method and URI
+	r.Method = "GET"
+	if _, err := creds.Authenticate(r, now); err == nil {
+		t.Errorf("Signature accepted for a different method")
+	}
+	r = newRequest()
+	Sign(r, "admin", "t0ps3cret", now)
+	r.URL.Path = "/metrics/other"
+	if _, err := creds.Authenticate(r, now); err == nil {
+		t.Errorf("Signature accepted for a different URI")
+	}
+
+	r = newRequest()
+	Sign(r, "admin", "wrong", now)
+	if _, err := creds.Authenticate(r, now); err == nil {
+		t.Errorf("Signature with the wrong secret was accepted")
+	}
+	r = newRequest()
+	Sign(r, "nobody", "t0ps3cret", now)
+	if _, err := creds.Authenticate(r, now); err == nil {
+		t.Errorf("Signature with an unknown name was accepted")
+	}
+}
+
+func TestSignBody(t *testing.T) {
+	creds := Credentials{
+		"admin": &Credential{Name: "admin", Secret: "t0ps3cret", Write: true},
+	}
+	now := time.Now()
+	newRequest := func(body string) *http.Request {
+		r, _ := http.NewRequest("POST", "http://localhost:4242/batch/delete",
+			bytes.NewBufferString(body))
+		return r
+	}
+
+	r := newRequest(`["foo.bar"]`)
+	if err := Sign(r, "admin", "t0ps3cret", now); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(r.Body); string(body) != `["foo.bar"]` {
+		t.Errorf("Signing consumed the body: %q", body)
+	}
+
+	replay := func(body, host string) error {
+		s := newRequest(body)
+		s.Host = host
+		s.Header = r.Header.Clone()
+		c, err := creds.Authenticate(s, now)
+		if err == nil {
+			// The body can still be read by the handler
+			if blob, _ := ioutil.ReadAll(s.Body); string(blob) != body || c.Name != "admin" {
+				t.Errorf("Authenticate lost the body: %q", blob)
+			}
+		}
+		return err
+	}
+	if err := replay(`["foo.bar"]`, "localhost:4242"); err != nil {
+		t.Errorf("Signed request not accepted: %s", err)
+	}
+	if err := replay(`["foo.bar"]`, "localhost:4242"); err == nil {
+		t.Errorf("Signed request accepted a second time")
+	}
+	if err := replay(`["foo.*"]`, "localhost:4242"); err == nil {
+		t.Errorf("Signature accepted for a different body")
+	}
+	if err := replay(`["foo.bar"]`, "other:4242"); err == nil {
+		t.Errorf("Signature accepted for a different host")
+	}
+
+	// Nor may the claimed hash be swapped along with the body
+	s := newRequest(`["foo.*"]`)
+	s.Header = r.Header.Clone()
+	s.Header.Set(ContentHashHeader, bodyHash([]byte(`["foo.*"]`)))
+	if _, err := creds.Authenticate(s, now); err == nil {
+		t.Errorf("Signature accepted with a replaced body hash")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	creds := Credentials{
+		"admin": &Credential{Name: "admin", Secret: "t0ps3cret", Write: true},
+	}
+	now := time.Now()
+
+	// Identical requests signed in the same second are both accepted
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("DELETE", "http://localhost:4242/metrics/foo.bar", nil)
+		Sign(r, "admin", "t0ps3cret", now)
+		if _, err := creds.Authenticate(r, now); err != nil {
+			t.Errorf("Signed request %d not accepted: %s", i, err)
+		}
+	}
+
+	c := &replayCache{expires: make(map[string]time.Time)}
+	for _, test := range []struct {
+		sig string
+		at  time.Duration
+		ok  bool
+	}{
+		{"a", 0, true},
+		{"a", time.Second, false},
+		{"b", time.Second, true},
+		{"a", 2 * MaxSkew, false},
+		{"a", 2*MaxSkew + time.Second, true},
+		{"b", 2*MaxSkew + 2*time.Second, true},
+	} {
+		if ok := c.add(test.sig, now.Add(test.at)); ok != test.ok {
+			t.Errorf("Adding %s after %s returned %t", test.sig, test.at, ok)
+		}
+	}
+	if len(c.expires) != 2 {
+		t.Errorf("Replay cache holds %d signatures", len(c.expires))
+	}
+}
+
+func TestReadClientFile(t *testing.T) {
+	path := writeCredentials(t, "# peer credentials\n\nkey admin t0ps3cret\n")
+	defer os.Remove(path)
+	token, key, err := ReadClientFile(path)
+	if err != nil || token != "" || key != "admin:t0ps3cret" {
+		t.Errorf("ReadClientFile returned %q, %q, %v", token, key, err)
+	}
+
+	bad := writeCredentials(t, "key admin\n")
+	defer os.Remove(bad)
+	if _, _, err := ReadClientFile(bad); err == nil {
+		t.Errorf("Accepted an invalid client credentials file")
+	}
+}
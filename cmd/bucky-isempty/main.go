@@ -28,8 +28,8 @@ func usage() {
 prints the path if no data points are found.  Options allow finding the
 time and value of the most recent data point in the DB file.  If no files
 are given on the command line all WSP found in the file tree rooted at the
-prefix are scanned.  Useful for finding empty WSP files that can be removed.
-All errors and logs are reported to STDERR.`)
+prefix, or at each instance prefix, are scanned.  Useful for finding empty
+WSP files that can be removed.  All errors and logs are reported to STDERR.`)
 	fmt.Printf("\n\n")
 	flag.PrintDefaults()
 }
@@ -130,10 +130,12 @@ func main() {
 			examine(p, stat, nil)
 		}
 	} else {
-		// Start our walk
-		err := filepath.Walk(metrics.Prefix, examine)
-		if err != nil {
-			log.Fatalf("%s\n", err)
+		// Start our walk of each whisper store
+		for _, root := range metrics.Roots() {
+			err := filepath.Walk(root, examine)
+			if err != nil {
+				log.Fatalf("%s\n", err)
+			}
 		}
 	}
 }
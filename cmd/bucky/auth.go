@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import "github.com/jjneely/buckytools/auth"
+
+// authToken is the bearer token sent to the buckyd daemons.
+var authToken string
+
+// authKey is the NAME:SECRET pair used to sign requests to the buckyd
+// daemons.
+var authKey string
+
+// authFile is the path of the client credentials file.
+var authFile string
+
+// SetupAuth installs the --token, --key and --auth-file flags in the
+// given Command.  These default to the BUCKYTOKEN, BUCKYKEY and
+// BUCKYAUTHFILE environment variables.
+func SetupAuth(c Command) {
+	file := os.Getenv("BUCKYAUTHFILE")
+	if file == "" && os.Getenv("HOME") != "" {
+		file = filepath.Join(os.Getenv("HOME"), ".buckyauth")
+	}
+
+	c.Flag.StringVar(&authToken, "token", os.Getenv("BUCKYTOKEN"),
+		"Bearer token for the buckyd daemons.")
+	c.Flag.StringVar(&authKey, "key", os.Getenv("BUCKYKEY"),
+		"NAME:SECRET to sign requests to the buckyd daemons.")
+	c.Flag.StringVar(&authFile, "auth-file", file,
+		"File holding a \"token TOKEN\" or \"key NAME SECRET\" line.")
+}
+
+// readAuthFile sets authToken or authKey from the credentials file if
+// neither was given.  A missing file is not an error.
+func readAuthFile() error {
+	if authToken != "" || authKey != "" || authFile == "" {
+		return nil
+	}
+	var err error
+	authToken, authKey, err = auth.ReadClientFile(authFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// authRoundTripper wraps base to add the configured credentials to each
+// request.  base is returned if there are no credentials.
+func authRoundTripper(base http.RoundTripper) http.RoundTripper {
+	if err := readAuthFile(); err != nil {
+		log.Fatalf("Error reading credentials: %s", err)
+	}
+	if authKey != "" && !strings.Contains(authKey, ":") {
+		log.Fatalf("The signing key must be given as NAME:SECRET")
+	}
+	if authToken == "" && authKey == "" {
+		return base
+	}
+	return &auth.Transport{Base: base, Token: authToken, Key: authKey}
+}
@@ -6,7 +6,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +19,9 @@ type MigrateWork struct {
 	newName     string
 	oldLocation string
 	newLocation string
+
+	// fill is true when the source is a replica that must be kept
+	fill bool
 }
 
 func init() {
@@ -37,49 +42,33 @@ by -h or the BUCKYHOST environment variable.  Cluster health is not checked.
 Backfills that result in metrics that live on a different host will be
 completed, so other hosts will be affected even with -s.
 
+When the cluster stores more than one replica of each metric every replica
+of the new metric is filled.
+
 This operation is idempotent.  Repeated runs will find new metrics already
 filled and not overwrite data points.  The old or source metrics are not
 modified or removed.
 
-Set -w to change the number of worker threads used to upload the Whisper
-DBs to the remote servers.`
+Each source server is asked to push its metrics straight to the server of
+the new metric in batches of the size given by -batch.  Set -w to change
+the number of batches backfilled at once.  Metrics on servers that cannot
+push are copied through this client.`
 
 	c := NewCommand(backfillCommand, "backfill", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
+	SetupBatch(c)
+	SetupTransfer(c)
 
 	c.Flag.IntVar(&metricWorkers, "w", 5,
-		"Downloader threads.")
+		"Batches backfilled at once.")
 	c.Flag.IntVar(&metricWorkers, "workers", 5,
-		"Downloader threads.")
+		"Batches backfilled at once.")
 	c.Flag.BoolVar(&listForce, "f", false,
 		"Force the remote daemons to rebuild their cache.")
 }
 
-func backfillWorker(workIn chan *MigrateWork, wg *sync.WaitGroup) {
-	for work := range workIn {
-		if Verbose {
-			log.Printf("Backfilling [%s] %s => [%s] %s",
-				work.oldLocation, work.oldName,
-				work.newLocation, work.newName)
-		}
-		metric, err := GetMetricData(work.oldLocation, work.oldName)
-		if err != nil {
-			// errors already handled
-			workerErrors = true
-			continue
-		}
-		metric.Name = work.newName
-		err = PostMetric(work.newLocation, metric)
-		if err != nil {
-			// errors already handled
-			workerErrors = true
-		}
-	}
-	wg.Done()
-}
-
 // BackfillMetrics takes a list of Graphite servers to operate on and a map
 // of old metric => new metric.  The new metric name will have the data from
 // the old metric backfilled into it.
@@ -102,46 +91,67 @@ func BackfillMetrics(metricMap map[string]string) error {
 		return err
 	}
 
-	// re-create our map, so that we spread out load, and lessen complexity
-	backfillJob := make(map[string]string)
+	// re-create our map of old metric => servers holding a copy
+	backfillJob := make(map[string][]string)
 	for server, metrics := range locations {
 		for _, m := range metrics {
-			backfillJob[m] = server
+			backfillJob[m] = append(backfillJob[m], server)
 		}
 	}
 
-	workIn := make(chan *MigrateWork, 25)
-	wg := new(sync.WaitGroup)
-	wg.Add(metricWorkers)
-	for i := 0; i < metricWorkers; i++ {
-		go backfillWorker(workIn, wg)
+	// Fill each replica of the new metric, from a copy of the old metric
+	// on the same server when there is one
+	ring := Cluster.Ring()
+	jobs := make([]*MigrateWork, 0)
+	for m, servers := range backfillJob {
+		sort.Strings(servers)
+		newName := CleanMetric(metricMap[m])
+		for _, replica := range ring.ReplicaServers(newName) {
+			work := new(MigrateWork)
+			work.oldName = m
+			work.newName = newName
+			work.oldLocation = servers[0]
+			work.newLocation = fmt.Sprintf("%s:%s", replica, Cluster.Port)
+			if containsString(servers, work.newLocation) {
+				if m == newName {
+					// Already in place
+					continue
+				}
+				work.oldLocation = work.newLocation
+			}
+			jobs = append(jobs, work)
+		}
 	}
 
-	c := 0
-	l := len(backfillJob)
+	// Report progress as backfills complete
+	var c int64
+	l := len(jobs)
 	t := time.Now().Unix()
-	for m, server := range backfillJob {
-		work := new(MigrateWork)
-		work.oldName = m
-		work.newName = CleanMetric(metricMap[m])
-		work.oldLocation = server
-		work.newLocation = Cluster.Hash.GetNode(work.newName).Server
-
-		workIn <- work
-		c++
-		if c%10 == 0 {
-			now := time.Now().Unix()
-			s := now - t
+	done := func(work *MigrateWork) {
+		n := atomic.AddInt64(&c, 1)
+		if n%100 == 0 {
+			s := time.Now().Unix() - t
 			if s == 0 {
 				s = 1
 			}
 			log.Printf("Progress %d / %d: %.2f  Metrics/second: %.2f",
-				c, l,
-				100*float64(c)/float64(l),
-				float64(c)/float64(s))
+				n, l,
+				100*float64(n)/float64(l),
+				float64(n)/float64(s))
 		}
 	}
 
+	workIn := make(chan *PushWork, metricWorkers)
+	wg := new(sync.WaitGroup)
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go pushWorker(workIn, done, wg)
+	}
+
+	for _, work := range pushBatches(jobs) {
+		workIn <- work
+	}
+
 	close(workIn)
 	wg.Wait()
 	log.Printf("Backfill request complete.")
@@ -186,6 +196,11 @@ func backfillCommand(c Command) int {
 		return 1
 	}
 
+	if err = StartTransfers(); err != nil {
+		log.Print(err)
+		return 1
+	}
+
 	if c.Flag.Arg(0) != "-" {
 		fd, err = os.Open(c.Flag.Arg(0))
 		if err != nil {
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// batchSize is the number of metrics sent to a buckyd daemon in each batch
+// request.
+var batchSize int
+
+// errBatchUnsupported is returned by BatchRemote when the daemon predates
+// the /batch/ API.
+var errBatchUnsupported = errors.New("Batch requests are not supported")
+
+// errBatchRefused is returned by postBatch when the daemon rejects the
+// request as bad.
+var errBatchRefused = errors.New("Batch request refused")
+
+// BatchWork is a batch of metrics on a single server.
+type BatchWork struct {
+	server string
+	names  []string
+}
+
+// SetupBatch installs the -batch flag in the given Command.
+func SetupBatch(c Command) {
+	c.Flag.IntVar(&batchSize, "batch", 1000,
+		"Metrics per batch request to a buckyd daemon.")
+}
+
+// batches splits the metrics of each server into batches of at most
+// batchSize metrics.
+func batches(metricMap map[string][]string) []*BatchWork {
+	size := batchSize
+	if size < 1 {
+		size = 1
+	}
+	work := make([]*BatchWork, 0)
+	for server, metrics := range metricMap {
+		for i := 0; i < len(metrics); i += size {
+			end := i + size
+			if end > len(metrics) {
+				end = len(metrics)
+			}
+			work = append(work, &BatchWork{server, metrics[i:end]})
+		}
+	}
+	return work
+}
+
+// streamBatches issues the list requests and calls fn with a batch of the
+// metrics on a server each time batchSize of them have been listed, and
+// with the rest at the end, so the listings are never held in memory.
+func streamBatches(requests []metricListRequest, fn func(*BatchWork)) error {
+	size := batchSize
+	if size < 1 {
+		size = 1
+	}
+	pending := make(map[string][]string)
+	err := mergeListRequests(requests, func(server, m string) {
+		pending[server] = append(pending[server], m)
+		if len(pending[server]) >= size {
+			fn(&BatchWork{server, pending[server]})
+			pending[server] = nil
+		}
+	})
+	for server, names := range pending {
+		if len(names) > 0 {
+			fn(&BatchWork{server, names})
+		}
+	}
+	return err
+}
+
+// BatchRemote runs the batch operation op, one of stat, exists or delete,
+// on the given metrics on server.  fn is called with the result for each
+// metric as it arrives.
+func BatchRemote(server, op string, metrics []string, fn func(*BatchResult)) error {
+	items := make([]interface{}, len(metrics))
+	for i, m := range metrics {
+		items[i] = m
+	}
+	return postBatch(server, "/batch/"+op, "", items, fn)
+}
+
+// postBatch POSTs the items as NDJSON to the path on server and calls fn
+// with each BatchResult streamed back.  errBatchUnsupported is returned
+// if the daemon does not know the path and errBatchRefused if it returns
+// 400 Bad Request.
+func postBatch(server, path, query string, items []interface{}, fn func(*BatchResult)) error {
+	var err error
+	u := &url.URL{
+		Scheme:   URLScheme(),
+		Path:     path,
+		RawQuery: query,
+	}
+	u.Host, err = SanitizeHostPort(server)
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return err
+	}
+
+	body := new(bytes.Buffer)
+	enc := json.NewEncoder(body)
+	for _, item := range items {
+		enc.Encode(item)
+	}
+	r, err := http.NewRequest("POST", u.String(), body)
+	if err != nil {
+		log.Printf("Error building request: %s", err)
+		return err
+	}
+	r.Header.Set("Content-Type", NDJSON)
+
+	resp, err := GetHTTP().Do(r)
+	if err != nil {
+		log.Printf("Error communicating: %s", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		return errBatchUnsupported
+	case 400:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("Error: %s on %s refused: %s", path, server,
+			strings.TrimSpace(string(msg)))
+		return errBatchRefused
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("Error: %s on %s returned %s: %s", path, server,
+			resp.Status, string(msg))
+		return fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	count := 0
+	for dec.More() {
+		result := new(BatchResult)
+		if err := dec.Decode(result); err != nil {
+			log.Printf("Error decoding batch results from %s: %s", server, err)
+			return err
+		}
+		fn(result)
+		count++
+	}
+	if count != len(items) {
+		log.Printf("Error: %s on %s returned %d of %d results", path, server,
+			count, len(items))
+		return fmt.Errorf("%s returned %d of %d results", path, count, len(items))
+	}
+	return nil
+}
+
+// BatchStat stats the given metrics on server calling fn with each that
+// exists.  Metrics that could not be stat'd are logged and an error is
+// returned.  Daemons without the batch API are asked one metric at a time.
+func BatchStat(server string, metrics []string, fn func(*MetricData)) error {
+	var failed error
+	err := BatchRemote(server, "stat", metrics, func(result *BatchResult) {
+		switch {
+		case result.Status == 200 && result.Stat != nil:
+			fn(result.Stat)
+		case result.Status == 404:
+			log.Printf("Metric not found: %s", result.Name)
+			failed = fmt.Errorf("Metric not found.")
+		default:
+			log.Printf("Error: Stat of %s failed: %s", result.Name, result.Error)
+			failed = fmt.Errorf("Stat failed: %s", result.Error)
+		}
+	})
+	if err == errBatchUnsupported {
+		for _, m := range metrics {
+			stat, err := StatRemoteMetric(server, m)
+			if err != nil {
+				failed = err
+			} else {
+				fn(stat)
+			}
+		}
+		return failed
+	}
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+// BatchDigest digests the datapoints of the given metrics on server
+// between from and until, in Unix seconds, calling fn with the result for
+// each metric.  A from of 0 starts at the retention of each metric.
+func BatchDigest(server string, metrics []string, from, until int64, fn func(*BatchResult)) error {
+	items := make([]*BatchItem, len(metrics))
+	for i, m := range metrics {
+		items[i] = &BatchItem{Name: m, From: from, Until: until}
+	}
+	return BatchDigestItems(server, items, fn)
+}
+
+// BatchDigestItems digests the datapoints of each metric on server over
+// the time span of its item, calling fn with the result for each.
+func BatchDigestItems(server string, items []*BatchItem, fn func(*BatchResult)) error {
+	list := make([]interface{}, len(items))
+	for i, item := range items {
+		list[i] = item
+	}
+	err := postBatch(server, "/batch/digest", "", list, fn)
+	if err == errBatchUnsupported {
+		log.Printf("Error: %s does not support digests, upgrade buckyd", server)
+	}
+	return err
+}
+
+// BatchDelete deletes the given metrics on server calling fn, if not nil,
+// with each metric deleted.  Each metric deleted or not is logged and an
+// error is returned if any were not deleted.  Daemons without the batch
+// API are asked one metric at a time.
+func BatchDelete(server string, metrics []string, fn func(string)) error {
+	var failed error
+	err := BatchRemote(server, "delete", metrics, func(result *BatchResult) {
+		switch result.Status {
+		case 200:
+			log.Printf("DELETED: %s", result.Name)
+			if fn != nil {
+				fn(result.Name)
+			}
+		case 404:
+			log.Printf("Not found / Not deleted: %s", result.Name)
+			failed = fmt.Errorf("Metric not found.")
+		default:
+			log.Printf("Error: Delete of %s failed: %s", result.Name, result.Error)
+			failed = fmt.Errorf("Delete failed: %s", result.Error)
+		}
+	})
+	if err == errBatchUnsupported {
+		for _, m := range metrics {
+			if err := DeleteMetric(server, m); err != nil {
+				failed = err
+			} else if fn != nil {
+				fn(m)
+			}
+		}
+		return failed
+	}
+	if err != nil {
+		return err
+	}
+	return failed
+}
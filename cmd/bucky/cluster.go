@@ -20,6 +20,12 @@ type ClusterConfig struct {
 	// that the cluster is using
 	Hash hashing.HashRing
 
+	// Algo is the name of the hashing algorithm of Hash
+	Algo string
+
+	// Replicas is the number of servers each metric is stored on
+	Replicas int
+
 	// Healthy is true if the cluster configuration represents a Healthy
 	// cluster
 	Healthy bool
@@ -62,21 +68,26 @@ func GetClusterConfig(hostport string) (*ClusterConfig, error) {
 	Cluster = new(ClusterConfig)
 	Cluster.Port = port
 	Cluster.Servers = make([]string, 0)
-	switch master.Algo {
-	case "carbon":
-		Cluster.Hash = hashing.NewCarbonHashRing()
-	case "fnv1a":
-		Cluster.Hash = hashing.NewFNV1aHashRing()
-	case "jump_fnv1a":
-		Cluster.Hash = hashing.NewJumpHashRing(master.Replicas)
-	default:
-		log.Printf("Unknown consistent hash algorithm: %s", master.Algo)
-		return nil, fmt.Errorf("Unknown consistent hash algorithm: %s", master.Algo)
+	Cluster.Algo = master.Algo
+	Cluster.Replicas = master.Replicas
+	if Cluster.Replicas < 1 {
+		Cluster.Replicas = 1
+	}
+	Cluster.Hash, err = master.HashRing()
+	if err != nil {
+		log.Printf("%s", err)
+		Cluster = nil
+		return nil, err
 	}
 
+	// A server running several carbon-cache instances appears in the
+	// ring once per instance, but runs a single buckyd.
+	seen := make(map[string]bool)
 	for _, v := range master.Nodes {
-		Cluster.Hash.AddNode(v)
-		Cluster.Servers = append(Cluster.Servers, v.Server)
+		if !seen[v.Server] {
+			seen[v.Server] = true
+			Cluster.Servers = append(Cluster.Servers, v.Server)
+		}
 	}
 
 	members := make([]*hashing.JSONRingType, 0)
@@ -93,27 +104,31 @@ func GetClusterConfig(hostport string) (*ClusterConfig, error) {
 		members = append(members, member)
 	}
 
-	Cluster.Healthy = isHealthy(master, members)
+	Cluster.Healthy = isHealthy(master, members, len(Cluster.Servers))
 	return Cluster, nil
 }
 
 // isHealthy will return true if the cluster ring data represents
 // a healthy cluster.  The master is the initial buckyd daemon we
 // built the list from.  The ring is a slice of ring objects from each
-// server in the cluster except the initial buckyd daemon.
-func isHealthy(master *hashing.JSONRingType, ring []*hashing.JSONRingType) bool {
-	// XXX: Take replicas into account
+// server in the cluster except the initial buckyd daemon.  servers is the
+// number of distinct servers in the master's ring.
+func isHealthy(master *hashing.JSONRingType, ring []*hashing.JSONRingType, servers int) bool {
 	// The initial buckyd daemon isn't in the ring, so we need to add 1
 	// to the length.
-	if len(master.Nodes) != len(ring)+1 {
+	if servers != len(ring)+1 {
 		return false
 	}
 
 	// We compare each ring to the first one
 	for _, v := range ring {
+		if v == nil {
+			// This member did not respond
+			return false
+		}
 		// Order, host:instance pair, must be the same.  You configured
 		// your cluster with a CM tool, right?
-		if master.Algo != v.Algo {
+		if master.Algo != v.Algo || master.Replicas != v.Replicas {
 			return false
 		}
 		if len(v.Nodes) != len(master.Nodes) {
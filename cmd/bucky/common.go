@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 )
 
 import "github.com/golang/snappy"
@@ -31,19 +32,25 @@ var Verbose bool
 
 // httpClient is a cached http.Client. Use GetHTTP() to setup and return.
 var httpClient *http.Client
+var httpClientOnce sync.Once
 
 // GetHTTP returns a *http.Client that can be used to interact with remote
-// buckyd daemons.
+// buckyd daemons.  It is safe to call from the workers at once.
 func GetHTTP() *http.Client {
-	if httpClient != nil {
-		return httpClient
-	}
-
-	httpClient = new(http.Client)
+	httpClientOnce.Do(func() {
+		config, err := clientTLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
 
-	// Set a 30 second timeout on all operations
-	//httpClient.Timeout = 30 * time.Second
+		httpClient = new(http.Client)
+		httpClient.Transport = authRoundTripper(transport)
 
+		// Set a 30 second timeout on all operations
+		//httpClient.Timeout = 30 * time.Second
+	})
 	return httpClient
 }
 
@@ -121,7 +128,7 @@ func DeleteMetric(server, metric string) error {
 	var err error
 	httpClient := GetHTTP()
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: URLScheme(),
 		Path:   "/metrics/" + metric,
 	}
 	u.Host, err = SanitizeHostPort(server)
@@ -171,7 +178,7 @@ func GetMetricData(server, name string) (*MetricData, error) {
 	var err error
 	httpClient := GetHTTP()
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: URLScheme(),
 		Path:   "/metrics/" + name,
 	}
 	u.Host, err = SanitizeHostPort(server)
@@ -188,6 +195,7 @@ func GetMetricData(server, name string) (*MetricData, error) {
 		r.Header.Set("accept-encoding", "snappy")
 	}
 
+	defer sourceSlots.acquire(u.Host, sourceLimit)()
 	resp, err := httpClient.Do(r)
 	if err != nil {
 		log.Printf("Error downloading metric data: %s", err)
@@ -208,7 +216,7 @@ func GetMetricData(server, name string) (*MetricData, error) {
 		return nil, err
 	}
 
-	data.Data, err = ioutil.ReadAll(resp.Body)
+	data.Data, err = ioutil.ReadAll(throttleReader(resp.Body))
 	encoding := resp.Header.Get("Content-Encoding")
 	switch encoding {
 	case "snappy":
@@ -228,7 +236,7 @@ func StatRemoteMetric(server, metric string) (*MetricData, error) {
 	var err error
 	httpClient := GetHTTP()
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: URLScheme(),
 		Path:   "/metrics/" + metric,
 	}
 	u.Host, err = SanitizeHostPort(server)
@@ -288,7 +296,7 @@ func PostMetric(server string, metric *MetricData) error {
 	var err error
 	httpClient := GetHTTP()
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: URLScheme(),
 		Path:   "/metrics/" + metric.Name,
 	}
 	u.Host, err = SanitizeHostPort(server)
@@ -297,12 +305,13 @@ func PostMetric(server string, metric *MetricData) error {
 		return nil
 	}
 
-	buf := bytes.NewBuffer(metric.Data)
+	buf := throttleReader(bytes.NewBuffer(metric.Data))
 	r, err := http.NewRequest("POST", u.String(), buf)
 	if err != nil {
 		log.Printf("Error building request: %s", err)
 		return err
 	}
+	r.ContentLength = int64(len(metric.Data))
 	statInfo, err := json.Marshal(metric)
 	if err != nil {
 		return err
@@ -315,6 +324,7 @@ func PostMetric(server string, metric *MetricData) error {
 	}
 
 	// This doesn't return until the backfill operation completes
+	defer destSlots.acquire(u.Host, destLimit)()
 	resp, err := httpClient.Do(r)
 	if err != nil {
 		log.Printf("Error communicating with server: %s", err)
@@ -338,7 +348,7 @@ func PostMetric(server string, metric *MetricData) error {
 // string must include any port information.
 func GetSingleHashRing(server string) (*hashing.JSONRingType, error) {
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: URLScheme(),
 		Host:   server,
 		Path:   "/hashring",
 	}
@@ -384,6 +394,8 @@ func SetupCommon(c Command) {
 		"Verbose log output.")
 	c.Flag.BoolVar(&NoEncoding, "no-encoding", false,
 		"Disable Content-Encoding methods for HTTP API calls.")
+	SetupAuth(c)
+	SetupTLS(c)
 }
 
 // SetupHostname sets up a generic find the host to connect to flag
@@ -428,9 +440,78 @@ func SetupJSON(c Command) {
 		"Instead of text ouput JSON encoded data.")
 }
 
+// statFilter is a flag.Value holding a string that is checked by parse
+// when set.  The string is passed unchanged to the buckyd daemons.
+type statFilter struct {
+	value string
+	parse func(string) (int64, error)
+}
+
+func (f *statFilter) String() string {
+	return f.value
+}
+
+func (f *statFilter) Set(s string) error {
+	if _, err := f.parse(s); err != nil {
+		return err
+	}
+	f.value = s
+	return nil
+}
+
+// Filters on the modification time and size of metrics evaluated by the
+// buckyd daemons when listing metrics.  Setup by SetupStatFilters().
+var (
+	olderThan = &statFilter{parse: ParseAge}
+	newerThan = &statFilter{parse: ParseAge}
+	minSize   = &statFilter{parse: ParseSize}
+	maxSize   = &statFilter{parse: ParseSize}
+)
+
+// SetupStatFilters installs the --older-than, --newer-than, --min-size
+// and --max-size flags in the given Command.
+func SetupStatFilters(c Command) {
+	c.Flag.Var(olderThan, "older-than",
+		"Only metrics not modified within this age such as 30d.")
+	c.Flag.Var(newerThan, "newer-than",
+		"Only metrics modified within this age such as 12h.")
+	c.Flag.Var(minSize, "min-size",
+		"Only metrics at least this size such as 50M.")
+	c.Flag.Var(maxSize, "max-size",
+		"Only metrics at most this size such as 1G.")
+}
+
+// statFiltersSet returns true if any stat filter was given on the command
+// line.
+func statFiltersSet() bool {
+	return olderThan.value != "" || newerThan.value != "" ||
+		minSize.value != "" || maxSize.value != ""
+}
+
+// setStatFilters adds the query parameters for any stat filters given on
+// the command line to query.
+func setStatFilters(query url.Values) {
+	params := map[string]*statFilter{
+		"older_than": olderThan,
+		"newer_than": newerThan,
+		"min_size":   minSize,
+		"max_size":   maxSize,
+	}
+	for k, v := range params {
+		if v.value != "" {
+			query.Set(k, v.value)
+		}
+	}
+}
+
 // CleanMetric sanitizes the given metric key by removing adjacent "."
-// characters and replacing any "/" characters with "."
+// characters and replacing any "/" characters with "."  Tagged series
+// are normalized instead.
 func CleanMetric(m string) string {
+	if IsTagged(m) {
+		return HashKey(m)
+	}
+
 	// Slash isn't really illegal but gets interperated as a directory
 	// on the Graphite server
 	m = strings.Replace(m, "/", ".", -1)
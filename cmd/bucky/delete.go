@@ -13,11 +13,6 @@ import (
 var deleteRegexMode bool
 var deleteForce bool
 
-type DeleteWork struct {
-	server string
-	name   string
-}
-
 func init() {
 	usage := "[options] <metric expression>"
 	short := "List out matching metrics."
@@ -31,13 +26,20 @@ Use -r to enable regular expression mode.  The first argument is a regular
 expression.  If metrics names match they will be included in the output.
 
 Use -s to only delete metrics found on the server specified by -h or the
-BUCKYSERVER environment variable.`
+BUCKYSERVER environment variable.
+
+The --older-than, --newer-than, --min-size and --max-size flags further
+restrict the metrics by their modification time and size as last seen by
+the remote daemons.  With one of these flags the metric expression may be
+left out to select from all metrics.`
 
 	c := NewCommand(deleteCommand, "delete", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
 	SetupJSON(c)
+	SetupStatFilters(c)
+	SetupBatch(c)
 
 	c.Flag.BoolVar(&deleteRegexMode, "r", false,
 		"Filter by a regular expression.")
@@ -49,9 +51,9 @@ BUCKYSERVER environment variable.`
 		"Downloader threads.")
 }
 
-func deleteWorker(workIn chan *DeleteWork, wg *sync.WaitGroup) {
+func deleteWorker(workIn chan *BatchWork, wg *sync.WaitGroup) {
 	for work := range workIn {
-		err := DeleteMetric(work.server, work.name)
+		err := BatchDelete(work.server, work.names, nil)
 		if err != nil {
 			workerErrors = true
 		}
@@ -61,7 +63,7 @@ func deleteWorker(workIn chan *DeleteWork, wg *sync.WaitGroup) {
 
 func deleteMetrics(metricMap map[string][]string) error {
 	wg := new(sync.WaitGroup)
-	workIn := make(chan *DeleteWork) // Purposely unbuffered
+	workIn := make(chan *BatchWork) // Purposely unbuffered
 
 	wg.Add(metricWorkers)
 	for i := 0; i < metricWorkers; i++ {
@@ -77,10 +79,7 @@ func deleteMetrics(metricMap map[string][]string) error {
 			continue
 		}
 		log.Printf("Deleting %d metrics on %s...", len(metrics), server)
-		for _, m := range metrics {
-			work := new(DeleteWork)
-			work.server = server
-			work.name = m
+		for _, work := range batches(map[string][]string{server: metrics}) {
 			workIn <- work
 		}
 	}
@@ -96,6 +95,17 @@ func deleteMetrics(metricMap map[string][]string) error {
 	return nil
 }
 
+// DeleteAllMetrics deletes every metric selected by the stat filters
+// alone.
+func DeleteAllMetrics(servers []string, force bool) error {
+	metricMap, err := ListAllMetrics(servers, listForce)
+	if err != nil {
+		return err
+	}
+
+	return deleteMetrics(metricMap)
+}
+
 // DeleteRegexMetrics deletes metrics matched by the given regular
 // expression.
 func DeleteRegexMetrics(servers []string, regex string, force bool) error {
@@ -144,8 +154,10 @@ func deleteCommand(c Command) int {
 		return 1
 	}
 
-	if c.Flag.NArg() == 0 {
+	if c.Flag.NArg() == 0 && !statFiltersSet() {
 		log.Fatal("At least one argument is required.")
+	} else if c.Flag.NArg() == 0 {
+		err = DeleteAllMetrics(Cluster.HostPorts(), deleteForce)
 	} else if deleteRegexMode && c.Flag.NArg() > 0 {
 		err = DeleteRegexMetrics(Cluster.HostPorts(), c.Flag.Arg(0), deleteForce)
 	} else if c.Flag.Arg(0) != "-" {
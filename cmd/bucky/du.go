@@ -10,6 +10,8 @@ import (
 	"sync"
 )
 
+import . "github.com/jjneely/buckytools/metrics"
+
 // duTotal is the result of the du operation in bytes.
 var duTotal int
 
@@ -26,13 +28,20 @@ Use -r to enable regular expression mode.  The first argument is a regular
 expression.  If metrics names match they will be included in the output.
 
 Use -s to only find metrics found on the server specified by -h or the
-BUCKYSERVER environment variable.`
+BUCKYSERVER environment variable.
+
+The --older-than, --newer-than, --min-size and --max-size flags further
+restrict the metrics by their modification time and size as last seen by
+the remote daemons.  With one of these flags the metric expression may be
+left out to select from all metrics.`
 
 	c := NewCommand(duCommand, "du", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
 	SetupJSON(c)
+	SetupStatFilters(c)
+	SetupBatch(c)
 
 	c.Flag.BoolVar(&listRegexMode, "r", false,
 		"Filter by a regular expression.")
@@ -42,13 +51,13 @@ BUCKYSERVER environment variable.`
 		"Downloader threads.")
 }
 
-func duWorker(workIn chan *DeleteWork, workOut chan int, wg *sync.WaitGroup) {
+func duWorker(workIn chan *BatchWork, workOut chan int, wg *sync.WaitGroup) {
 	for work := range workIn {
-		stat, err := StatRemoteMetric(work.server, work.name)
+		err := BatchStat(work.server, work.names, func(stat *MetricData) {
+			workOut <- int(stat.Size)
+		})
 		if err != nil {
 			workerErrors = true
-		} else {
-			workOut <- int(stat.Size)
 		}
 	}
 	wg.Done()
@@ -61,10 +70,10 @@ func duResults(workOut chan int, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
-func duMetrics(metricMap map[string][]string) (int, error) {
+func duMetrics(requests []metricListRequest) (int, error) {
 	wg := new(sync.WaitGroup)
 	wg2 := new(sync.WaitGroup)
-	workIn := make(chan *DeleteWork, 25)
+	workIn := make(chan *BatchWork, metricWorkers)
 	workOut := make(chan int, 25)
 
 	wg.Add(metricWorkers)
@@ -76,21 +85,13 @@ func duMetrics(metricMap map[string][]string) (int, error) {
 	go duResults(workOut, wg2)
 
 	c := 0
-	l := countMap(metricMap)
-	for server, metrics := range metricMap {
-		if len(metrics) == 0 {
-			continue
-		}
-		for _, m := range metrics {
-			work := new(DeleteWork)
-			work.server = server
-			work.name = m
-			workIn <- work
-			c++
-			if c%100 == 0 {
-				log.Printf("Progress: %d/%d %.2f%%", c, l, float64(c)/float64(l)*100)
-			}
-		}
+	err := streamBatches(requests, func(work *BatchWork) {
+		workIn <- work
+		c = c + len(work.names)
+		log.Printf("Progress: %d metrics", c)
+	})
+	if err != nil {
+		workerErrors = true
 	}
 
 	close(workIn)
@@ -107,22 +108,21 @@ func duMetrics(metricMap map[string][]string) (int, error) {
 	return duTotal, nil
 }
 
-func DuRegexMetrics(servers []string, regex string, force bool) (int, error) {
-	metricMap, err := ListRegexMetrics(servers, regex, force)
-	if err != nil {
-		return 0, err
-	}
+func DuAllMetrics(servers []string, force bool) (int, error) {
+	return duMetrics(allMetricsRequests(servers, force))
+}
 
-	return duMetrics(metricMap)
+func DuRegexMetrics(servers []string, regex string, force bool) (int, error) {
+	return duMetrics(regexMetricsRequests(servers, regex, force))
 }
 
 func DuSliceMetrics(servers []string, metrics []string, force bool) (int, error) {
-	metricMap, err := ListSliceMetrics(servers, metrics, force)
+	requests, err := sliceMetricsRequests(servers, metrics, force)
 	if err != nil {
 		return 0, err
 	}
 
-	return duMetrics(metricMap)
+	return duMetrics(requests)
 }
 
 func DuJSONMetrics(servers []string, fd io.Reader, force bool) (int, error) {
@@ -150,8 +150,10 @@ func duCommand(c Command) int {
 	}
 
 	var storage int
-	if c.Flag.NArg() == 0 {
+	if c.Flag.NArg() == 0 && !statFiltersSet() {
 		log.Fatal("At least one argument is required.")
+	} else if c.Flag.NArg() == 0 {
+		storage, err = DuAllMetrics(Cluster.HostPorts(), listForce)
 	} else if listRegexMode && c.Flag.NArg() > 0 {
 		storage, err = DuRegexMetrics(Cluster.HostPorts(), c.Flag.Arg(0), listForce)
 	} else if c.Flag.Arg(0) != "-" {
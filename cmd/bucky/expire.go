@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// expireAge is the age given by --older-than.
+var expireAge = &statFilter{parse: ParseAge}
+
+// expireData enables checking the data points of recently modified metrics.
+var expireData bool
+
+// expireDryRun only reports what would be expired.
+var expireDryRun bool
+
+// expireBatch is the number of metrics deleted per batch.
+var expireBatch int
+
+func init() {
+	usage := "[options] --older-than <age> [regex]"
+	short := "Delete stale metrics across the cluster."
+	long := `Find and delete abandoned metrics on every server in the cluster.
+
+A metric is stale when its Whisper DB has not been modified within the age
+given by --older-than, such as 90d.  Ages take the units s, m, h, d, w and y.
+Modification times are those seen by the buckyd daemons when they last
+built their metric cache, use -f to force a new inventory.
+
+Use -data to also find metrics that were modified recently but whose most
+recent valid data point is older than the age, such as metrics that were
+moved by a rebalance.  Each buckyd daemon must then read every recently
+modified Whisper DB which can take a while on a large store.
+
+The optional argument is a regular expression that limits the metrics
+considered.
+
+A summary of the stale metrics and the bytes they use is printed for each
+server.  Unless -noconfirm is given you will be asked to confirm the
+deletes on each server.  The metrics are then deleted in batches of the
+size given by -b.  Each batch is stat'd again right before it is deleted
+and metrics modified since they were found are kept.  Use -n to only print
+the summary.`
+
+	c := NewCommand(expireCommand, "expire", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+
+	c.Flag.Var(expireAge, "older-than",
+		"Expire metrics with no updates within this age such as 90d.")
+	c.Flag.BoolVar(&expireData, "data", false,
+		"Also expire metrics whose last valid data point is older than the age.")
+	c.Flag.BoolVar(&expireDryRun, "n", false,
+		"Dry run, only print the summary.")
+	c.Flag.BoolVar(&deleteForce, "noconfirm", false,
+		"No confirmation.")
+	c.Flag.BoolVar(&listForce, "f", false,
+		"Force metric re-inventory.")
+	c.Flag.IntVar(&expireBatch, "b", 1000,
+		"Number of metrics to delete per batch.")
+	c.Flag.IntVar(&metricWorkers, "w", 5,
+		"Delete threads.")
+}
+
+// expireRequests builds the requests that find the stale metrics on each
+// of the host:port strings in servers.
+func expireRequests(servers []string, regex string, force bool) []metricListRequest {
+	var requests []metricListRequest
+	if regex != "" {
+		requests = regexMetricsRequests(servers, regex, force)
+	} else {
+		requests = allMetricsRequests(servers, force)
+	}
+
+	for i := range requests {
+		query := requests[i].url.Query()
+		if expireData {
+			query.Set("no_data_since", expireAge.value)
+		} else {
+			query.Set("older_than", expireAge.value)
+		}
+		requests[i].url.RawQuery = query.Encode()
+	}
+	return requests
+}
+
+// expireCutoff returns the Unix time stale metrics must not have been
+// modified since.  With -data it is the time the search started as the
+// daemons read the data points of each metric then.
+func expireCutoff(start time.Time) (int64, error) {
+	if expireData {
+		return start.Unix(), nil
+	}
+	age, err := ParseAge(expireAge.value)
+	if err != nil {
+		return 0, err
+	}
+	return start.Unix() - age, nil
+}
+
+// staleMetrics stats the metrics on server again and returns those that
+// still were not modified since cutoff and their total size.  The metric
+// cache of a daemon may be up to an hour old, so metrics written since are
+// left out, as are metrics that could not be stat'd.
+func staleMetrics(server string, metrics []string, cutoff int64) ([]string, int64, error) {
+	var size int64
+	stale := make([]string, 0, len(metrics))
+	err := BatchStat(server, metrics, func(stat *MetricData) {
+		if stat.ModTime < cutoff {
+			stale = append(stale, stat.Name)
+			size = size + stat.Size
+		}
+	})
+	return stale, size, err
+}
+
+// expireStale checks each of the found metrics with staleMetrics and
+// returns the stale metrics and the bytes they use on each server.
+func expireStale(metricMap map[string][]string, cutoff int64) (map[string][]string, map[string]int64) {
+	lock := new(sync.Mutex)
+	stale := make(map[string][]string)
+	sizes := make(map[string]int64)
+	workIn := make(chan *BatchWork, metricWorkers)
+	wg := new(sync.WaitGroup)
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for work := range workIn {
+				names, size, err := staleMetrics(work.server, work.names, cutoff)
+				lock.Lock()
+				if err != nil {
+					workerErrors = true
+				}
+				stale[work.server] = append(stale[work.server], names...)
+				sizes[work.server] = sizes[work.server] + size
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, work := range batches(metricMap) {
+		workIn <- work
+	}
+	close(workIn)
+	wg.Wait()
+
+	for server := range stale {
+		sort.Strings(stale[server])
+	}
+	return stale, sizes
+}
+
+// expireWorker deletes the metrics of each batch that are still stale.
+func expireWorker(workIn chan *BatchWork, cutoff int64, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for work := range workIn {
+		stale, _, err := staleMetrics(work.server, work.names, cutoff)
+		if err != nil {
+			workerErrors = true
+		}
+		if kept := len(work.names) - len(stale); kept > 0 {
+			log.Printf("Keeping %d metrics on %s modified since they were found.",
+				kept, work.server)
+		}
+		if len(stale) == 0 {
+			continue
+		}
+		if err := BatchDelete(work.server, stale, nil); err != nil {
+			workerErrors = true
+		}
+	}
+}
+
+// printExpireSummary writes the per server table of stale metrics and
+// their sizes to STDOUT.
+func printExpireSummary(metricMap map[string][]string, sizes map[string]int64) {
+	servers := make([]string, 0, len(metricMap))
+	for server := range metricMap {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	var total int64
+	fmt.Printf("%-30s %12s %14s\n", "Server", "Metrics", "Reclaim")
+	for _, server := range servers {
+		fmt.Printf("%-30s %12d %10.2f MiB\n", server, len(metricMap[server]),
+			float64(sizes[server])/float64(1024*1024))
+		total = total + sizes[server]
+	}
+	fmt.Printf("%-30s %12d %10.2f MiB\n", "Total", countMap(metricMap),
+		float64(total)/float64(1024*1024))
+}
+
+// expireMetrics asks to confirm the deletes on each server and then
+// deletes the metrics that are still stale in batches.
+func expireMetrics(metricMap map[string][]string, sizes map[string]int64, cutoff int64) error {
+	servers := make([]string, 0, len(metricMap))
+	for server := range metricMap {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	confirmed := make([]string, 0, len(servers))
+	for _, server := range servers {
+		metrics := metricMap[server]
+		if len(metrics) == 0 {
+			continue
+		}
+		msg := fmt.Sprintf("Expiring %d metrics using %.2f MiB on %s: Please Confirm:",
+			len(metrics), float64(sizes[server])/float64(1024*1024), server)
+		if deleteForce || askForConfirmation(msg) {
+			confirmed = append(confirmed, server)
+		}
+	}
+
+	wg := new(sync.WaitGroup)
+	workIn := make(chan *BatchWork) // Purposely unbuffered
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go expireWorker(workIn, cutoff, wg)
+	}
+
+	for _, server := range confirmed {
+		metrics := metricMap[server]
+		for i := 0; i < len(metrics); i += expireBatch {
+			end := i + expireBatch
+			if end > len(metrics) {
+				end = len(metrics)
+			}
+			log.Printf("Deleting metrics %d-%d of %d on %s...", i+1, end,
+				len(metrics), server)
+			workIn <- &BatchWork{server, metrics[i:end]}
+		}
+	}
+
+	close(workIn)
+	wg.Wait()
+
+	log.Printf("Expire operation complete.")
+	if workerErrors {
+		log.Printf("Errors occured in expire operation.")
+		return fmt.Errorf("Errors occured in expire operations.")
+	}
+	return nil
+}
+
+// expireCommand runs this subcommand.
+func expireCommand(c Command) int {
+	if expireAge.value == "" {
+		log.Fatal("The --older-than flag is required.")
+	}
+	if expireBatch < 1 {
+		log.Fatal("The batch size must be at least 1.")
+	}
+	batchSize = expireBatch
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	cutoff, err := expireCutoff(time.Now())
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	requests := expireRequests(Cluster.HostPorts(), c.Flag.Arg(0), listForce)
+	metricMap, err := multiplexListRequests(requests)
+	if err != nil {
+		return 1
+	}
+
+	metricMap, sizes := expireStale(metricMap, cutoff)
+	if countMap(metricMap) == 0 {
+		log.Printf("No stale metrics found.")
+		return 0
+	}
+	printExpireSummary(metricMap, sizes)
+	if workerErrors {
+		log.Printf("Errors occured finding the size of stale metrics.")
+		return 1
+	}
+	if expireDryRun {
+		return 0
+	}
+
+	err = expireMetrics(metricMap, sizes, cutoff)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// fakeStore is a buckyd daemon answering batch stat and delete requests
+// for the metrics it holds.
+type fakeStore struct {
+	lock    sync.Mutex
+	metrics map[string]*MetricData
+}
+
+func (f *fakeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	enc := json.NewEncoder(w)
+	dec := json.NewDecoder(r.Body)
+	for dec.More() {
+		var name string
+		if err := dec.Decode(&name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result := &BatchResult{Name: name, Status: http.StatusOK}
+		stat := f.metrics[name]
+		switch {
+		case stat == nil:
+			result.Status = http.StatusNotFound
+		case r.URL.Path == "/batch/stat":
+			result.Stat = stat
+		case r.URL.Path == "/batch/delete":
+			delete(f.metrics, name)
+		}
+		enc.Encode(result)
+	}
+}
+
+func TestExpireRewrittenMetric(t *testing.T) {
+	now := time.Now()
+	store := &fakeStore{metrics: map[string]*MetricData{
+		"stale":     {Name: "stale", Size: 100, ModTime: now.Add(-100 * 24 * time.Hour).Unix()},
+		"rewritten": {Name: "rewritten", Size: 200, ModTime: now.Add(-100 * 24 * time.Hour).Unix()},
+		"fresh":     {Name: "fresh", Size: 400, ModTime: now.Unix()},
+	}}
+	server := httptest.NewServer(store)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	metricWorkers, expireBatch, deleteForce = 1, 10, true
+	expireAge.value, expireData = "90d", false
+	cutoff, err := expireCutoff(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The daemon's cache listed fresh as stale before it was written
+	found := map[string][]string{host: {"fresh", "rewritten", "stale"}}
+	stale, sizes := expireStale(found, cutoff)
+	if strings.Join(stale[host], " ") != "rewritten stale" || sizes[host] != 300 {
+		t.Errorf("Found %v using %d bytes as stale", stale[host], sizes[host])
+	}
+
+	// rewritten is written again while waiting for confirmation
+	store.lock.Lock()
+	store.metrics["rewritten"].ModTime = now.Unix()
+	store.lock.Unlock()
+
+	if err := expireMetrics(stale, sizes, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	if store.metrics["stale"] != nil {
+		t.Errorf("The stale metric was not deleted")
+	}
+	if store.metrics["rewritten"] == nil || store.metrics["fresh"] == nil {
+		t.Errorf("A metric written since the scan was deleted")
+	}
+}
@@ -4,15 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"sort"
-	"strings"
 	"time"
 )
 
-// import "github.com/jjneely/buckytools/hashing"
-
 func init() {
 	usage := "[options]"
 	short := "Find metrics not in correct locations."
@@ -24,6 +20,15 @@ ring matches the location where the metric is found.  Print to STDOUT
 server:metric for each metric that is in the wrong location.  The server
 is the server the metric is presently found on.
 
+When the cluster stores more than one replica of each metric, copies on any
+of the replica servers are in the right location.  Replica servers without
+a copy of a metric found elsewhere are printed as server:metric followed by
+"(missing)".  Missing replicas are not included in the JSON output of -j.
+
+Use -ring or -ring-nodes to check the metrics against a proposed hash ring,
+such as one with new servers, before the buckyd daemons are reconfigured
+with it.  The servers of the proposed ring are searched as well.
+
 Use bucky rebalance to correct.`
 
 	c := NewCommand(inconsistentCommand, "inconsistent", usage, short, long)
@@ -31,53 +36,72 @@ Use bucky rebalance to correct.`
 	SetupHostname(c)
 	SetupSingle(c)
 	SetupJSON(c)
+	SetupTargetRing(c)
 
 	c.Flag.BoolVar(&listForce, "f", false,
 		"Force the remote daemons to rebuild their cache.")
 }
 
-func InconsistentMetrics(hostports []string) (map[string][]string, error) {
-	var list map[string][]string
-	var err error
-
-	list, err = ListAllMetrics(hostports, listForce)
-	if err != nil {
-		log.Printf("Error retrieving metric lists: %s", err)
-		return nil, err
+// replicaSets compares the servers the metric is found on, have, with
+// those the target ring places its replicas on.  It returns the HOST:PORT
+// of the replica servers, the servers with a copy outside of the replicas,
+// the replicas missing a copy and the replicas with a copy.
+func replicaSets(metric string, have []string, target *TargetRing) (want, misplaced, missing, healthy []string) {
+	for _, server := range target.ReplicaServers(metric) {
+		want = append(want, fmt.Sprintf("%s:%s", server, Cluster.Port))
 	}
+	for _, server := range have {
+		if containsString(want, server) {
+			healthy = append(healthy, server)
+		} else {
+			misplaced = append(misplaced, server)
+		}
+	}
+	for _, server := range want {
+		if !containsString(have, server) {
+			missing = append(missing, server)
+		}
+	}
+	return want, misplaced, missing, healthy
+}
 
+// InconsistentMetrics returns the metrics found on each of the hostports
+// that the target ring places on other servers.  The second map holds the
+// metrics missing from each server the ring places a replica on.
+func InconsistentMetrics(hostports []string, target *TargetRing) (map[string][]string, map[string][]string, error) {
 	results := make(map[string][]string)
-	log.Printf("Hashing...")
+	missingMap := make(map[string][]string)
 	t := time.Now().Unix()
-	for server, metrics := range list {
-		host, _, err := net.SplitHostPort(server)
-		if err != nil {
-			log.Printf("Malformed hostname: %s", server)
-			return nil, err
+	requests := allMetricsRequests(hostports, listForce)
+	err := streamLocations(requests, func(m string, have []string) {
+		_, misplaced, missing, _ := replicaSets(m, have, target)
+		for _, server := range misplaced {
+			results[server] = append(results[server], m)
 		}
-		for _, m := range metrics {
-			if strings.HasPrefix(m, "carbon.agents.") {
-				// These metrics are inserted into the stream after hashing
-				// is done.  They will never be consistent and shouldn't be.
-				continue
-			}
-			if Cluster.Hash.GetNode(m).Server != host {
-				results[server] = append(results[server], m)
-			}
+		for _, server := range missing {
+			missingMap[server] = append(missingMap[server], m)
 		}
+	})
+	if err != nil {
+		log.Printf("Error retrieving metric lists: %s", err)
+		return nil, nil, err
 	}
-	log.Printf("Hashing time was: %ds", time.Now().Unix()-t)
+	log.Printf("Listing and hashing time was: %ds", time.Now().Unix()-t)
 
 	// sort for sanity
 	for server, metrics := range results {
 		log.Printf("%d inconsistent metrics found on %s", len(metrics), server)
 		sort.Strings(metrics)
 	}
-	if len(results) == 0 {
+	for server, metrics := range missingMap {
+		log.Printf("%d metrics missing a replica on %s", len(metrics), server)
+		sort.Strings(metrics)
+	}
+	if len(results) == 0 && len(missingMap) == 0 {
 		log.Printf("No inconsistent metrics found.")
 	}
 
-	return results, nil
+	return results, missingMap, nil
 }
 
 // inconsistentCommand runs this subcommand.
@@ -91,7 +115,13 @@ func inconsistentCommand(c Command) int {
 	if !Cluster.Healthy {
 		log.Printf("Warning: Cluster is not healthy!")
 	}
-	results, err := InconsistentMetrics(Cluster.HostPorts())
+	target, err := GetTargetRing()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	results, missing, err := InconsistentMetrics(mergeHostPorts(Cluster.HostPorts(),
+		target.HostPorts()), target)
 	if JSONOutput {
 		blob, err := json.Marshal(results)
 		if err != nil {
@@ -106,6 +136,11 @@ func inconsistentCommand(c Command) int {
 				fmt.Printf("%s: %s\n", server, m)
 			}
 		}
+		for server, metrics := range missing {
+			for _, m := range metrics {
+				fmt.Printf("%s: %s (missing)\n", server, m)
+			}
+		}
 	}
 
 	if err != nil {
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// ServerJob is a job and the buckyd daemon running it.
+type ServerJob struct {
+	Server string
+	*Job
+}
+
+func init() {
+	usage := "[options] list|status|cancel [job id ...]"
+	short := "Manage the asynchronous jobs run by buckyd."
+	long := `List, check on or cancel the jobs run in the background by the buckyd
+daemons.
+
+When buckyd runs with -job-dir a client may submit a job to move, delete,
+fill or resize a list of metrics through the /jobs API.  The job runs on the
+daemon whether or not the client stays connected and its progress is kept
+on disk so it is resumed if the daemon restarts.
+
+The first argument is the action:
+
+    list     Print each job known to the cluster with its server, type,
+             state, progress, failures and age.
+    status   Print the given jobs along with the last error of each.
+    cancel   Stop the given jobs after the metric in progress.
+
+Use -s to only work with the server specified by -h or the BUCKYSERVER
+environment variable.  Use -j to dump the jobs as JSON.`
+
+	c := NewCommand(jobsCommand, "jobs", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+	SetupJSON(c)
+}
+
+// jobsRequest calls the jobs API on server.  An empty id lists all jobs.
+// A job not found on the server returns nil without an error.
+func jobsRequest(server, method, id string) ([]*ServerJob, error) {
+	u := &url.URL{
+		Scheme: URLScheme(),
+		Path:   "/jobs",
+	}
+	if id != "" {
+		u.Path = "/jobs/" + id
+	}
+	var err error
+	u.Host, err = SanitizeHostPort(server)
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return nil, err
+	}
+
+	r, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		log.Printf("Error building request: %s", err)
+		return nil, err
+	}
+	resp, err := GetHTTP().Do(r)
+	if err != nil {
+		log.Printf("Error retrieving URL: %s", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	blob, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading response body: %s", err)
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == 404 && id != "":
+		return nil, nil
+	case resp.StatusCode != 200:
+		log.Printf("/jobs API on %s returned %s: %s", server, resp.Status, blob)
+		return nil, fmt.Errorf("/jobs API returned: %s", resp.Status)
+	}
+
+	jobs := make([]*Job, 0)
+	if id != "" {
+		job := new(Job)
+		jobs = append(jobs, job)
+		err = json.Unmarshal(blob, job)
+	} else {
+		err = json.Unmarshal(blob, &jobs)
+	}
+	if err != nil {
+		log.Printf("Could not unmarshal JSON from host %s: %s", server, err)
+		return nil, err
+	}
+	result := make([]*ServerJob, len(jobs))
+	for i, job := range jobs {
+		result[i] = &ServerJob{server, job}
+	}
+	return result, nil
+}
+
+// ClusterJobs calls the jobs API on each server in parallel for each of
+// the ids, or once to list all jobs if there are none.  The jobs are
+// returned in the order they were submitted.
+func ClusterJobs(servers []string, method string, ids []string) ([]*ServerJob, error) {
+	if len(ids) == 0 {
+		ids = []string{""}
+	}
+	var failed error
+	jobs := make([]*ServerJob, 0)
+	lock := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	for _, server := range servers {
+		for _, id := range ids {
+			wg.Add(1)
+			go func(server, id string) {
+				defer wg.Done()
+				list, err := jobsRequest(server, method, id)
+				lock.Lock()
+				defer lock.Unlock()
+				if err != nil {
+					failed = err
+				}
+				jobs = append(jobs, list...)
+			}(server, id)
+		}
+	}
+	wg.Wait()
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].Created == jobs[j].Created {
+			return jobs[i].Server < jobs[j].Server
+		}
+		return jobs[i].Created < jobs[j].Created
+	})
+	return jobs, failed
+}
+
+// printJobs writes the table of jobs to STDOUT, with the last error of
+// each if errors is true.
+func printJobs(jobs []*ServerJob, errors bool) {
+	now := time.Now().Unix()
+	fmt.Printf("%-36s %-30s %-6s %-8s %15s %8s %8s\n", "ID", "Server", "Type",
+		"State", "Done", "Failed", "Age")
+	for _, job := range jobs {
+		fmt.Printf("%-36s %-30s %-6s %-8s %15s %8d %8s\n", job.ID, job.Server,
+			job.Type, job.State, fmt.Sprintf("%d/%d", job.Done, job.Total),
+			job.Failed, formatAge(now-job.Created))
+		if errors && job.Error != "" {
+			fmt.Printf("    Error: %s\n", job.Error)
+		}
+	}
+}
+
+// jobsCommand runs this subcommand.
+func jobsCommand(c Command) int {
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if c.Flag.NArg() == 0 {
+		log.Fatal("An action of list, status or cancel is required.")
+	}
+	servers := Cluster.HostPorts()
+	if SingleHost {
+		servers = []string{HostPort}
+	}
+
+	action, ids := c.Flag.Arg(0), c.Flag.Args()[1:]
+	method := "GET"
+	switch action {
+	case "list":
+		ids = nil
+	case "status", "cancel":
+		if len(ids) == 0 {
+			log.Fatalf("At least one job ID is required to %s.", action)
+		}
+		if action == "cancel" {
+			method = "DELETE"
+		}
+	default:
+		log.Fatalf("Unknown action: %s", action)
+	}
+
+	jobs, err := ClusterJobs(servers, method, ids)
+	if JSONOutput {
+		blob, err := json.Marshal(jobs)
+		if err != nil {
+			log.Printf("%s", err)
+			return 1
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+	} else {
+		printJobs(jobs, action != "list")
+	}
+
+	retval := 0
+	if err != nil {
+		retval = 1
+	}
+	found := make(map[string]bool)
+	for _, job := range jobs {
+		found[job.ID] = true
+	}
+	for _, id := range ids {
+		if !found[id] {
+			log.Printf("Job %s not found.", id)
+			retval = 1
+		}
+	}
+	return retval
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The steps of a move recorded in a rebalance journal, in order.
+const (
+	movePlanned  = "planned"
+	moveCopied   = "copied"
+	moveVerified = "verified"
+	moveDeleted  = "deleted"
+	moveFailed   = "failed"
+)
+
+// JournalEntry is one line of a rebalance journal.  Src and Dst are the
+// HOST:PORT of the servers the metric moves between.  Fill is true if the
+// source is a replica that is not deleted.  A failed entry records the
+// Error of the step after the last one the move completed.
+type JournalEntry struct {
+	State  string
+	Metric string
+	Src    string
+	Dst    string
+	Fill   bool   `json:",omitempty"`
+	Error  string `json:",omitempty"`
+	Time   int64
+}
+
+// Journal records the progress of each move of a rebalance in an append
+// only file of NDJSON so an interrupted rebalance can be resumed.
+type Journal struct {
+	lock   sync.Mutex
+	fd     *os.File
+	enc    *json.Encoder
+	moves  []*MigrateWork
+	state  map[string]string // last step completed by each move
+	errors map[string]string // error of moves that failed since
+}
+
+// journalKey identifies a move.
+func journalKey(work *MigrateWork) string {
+	return work.oldLocation + " " + work.newLocation + " " + work.oldName
+}
+
+// newJournal returns an empty journal that is not written anywhere.
+func newJournal() *Journal {
+	return &Journal{
+		moves:  make([]*MigrateWork, 0),
+		state:  make(map[string]string),
+		errors: make(map[string]string),
+	}
+}
+
+// OpenJournal reads the journal at path, if it exists, and opens it to
+// record more moves.
+func OpenJournal(path string) (*Journal, error) {
+	j := newJournal()
+	fd, err := os.Open(path)
+	if err == nil {
+		err = j.read(fd)
+		fd.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading journal %s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return j, j.open(path, os.O_APPEND|os.O_CREATE)
+}
+
+// CreateJournal creates a new journal at path.  An existing journal is an
+// error rather than replayed as its moves may not have finished.
+func CreateJournal(path string) (*Journal, error) {
+	j := newJournal()
+	err := j.open(path, os.O_CREATE|os.O_EXCL)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("Journal %s exists, resume it with -resume or remove it", path)
+	}
+	return j, err
+}
+
+// open opens the journal file to record moves.
+func (j *Journal) open(path string, flag int) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|flag, 0644)
+	if err != nil {
+		return err
+	}
+	j.fd = fd
+	j.enc = json.NewEncoder(j.fd)
+	return nil
+}
+
+// read replays the entries of a journal file.
+func (j *Journal) read(fd *os.File) error {
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		entry := new(JournalEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// A crash may leave the last line incomplete
+			log.Printf("Warning: Skipping line %d of journal: %s", line, err)
+			continue
+		}
+		j.apply(entry)
+	}
+	return scanner.Err()
+}
+
+// apply updates the state of the move the entry records.
+func (j *Journal) apply(entry *JournalEntry) {
+	work := &MigrateWork{
+		oldName:     entry.Metric,
+		newName:     entry.Metric,
+		oldLocation: entry.Src,
+		newLocation: entry.Dst,
+		fill:        entry.Fill,
+	}
+	key := journalKey(work)
+	switch entry.State {
+	case movePlanned:
+		if _, ok := j.state[key]; !ok {
+			j.moves = append(j.moves, work)
+		}
+		j.state[key] = movePlanned
+		delete(j.errors, key)
+	case moveFailed:
+		j.errors[key] = entry.Error
+	default:
+		j.state[key] = entry.State
+		delete(j.errors, key)
+	}
+}
+
+// Record notes that the move completed the step given by state, or
+// failed with err if state is moveFailed.  Errors writing the journal are
+// fatal as the rebalance could no longer be resumed.
+func (j *Journal) Record(state string, work *MigrateWork, err error) {
+	entry := &JournalEntry{
+		State:  state,
+		Metric: work.oldName,
+		Src:    work.oldLocation,
+		Dst:    work.newLocation,
+		Fill:   work.fill,
+		Time:   time.Now().Unix(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.apply(entry)
+	if j.enc != nil {
+		if err := j.enc.Encode(entry); err != nil {
+			log.Fatalf("Error writing journal: %s", err)
+		}
+	}
+}
+
+// Pending returns the moves that have not finished grouped by the last
+// step they completed.  Moves are finished once deleted or, if
+// deleting is false or the move is a fill, verified.
+func (j *Journal) Pending(deleting bool) map[string][]*MigrateWork {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	pending := make(map[string][]*MigrateWork)
+	for _, work := range j.moves {
+		state := j.state[journalKey(work)]
+		if state == moveDeleted || (state == moveVerified && (!deleting || work.fill)) {
+			continue
+		}
+		pending[state] = append(pending[state], work)
+	}
+	return pending
+}
+
+// Summary logs the number of moves by the last step they completed and
+// each move that failed.  The number of failed moves is returned.
+func (j *Journal) Summary() int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	counts := make(map[string]int)
+	failed := make([]string, 0)
+	for _, work := range j.moves {
+		key := journalKey(work)
+		counts[j.state[key]]++
+		if msg, ok := j.errors[key]; ok {
+			failed = append(failed, fmt.Sprintf("[%s] %s => %s after %s: %s",
+				work.oldLocation, work.oldName, work.newLocation, j.state[key], msg))
+		}
+	}
+	sort.Strings(failed)
+
+	log.Printf("%d moves: %d not copied, %d copied, %d verified, %d deleted, %d failed",
+		len(j.moves), counts[movePlanned], counts[moveCopied],
+		counts[moveVerified], counts[moveDeleted], len(failed))
+	for _, f := range failed {
+		log.Printf("Failed: %s", f)
+	}
+	return len(failed)
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	if j.fd == nil {
+		return nil
+	}
+	return j.fd.Close()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucky_journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		lines    []string
+		deleting bool
+		pending  map[string][]string // metrics by the last step they completed
+		failed   int
+	}{
+		{
+			name: "steps",
+			lines: []string{
+				`{"State":"planned","Metric":"a","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"planned","Metric":"b","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"planned","Metric":"c","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"copied","Metric":"b","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"copied","Metric":"c","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"verified","Metric":"c","Src":"s:1","Dst":"d:1"}`,
+			},
+			deleting: true,
+			pending: map[string][]string{
+				movePlanned:  {"a"},
+				moveCopied:   {"b"},
+				moveVerified: {"c"},
+			},
+		},
+		{
+			name: "verified without deleting",
+			lines: []string{
+				`{"State":"planned","Metric":"a","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"verified","Metric":"a","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"planned","Metric":"b","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"deleted","Metric":"b","Src":"s:1","Dst":"d:1"}`,
+			},
+			pending: map[string][]string{},
+		},
+		{
+			name: "verified fill",
+			lines: []string{
+				`{"State":"planned","Metric":"a","Src":"s:1","Dst":"d:1","Fill":true}`,
+				`{"State":"verified","Metric":"a","Src":"s:1","Dst":"d:1","Fill":true}`,
+			},
+			deleting: true,
+			pending:  map[string][]string{},
+		},
+		{
+			name: "failed",
+			lines: []string{
+				`{"State":"planned","Metric":"a","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"failed","Metric":"a","Src":"s:1","Dst":"d:1","Error":"Copy failed"}`,
+				`{"State":"planned","Metric":"b","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"copied","Metric":"b","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"failed","Metric":"b","Src":"s:1","Dst":"d:1","Error":"Verify failed"}`,
+				`{"State":"verified","Metric":"b","Src":"s:1","Dst":"d:1"}`,
+			},
+			deleting: true,
+			pending: map[string][]string{
+				movePlanned:  {"a"},
+				moveVerified: {"b"},
+			},
+			failed: 1,
+		},
+		{
+			name: "same metric between other servers",
+			lines: []string{
+				`{"State":"planned","Metric":"a","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"planned","Metric":"a","Src":"s:2","Dst":"d:1"}`,
+				`{"State":"planned","Metric":"a","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"copied","Metric":"a","Src":"s:2","Dst":"d:1"}`,
+			},
+			deleting: true,
+			pending: map[string][]string{
+				movePlanned: {"a"},
+				moveCopied:  {"a"},
+			},
+		},
+		{
+			name: "incomplete last line",
+			lines: []string{
+				`{"State":"planned","Metric":"a","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"copied","Metric":"a","Src":"s:1","Dst":"d:1"}`,
+				`{"State":"verified","Metric":"a","Sr`,
+			},
+			deleting: true,
+			pending: map[string][]string{
+				moveCopied: {"a"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1))
+		content := strings.Join(test.lines, "\n") + "\n"
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		j, err := OpenJournal(path)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		pending := make(map[string][]string)
+		for state, moves := range j.Pending(test.deleting) {
+			for _, m := range moves {
+				pending[state] = append(pending[state], m.oldName)
+			}
+		}
+		if !reflect.DeepEqual(pending, test.pending) {
+			t.Errorf("%s: Pending moves %v rather than %v", test.name, pending, test.pending)
+		}
+		if failed := j.Summary(); failed != test.failed {
+			t.Errorf("%s: %d failed moves rather than %d", test.name, failed, test.failed)
+		}
+		j.Close()
+	}
+}
+
+func TestJournalRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucky_journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rebalance.journal")
+
+	j, err := CreateJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := &MigrateWork{oldName: "a", newName: "a", oldLocation: "s:1", newLocation: "d:1"}
+	j.Record(movePlanned, work, nil)
+	j.Record(moveCopied, work, nil)
+	j.Close()
+
+	// A new rebalance does not take over the moves of an earlier one
+	if _, err := CreateJournal(path); err == nil {
+		t.Errorf("Created a journal over an existing one")
+	}
+
+	j, err = OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	pending := j.Pending(true)
+	if len(pending) != 1 || len(pending[moveCopied]) != 1 || pending[moveCopied][0].oldName != "a" {
+		t.Errorf("Resumed journal has pending moves %v", pending)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,11 +12,14 @@ import (
 	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+import . "github.com/jjneely/buckytools/metrics"
+
 var listRegexMode bool
 var listForce bool
 var listLocation bool
@@ -62,13 +66,19 @@ output.
 
 With -l we list the server that the metric resides on.  This is the
 actual location of the metric and not the location computed by the
-consistent hash ring.  Combined with -j the JSON output will be a hash.`
+consistent hash ring.  Combined with -j the JSON output will be a hash.
+
+The --older-than, --newer-than, --min-size and --max-size flags further
+restrict the metrics by their modification time and size as last seen by
+the remote daemons.  Ages take the units s, m, h, d, w and y and sizes the
+units K, M, G and T.`
 
 	c := NewCommand(listCommand, "list", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
 	SetupJSON(c)
+	SetupStatFilters(c)
 
 	c.Flag.BoolVar(&listRegexMode, "r", false,
 		"Filter by a regular expression.")
@@ -78,33 +88,132 @@ consistent hash ring.  Combined with -j the JSON output will be a hash.`
 		"List the metric's real relocation.")
 }
 
-// getMetricCache accepts a url.URL and body  that defines a request to
-// retrieve metrics from a remote buckyd daemon.  These are formed into
-// a http.Request object and used to fetch remote metric listings.  This
-// also handles 202 (result not available) return codes and re-issuing the
-// request.  This returns a map of slices of strings keyed by host.
-func getMetricCache(u url.URL, body *string) (map[string][]string, error) {
-	resp, err := HTTPFetch(u, body)
-	if err != nil {
-		return nil, err
+// listPageSize is the number of metrics requested from a buckyd daemon
+// in each page of a streamed metric listing.
+const listPageSize = 10000
+
+// streamMetricCache accepts a url.URL and body that defines a request to
+// retrieve metrics from a remote buckyd daemon.  The listing is requested
+// as NDJSON in pages of listPageSize metrics and fn is called for each
+// metric as it is decoded, so memory use does not grow with the size of
+// the listing.  Requests with a body are not paginated.  Older daemons
+// that return a single JSON array are also handled, the array is sorted
+// so the metrics are always streamed in sorted order.  The number of
+// metrics streamed is returned.
+func streamMetricCache(u url.URL, body *string, fn func(string) error) (int, error) {
+	query := u.Query()
+	query.Set("format", "ndjson")
+	if body == nil {
+		query.Set("limit", strconv.Itoa(listPageSize))
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		err := fmt.Errorf("Error fetching remote metric cache: %s", resp.Status)
-		log.Print(err)
-		return nil, err
+	count := 0
+	last := ""
+	record := func(m string) error {
+		last = m
+		return fn(m)
 	}
+	for {
+		u.RawQuery = query.Encode()
+		resp, err := HTTPFetch(u, body)
+		if err != nil {
+			return count, err
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			err := fmt.Errorf("Error fetching remote metric cache: %s", resp.Status)
+			log.Print(err)
+			return count, err
+		}
 
+		paged := strings.Contains(resp.Header.Get("Content-Type"), NDJSON)
+		var n int
+		if paged {
+			n, err = decodeMetricList(resp.Body, paged, record)
+		} else {
+			n, err = decodeSortedList(resp.Body, record)
+		}
+		resp.Body.Close()
+		count += n
+		if err != nil {
+			log.Printf("Error decoding metric list from %s: %s", u.Host, err)
+			return count, err
+		}
+		if body != nil || !paged || n < listPageSize {
+			return count, nil
+		}
+		query.Set("cursor", last)
+		query.Del("force")
+	}
+}
+
+// dropForce removes the force parameter from an encoded query string.
+func dropForce(rawQuery string) string {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil || query.Get("force") == "" {
+		return rawQuery
+	}
+	query.Del("force")
+	return query.Encode()
+}
+
+// decodeMetricList decodes metric names from r and calls fn for each.
+// When ndjson is false r holds a single JSON array.  The number of
+// metrics decoded is returned.
+func decodeMetricList(r io.Reader, ndjson bool, fn func(string) error) (int, error) {
+	count := 0
+	dec := json.NewDecoder(r)
+	if !ndjson {
+		if _, err := dec.Token(); err != nil {
+			return 0, err
+		}
+	}
+	for dec.More() {
+		var m string
+		if err := dec.Decode(&m); err != nil {
+			return count, err
+		}
+		if err := fn(m); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// decodeSortedList decodes a JSON array of metric names from r and calls
+// fn for each in sorted order.  Older daemons return the array in the
+// order the metrics were found on disk, which is not sorted by name.
+func decodeSortedList(r io.Reader, fn func(string) error) (int, error) {
 	metrics := make([]string, 0)
-	blob, err := ioutil.ReadAll(resp.Body)
+	_, err := decodeMetricList(r, false, func(m string) error {
+		metrics = append(metrics, m)
+		return nil
+	})
 	if err != nil {
-		log.Printf("Error reading response body: %s", err)
-		return nil, err
+		return 0, err
 	}
-	err = json.Unmarshal(blob, &metrics)
+	sort.Strings(metrics)
+	for i, m := range metrics {
+		if err := fn(m); err != nil {
+			return i, err
+		}
+	}
+	return len(metrics), nil
+}
+
+// getMetricCache accepts a url.URL and body  that defines a request to
+// retrieve metrics from a remote buckyd daemon.  This also handles 202
+// (result not available) return codes and re-issuing the request.  This
+// returns a map of slices of strings keyed by host.
+func getMetricCache(u url.URL, body *string) (map[string][]string, error) {
+	metrics := make([]string, 0)
+	_, err := streamMetricCache(u, body, func(m string) error {
+		metrics = append(metrics, m)
+		return nil
+	})
 	if err != nil {
-		log.Printf("Error unmarshalling JSON data: %s", err)
 		return nil, err
 	}
 
@@ -154,6 +263,14 @@ func HTTPFetch(u url.URL, body *string) (*http.Response, error) {
 		}
 		resp.Body.Close()
 
+		// The daemon is now refreshing, forcing again would restart it
+		if body == nil {
+			u.RawQuery = dropForce(u.RawQuery)
+		} else {
+			*body = dropForce(*body)
+			rc = NewRetryReader(body)
+		}
+
 		// Sleep and retry until results are available
 		log.Printf("Results from %s not available. Sleeping.", u.Host)
 		if i == len(fib) {
@@ -174,7 +291,7 @@ func multiplexListRequests(r []metricListRequest) (map[string][]string, error) {
 	var wg sync.WaitGroup
 	comms := make(chan map[string][]string, 10)
 	wg.Add(len(r))
-	errors := false
+	errors := make(chan bool, len(r))
 
 	for _, v := range r {
 		go func(req metricListRequest) {
@@ -183,7 +300,7 @@ func multiplexListRequests(r []metricListRequest) (map[string][]string, error) {
 				// Errors reported by getMetricsCache
 				comms <- metrics
 			} else {
-				errors = true
+				errors <- true
 			}
 			wg.Done()
 		}(v)
@@ -201,44 +318,91 @@ func multiplexListRequests(r []metricListRequest) (map[string][]string, error) {
 		}
 	}
 
-	if errors {
+	if len(errors) > 0 {
 		return results, fmt.Errorf("Errors occured fetching metric keys.")
 	}
 	return results, nil
 }
 
-// ListAllMetrics interates through the host:port strings given in servers
-// contact those buckyd daemons, gets the list of all known metrics on that
-// server, returns a map of server => list of metrics
-func ListAllMetrics(servers []string, force bool) (map[string][]string, error) {
+// mergeListRequests issues the given slice of Requests in parallel and
+// calls fn for each metric returned in sorted order across all servers.
+// Each buckyd daemon returns its metrics sorted so only a page worth of
+// metrics per server is held in memory.  The error will indicate an error
+// with one or more http request/response that has already been handled.
+func mergeListRequests(r []metricListRequest, fn func(server, metric string)) error {
+	streams := make([]chan string, len(r))
+	errors := make(chan bool, len(r))
+	for i, v := range r {
+		streams[i] = make(chan string, listPageSize)
+		go func(req metricListRequest, out chan string) {
+			_, err := streamMetricCache(req.url, req.body, func(m string) error {
+				out <- m
+				return nil
+			})
+			if err != nil {
+				errors <- true
+			}
+			close(out)
+		}(v, streams[i])
+	}
+
+	// Head of each stream, ok is false once a stream is exhausted
+	heads := make([]string, len(r))
+	ok := make([]bool, len(r))
+	for i := range streams {
+		heads[i], ok[i] = <-streams[i]
+	}
+	for {
+		min := -1
+		for i := range heads {
+			if ok[i] && (min < 0 || heads[i] < heads[min]) {
+				min = i
+			}
+		}
+		if min < 0 {
+			break
+		}
+		fn(r[min].url.Host, heads[min])
+		heads[min], ok[min] = <-streams[min]
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("Errors occured fetching metric keys.")
+	}
+	return nil
+}
+
+// allMetricsRequests builds the requests for every metric on each of the
+// host:port strings in servers.
+func allMetricsRequests(servers []string, force bool) []metricListRequest {
 	requests := make([]metricListRequest, 0)
 
 	for _, buckyd := range servers {
 		u := url.URL{
-			Scheme: "http",
+			Scheme: URLScheme(),
 			Host:   buckyd,
 			Path:   "/metrics",
 		}
+		query := url.Values{}
 		if force {
-			query := url.Values{}
 			query.Set("force", "true")
-			u.RawQuery = query.Encode()
 		}
+		setStatFilters(query)
+		u.RawQuery = query.Encode()
 		requests = append(requests, metricListRequest{u, nil})
 	}
 
-	return multiplexListRequests(requests)
+	return requests
 }
 
-// ListRegexMetrics queries buckyd daemons specified in servers for all
-// metrics matching the given regex.  If successful matching metrics from
-// all servers returned in a map of server => slice of metrics
-func ListRegexMetrics(servers []string, regex string, force bool) (map[string][]string, error) {
+// regexMetricsRequests builds the requests for the metrics matching regex
+// on each of the host:port strings in servers.
+func regexMetricsRequests(servers []string, regex string, force bool) []metricListRequest {
 	requests := make([]metricListRequest, 0)
 
 	for _, buckyd := range servers {
 		u := url.URL{
-			Scheme: "http",
+			Scheme: URLScheme(),
 			Host:   buckyd,
 			Path:   "/metrics",
 		}
@@ -247,23 +411,22 @@ func ListRegexMetrics(servers []string, regex string, force bool) (map[string][]
 			query.Set("force", "true")
 		}
 		query.Set("regex", regex)
+		setStatFilters(query)
 		u.RawQuery = query.Encode()
 		requests = append(requests, metricListRequest{u, nil})
 	}
 
-	return multiplexListRequests(requests)
+	return requests
 }
 
-// ListSliceMetrics queries buckyd daemons specified in servers for all
-// metrics that are known by that buckyd daemon and listed in the slice
-// metrics.  Results from all servers are returned in a map of server =>
-// slice of metrics.
-func ListSliceMetrics(servers []string, metrics []string, force bool) (map[string][]string, error) {
+// sliceMetricsRequests builds the requests for the metrics in the slice
+// metrics on each of the host:port strings in servers.
+func sliceMetricsRequests(servers []string, metrics []string, force bool) ([]metricListRequest, error) {
 	requests := make([]metricListRequest, 0)
 
 	for _, buckyd := range servers {
 		u := url.URL{
-			Scheme: "http",
+			Scheme: URLScheme(),
 			Host:   buckyd,
 			Path:   "/metrics",
 		}
@@ -277,33 +440,118 @@ func ListSliceMetrics(servers []string, metrics []string, force bool) (map[strin
 			return nil, err
 		}
 		query.Set("list", string(blob))
+		setStatFilters(query)
 		rawQuery := query.Encode()
 		requests = append(requests, metricListRequest{u, &rawQuery})
 	}
 
+	return requests, nil
+}
+
+// streamLocations issues the list requests and calls fn with each metric
+// and the HOST:PORT of the servers it is found on in sorted order, so the
+// listings are never held in memory.  carbon.agents metrics are skipped as
+// they are inserted into the stream after hashing is done and will never
+// be consistent.
+func streamLocations(requests []metricListRequest, fn func(metric string, servers []string)) error {
+	var metric string
+	var servers []string
+	err := mergeListRequests(requests, func(server, m string) {
+		if strings.HasPrefix(m, "carbon.agents.") {
+			return
+		}
+		if m != metric && len(servers) > 0 {
+			fn(metric, servers)
+			servers = nil
+		}
+		metric = m
+		servers = append(servers, server)
+	})
+	if len(servers) > 0 {
+		fn(metric, servers)
+	}
+	return err
+}
+
+// ListAllMetrics interates through the host:port strings given in servers
+// contact those buckyd daemons, gets the list of all known metrics on that
+// server, returns a map of server => list of metrics
+func ListAllMetrics(servers []string, force bool) (map[string][]string, error) {
+	return multiplexListRequests(allMetricsRequests(servers, force))
+}
+
+// ListRegexMetrics queries buckyd daemons specified in servers for all
+// metrics matching the given regex.  If successful matching metrics from
+// all servers returned in a map of server => slice of metrics
+func ListRegexMetrics(servers []string, regex string, force bool) (map[string][]string, error) {
+	return multiplexListRequests(regexMetricsRequests(servers, regex, force))
+}
+
+// ListSliceMetrics queries buckyd daemons specified in servers for all
+// metrics that are known by that buckyd daemon and listed in the slice
+// metrics.  Results from all servers are returned in a map of server =>
+// slice of metrics.
+func ListSliceMetrics(servers []string, metrics []string, force bool) (map[string][]string, error) {
+	requests, err := sliceMetricsRequests(servers, metrics, force)
+	if err != nil {
+		return nil, err
+	}
+
 	return multiplexListRequests(requests)
 }
 
-// ListJSONMetrics queries buckyd daemons specified in servers for all
-// metrics known to that buckyd daemon and that are present in the
-// io.Reader interface which points to a data source containing a JSON
-// array.  Results are returned in a map of server => metrics.
-func ListJSONMetrics(servers []string, fd io.Reader, force bool) (map[string][]string, error) {
+// readJSONList reads a JSON array of metric names from the io.Reader.
+func readJSONList(fd io.Reader) ([]string, error) {
 	// Read the JSON from the file-like object
 	blob, err := ioutil.ReadAll(fd)
+	if err != nil {
+		log.Printf("Error reading JSON data: %s", err)
+		return nil, err
+	}
 	metrics := make([]string, 0)
 
 	err = json.Unmarshal(blob, &metrics)
+	if err != nil {
+		log.Printf("Error unmarshalling JSON data: %s", err)
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+// ListJSONMetrics queries buckyd daemons specified in servers for all
+// metrics known to that buckyd daemon and that are present in the
+// io.Reader interface which points to a data source containing a JSON
+// array.  Results are returned in a map of server => metrics.
+func ListJSONMetrics(servers []string, fd io.Reader, force bool) (map[string][]string, error) {
 	// We could just package this up and query the server, but lets check the
 	// JSON is valid first.
+	metrics, err := readJSONList(fd)
 	if err != nil {
-		log.Printf("Error unmarshalling JSON data: %s", err)
 		return nil, err
 	}
 
 	return ListSliceMetrics(servers, metrics, force)
 }
 
+// listRequests builds the list requests for the given command line
+// arguments.
+func listRequests(c Command) ([]metricListRequest, error) {
+	if c.Flag.NArg() == 0 {
+		return allMetricsRequests(Cluster.HostPorts(), listForce), nil
+	} else if listRegexMode && c.Flag.NArg() > 0 {
+		return regexMetricsRequests(Cluster.HostPorts(), c.Flag.Arg(0), listForce), nil
+	} else if c.Flag.Arg(0) != "-" {
+		return sliceMetricsRequests(Cluster.HostPorts(), c.Flag.Args(), listForce)
+	}
+
+	metrics, err := readJSONList(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return sliceMetricsRequests(Cluster.HostPorts(), metrics, listForce)
+}
+
 // listCommand runs this subcommand.
 func listCommand(c Command) int {
 	_, err := GetClusterConfig(HostPort)
@@ -312,58 +560,58 @@ func listCommand(c Command) int {
 		return 1
 	}
 
-	var list map[string][]string
-	if c.Flag.NArg() == 0 {
-		list, err = ListAllMetrics(Cluster.HostPorts(), listForce)
-	} else if listRegexMode && c.Flag.NArg() > 0 {
-		list, err = ListRegexMetrics(Cluster.HostPorts(), c.Flag.Arg(0), listForce)
-	} else if c.Flag.Arg(0) != "-" {
-		list, err = ListSliceMetrics(Cluster.HostPorts(), c.Flag.Args(), listForce)
-	} else {
-		list, err = ListJSONMetrics(Cluster.HostPorts(), os.Stdin, listForce)
+	requests, err := listRequests(c)
+	if err != nil {
+		return 1
 	}
 
-	results := make([]string, 0)
-	if listLocation {
+	if JSONOutput && listLocation {
+		// A map of server => metrics must be held in memory
+		list, err := multiplexListRequests(requests)
 		for _, v := range list {
 			sort.Strings(v)
 		}
-	} else {
-		// Merge and sort the results
-		for _, v := range list {
-			for _, m := range v {
-				results = append(results, m)
-			}
-		}
-		sort.Strings(results)
-	}
-
-	if JSONOutput {
-		var blob []byte
-		if listLocation {
-			blob, err = json.MarshalIndent(list, "", "\t")
-		} else {
-			blob, err = json.MarshalIndent(results, "", "\t")
-		}
-		if err != nil {
-			log.Printf("%s", err)
+		blob, err2 := json.MarshalIndent(list, "", "\t")
+		if err2 != nil {
+			log.Printf("%s", err2)
 		} else {
 			os.Stdout.Write(blob)
 			os.Stdout.Write([]byte("\n"))
 		}
-	} else {
-		if listLocation {
-			for server, metrics := range list {
-				for _, m := range metrics {
-					fmt.Printf("%s: %s\n", server, m)
-				}
-			}
-		} else {
-			for _, v := range results {
-				fmt.Printf("%s\n", v)
+		if err != nil || err2 != nil {
+			return 1
+		}
+		return 0
+	}
+
+	// Stream the sorted results
+	out := bufio.NewWriter(os.Stdout)
+	first := true
+	if JSONOutput {
+		out.WriteString("[")
+	}
+	err = mergeListRequests(requests, func(server, m string) {
+		switch {
+		case JSONOutput:
+			blob, _ := json.Marshal(m)
+			if !first {
+				out.WriteString(",")
 			}
+			fmt.Fprintf(out, "\n\t%s", blob)
+		case listLocation:
+			fmt.Fprintf(out, "%s: %s\n", server, m)
+		default:
+			fmt.Fprintf(out, "%s\n", m)
+		}
+		first = false
+	})
+	if JSONOutput {
+		if !first {
+			out.WriteString("\n")
 		}
+		out.WriteString("]\n")
 	}
+	out.Flush()
 
 	if err != nil {
 		return 1
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeLists starts a buckyd daemon for each list that answers /metrics
+// with it and returns the requests listing them.
+func fakeLists(t *testing.T, lists ...[]string) ([]metricListRequest, []string, func()) {
+	var servers []*httptest.Server
+	var hosts []string
+	for _, list := range lists {
+		blob, _ := json.Marshal(list)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(blob)
+		}))
+		servers = append(servers, server)
+		hosts = append(hosts, strings.TrimPrefix(server.URL, "http://"))
+	}
+	cleanup := func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+	return allMetricsRequests(hosts, false), hosts, cleanup
+}
+
+func TestStreamLocations(t *testing.T) {
+	requests, hosts, cleanup := fakeLists(t,
+		[]string{"a.b", "carbon.agents.x", "c.d"},
+		[]string{"a.b", "b.c"})
+	defer cleanup()
+
+	var metrics []string
+	locations := make(map[string][]string)
+	err := streamLocations(requests, func(m string, servers []string) {
+		metrics = append(metrics, m)
+		locations[m] = servers
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metrics, []string{"a.b", "b.c", "c.d"}) {
+		t.Errorf("Metrics streamed as %v", metrics)
+	}
+	if !reflect.DeepEqual(locations["a.b"], hosts) {
+		t.Errorf("a.b located on %v rather than %v", locations["a.b"], hosts)
+	}
+	if !reflect.DeepEqual(locations["b.c"], hosts[1:]) {
+		t.Errorf("b.c located on %v", locations["b.c"])
+	}
+}
+
+func TestStreamLocationsUnsorted(t *testing.T) {
+	// Older daemons list metrics in the order found on disk, where
+	// a/b/c.wsp comes before a/b-x.wsp
+	requests, hosts, cleanup := fakeLists(t,
+		[]string{"a.b.c", "a.b-x", "z"},
+		[]string{"z", "a.b-x", "a.b.c"})
+	defer cleanup()
+
+	var metrics []string
+	err := streamLocations(requests, func(m string, servers []string) {
+		metrics = append(metrics, m)
+		if !reflect.DeepEqual(servers, hosts) {
+			t.Errorf("%s located on %v rather than %v", m, servers, hosts)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metrics, []string{"a.b-x", "a.b.c", "z"}) {
+		t.Errorf("Metrics streamed as %v", metrics)
+	}
+}
+
+func TestStreamBatches(t *testing.T) {
+	requests, hosts, cleanup := fakeLists(t,
+		[]string{"a", "b", "c", "d", "e"},
+		[]string{"a"})
+	defer cleanup()
+
+	batchSize = 2
+	counts := make(map[string][]int)
+	err := streamBatches(requests, func(work *BatchWork) {
+		counts[work.server] = append(counts[work.server], len(work.names))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts[hosts[0]], []int{2, 2, 1}) || !reflect.DeepEqual(counts[hosts[1]], []int{1}) {
+		t.Errorf("Unexpected batches: %v", counts)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 )
 
 func init() {
@@ -14,12 +15,14 @@ func init() {
 	short := "Determine location in cluster for metrics."
 	long := `Output to STDOUT a Graphite host for each given metric key.  That
 host is where the given metric lives according to the hash ring.  We leave out
-the instance and assume that all instances use the same data store on the
-graphite node.
+the instance as the buckyd daemon on each graphite node handles the data
+stores of all of its instances.  When the cluster stores more than one
+replica of each metric the host of each replica is given.
 
 Metrics may be listed on the command line as arguments or, if the first
 argument is "-" we read the list from a JSON array on STDIN.  Using -j will
-produce a JSON map/hash on STDOUT of metric => host.
+produce a JSON map/hash on STDOUT of metric => host, or metric => array of
+hosts when the cluster stores more than one replica.
 
 Use -s to query the hash ring only on the host given by -h or in the BUCKYHOST
 environment variable.  Without -s, we verify the health of the cluster before
@@ -34,19 +37,22 @@ calculating metric locations.`
 
 // LocateSliceMetrics takes a slice of metric ken names and derives the location
 // of each metric in the cluster by using the consistent hash algorithm.  It
-// returns a map of metric => server.
-func LocateSliceMetrics(metrics []string) map[string]string {
+// returns a map of metric => servers holding its replicas.
+func LocateSliceMetrics(metrics []string) map[string][]string {
 	if !Cluster.Healthy {
 		log.Fatal("Cluster is inconsistent. Use the servers command to investigate.")
 	}
 
-	result := make(map[string]string)
+	ring := Cluster.Ring()
+	result := make(map[string][]string)
 	spread := make(map[string]int)
 	for _, key := range metrics {
-		// XXX: we toss away instance info here due to our assumption that a
-		// graphite node has one whisper db store
-		result[key] = Cluster.Hash.GetNode(key).Server
-		spread[result[key]]++
+		// Instance info is tossed away as buckyd handles routing to
+		// the correct whisper db store on the node
+		result[key] = ring.ReplicaServers(key)
+		for _, server := range result[key] {
+			spread[server]++
+		}
 	}
 
 	for k, v := range spread {
@@ -56,7 +62,7 @@ func LocateSliceMetrics(metrics []string) map[string]string {
 	return result
 }
 
-func LocateJSONMetrics(fd io.Reader) map[string]string {
+func LocateJSONMetrics(fd io.Reader) map[string][]string {
 	// Read the JSON from the file-like object
 	blob, err := ioutil.ReadAll(fd)
 	metrics := make([]string, 0)
@@ -77,7 +83,7 @@ func locateCommand(c Command) int {
 		return 1
 	}
 
-	var list map[string]string
+	var list map[string][]string
 	if c.Flag.NArg() == 0 {
 		log.Fatal("At least one argument is required.")
 	} else if c.Flag.Arg(0) != "-" {
@@ -87,7 +93,16 @@ func locateCommand(c Command) int {
 	}
 
 	if JSONOutput {
-		blob, err := json.Marshal(list)
+		var out interface{} = list
+		if Cluster.Replicas == 1 {
+			// Keep the metric => host form of single copy clusters
+			hosts := make(map[string]string)
+			for k, v := range list {
+				hosts[k] = v[0]
+			}
+			out = hosts
+		}
+		blob, err := json.Marshal(out)
 		if err != nil {
 			log.Printf("%s", err)
 		} else {
@@ -96,7 +111,7 @@ func locateCommand(c Command) int {
 		}
 	} else {
 		for k, v := range list {
-			fmt.Printf("%s => %s\n", k, v)
+			fmt.Printf("%s => %s\n", k, strings.Join(v, ", "))
 		}
 	}
 
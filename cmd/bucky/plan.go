@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// PlanMove is a metric to move from the Src to the Dst server, given as
+// HOST:PORT.  Size is the size of the metric on Src in bytes.  Fill is
+// true if Src holds a replica of the metric that is not deleted.
+type PlanMove struct {
+	Src    string
+	Dst    string
+	Metric string
+	Size   int64
+	Fill   bool `json:",omitempty"`
+}
+
+// PlanServer totals the moves of a plan to and from a server.
+type PlanServer struct {
+	MovesOut int
+	MovesIn  int
+	BytesOut int64
+	BytesIn  int64
+}
+
+// RebalancePlan is the list of moves a rebalance would make, as written by
+// rebalance -plan-out, with the totals for each server.
+type RebalancePlan struct {
+	Created int64
+	Bytes   int64
+	Servers map[string]*PlanServer
+	Moves   []*PlanMove
+}
+
+// statMoves returns the size of the source of each move.  Sources that
+// could not be stat'd are logged and an error returned.
+func statMoves(moves []*MigrateWork) (map[string]int64, error) {
+	sources := make(map[string][]string)
+	for _, m := range moves {
+		sources[m.oldLocation] = append(sources[m.oldLocation], m.oldName)
+	}
+	var failed error
+	sizes := make(map[string]int64)
+	for _, work := range batches(sources) {
+		err := BatchStat(work.server, work.names, func(stat *MetricData) {
+			sizes[work.server+" "+stat.Name] = stat.Size
+		})
+		if err != nil {
+			failed = err
+		}
+	}
+	return sizes, failed
+}
+
+// NewRebalancePlan builds the plan of the moves with their sizes.
+func NewRebalancePlan(moves []*MigrateWork, created int64) (*RebalancePlan, error) {
+	sizes, err := statMoves(moves)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &RebalancePlan{
+		Created: created,
+		Servers: make(map[string]*PlanServer),
+		Moves:   make([]*PlanMove, 0, len(moves)),
+	}
+	server := func(name string) *PlanServer {
+		if plan.Servers[name] == nil {
+			plan.Servers[name] = new(PlanServer)
+		}
+		return plan.Servers[name]
+	}
+	for _, m := range moves {
+		move := &PlanMove{
+			Src:    m.oldLocation,
+			Dst:    m.newLocation,
+			Metric: m.oldName,
+			Size:   sizes[m.oldLocation+" "+m.oldName],
+			Fill:   m.fill,
+		}
+		plan.Moves = append(plan.Moves, move)
+		plan.Bytes += move.Size
+		src, dst := server(move.Src), server(move.Dst)
+		src.MovesOut++
+		src.BytesOut += move.Size
+		dst.MovesIn++
+		dst.BytesIn += move.Size
+	}
+	sort.Slice(plan.Moves, func(i, j int) bool {
+		if plan.Moves[i].Src == plan.Moves[j].Src {
+			return plan.Moves[i].Metric < plan.Moves[j].Metric
+		}
+		return plan.Moves[i].Src < plan.Moves[j].Src
+	})
+	return plan, nil
+}
+
+// Log writes the totals of each server in the plan to the log.
+func (plan *RebalancePlan) Log() {
+	servers := make([]string, 0, len(plan.Servers))
+	for s := range plan.Servers {
+		servers = append(servers, s)
+	}
+	sort.Strings(servers)
+	for _, s := range servers {
+		p := plan.Servers[s]
+		log.Printf("%s: %d metrics %.2f MiB out, %d metrics %.2f MiB in", s,
+			p.MovesOut, float64(p.BytesOut)/float64(1024*1024),
+			p.MovesIn, float64(p.BytesIn)/float64(1024*1024))
+	}
+	log.Printf("Plan moves %d metrics using %.2f MiB.", len(plan.Moves),
+		float64(plan.Bytes)/float64(1024*1024))
+}
+
+// WriteRebalancePlan writes the plan as JSON to path.
+func WriteRebalancePlan(path string, plan *RebalancePlan) error {
+	blob, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(blob, '\n'), 0644)
+}
+
+// ReadRebalancePlan reads the plan at path and returns its moves.
+func ReadRebalancePlan(path string) ([]*MigrateWork, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := new(RebalancePlan)
+	if err := json.Unmarshal(blob, plan); err != nil {
+		return nil, fmt.Errorf("Error reading plan %s: %s", path, err)
+	}
+
+	moves := make([]*MigrateWork, 0, len(plan.Moves))
+	for _, m := range plan.Moves {
+		if m.Src == "" || m.Dst == "" || m.Metric == "" {
+			return nil, fmt.Errorf("Plan %s has a move without Src, Dst or Metric.", path)
+		}
+		moves = append(moves, &MigrateWork{
+			oldName:     m.Metric,
+			newName:     m.Metric,
+			oldLocation: m.Src,
+			newLocation: m.Dst,
+			fill:        m.Fill,
+		})
+	}
+	return moves, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+func TestRebalancePlanRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucky_plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var hosts []string
+	for _, sizes := range []map[string]int64{
+		{"a.b": 100, "c.d": 200},
+		{"a.b": 100, "e.f": 400},
+	} {
+		store := &fakeStore{metrics: make(map[string]*MetricData)}
+		for name, size := range sizes {
+			store.metrics[name] = &MetricData{Name: name, Size: size}
+		}
+		server := httptest.NewServer(store)
+		defer server.Close()
+		hosts = append(hosts, strings.TrimPrefix(server.URL, "http://"))
+	}
+	src1, src2, dst := hosts[0], hosts[1], "dst:4242"
+
+	// In the order the plan lists them, by source then metric
+	moves := []*MigrateWork{
+		{oldName: "a.b", newName: "a.b", oldLocation: src1, newLocation: dst},
+		{oldName: "c.d", newName: "c.d", oldLocation: src1, newLocation: src2},
+		{oldName: "a.b", newName: "a.b", oldLocation: src2, newLocation: dst, fill: true},
+		{oldName: "e.f", newName: "e.f", oldLocation: src2, newLocation: dst},
+	}
+	if src2 < src1 {
+		moves = append(moves[2:], moves[:2]...)
+	}
+	shuffled := []*MigrateWork{moves[3], moves[1], moves[0], moves[2]}
+	plan, err := NewRebalancePlan(shuffled, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Created != 1234 || plan.Bytes != 800 || len(plan.Moves) != 4 {
+		t.Errorf("Plan created %d moves %d metrics of %d bytes", plan.Created,
+			len(plan.Moves), plan.Bytes)
+	}
+	servers := map[string]*PlanServer{
+		src1: {MovesOut: 2, BytesOut: 300},
+		src2: {MovesOut: 2, BytesOut: 500, MovesIn: 1, BytesIn: 200},
+		dst:  {MovesIn: 3, BytesIn: 600},
+	}
+	if !reflect.DeepEqual(plan.Servers, servers) {
+		for s, p := range plan.Servers {
+			t.Errorf("Plan moves %+v for %s", *p, s)
+		}
+	}
+
+	path := filepath.Join(dir, "plan.json")
+	if err := WriteRebalancePlan(path, plan); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadRebalancePlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, moves) {
+		for _, m := range read {
+			t.Errorf("Plan read back with move %+v", *m)
+		}
+	}
+}
+
+func TestReadRebalancePlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucky_plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name  string
+		plan  string
+		moves []*MigrateWork
+		ok    bool
+	}{
+		{
+			name: "moves",
+			plan: `{"Moves": [{"Src": "s:1", "Dst": "d:1", "Metric": "a.b", "Size": 10},
+				{"Src": "s:1", "Dst": "d:2", "Metric": "c.d", "Fill": true}]}`,
+			moves: []*MigrateWork{
+				{oldName: "a.b", newName: "a.b", oldLocation: "s:1", newLocation: "d:1"},
+				{oldName: "c.d", newName: "c.d", oldLocation: "s:1", newLocation: "d:2", fill: true},
+			},
+			ok: true,
+		},
+		{name: "empty", plan: `{}`, moves: []*MigrateWork{}, ok: true},
+		{name: "no source", plan: `{"Moves": [{"Dst": "d:1", "Metric": "a.b"}]}`},
+		{name: "no metric", plan: `{"Moves": [{"Src": "s:1", "Dst": "d:1"}]}`},
+		{name: "truncated", plan: `{"Moves": [{"Src": "s:1",`},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1))
+		if err := ioutil.WriteFile(path, []byte(test.plan), 0644); err != nil {
+			t.Fatal(err)
+		}
+		moves, err := ReadRebalancePlan(path)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: Reading plan returned %v", test.name, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(moves, test.moves) {
+			t.Errorf("%s: Read moves %v", test.name, moves)
+		}
+	}
+}
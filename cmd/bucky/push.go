@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// PushWork is a batch of metrics to copy from one server to another.
+// size is the bytes of the metrics if known.
+type PushWork struct {
+	from  string
+	to    string
+	moves []*MigrateWork
+	size  int64
+}
+
+// pushBatches groups the moves by source and destination server into
+// batches of at most batchSize moves.  The batches of each pair of servers
+// are interleaved to spread the load across the cluster.
+func pushBatches(moves []*MigrateWork) []*PushWork {
+	size := batchSize
+	if size < 1 {
+		size = 1
+	}
+	pairs := make(map[string][]*PushWork)
+	keys := make([]string, 0)
+	for _, m := range moves {
+		key := m.oldLocation + " " + m.newLocation
+		batches := pairs[key]
+		if len(batches) == 0 {
+			keys = append(keys, key)
+		}
+		if len(batches) == 0 || len(batches[len(batches)-1].moves) >= size {
+			batches = append(batches, &PushWork{from: m.oldLocation, to: m.newLocation})
+		}
+		last := batches[len(batches)-1]
+		last.moves = append(last.moves, m)
+		pairs[key] = batches
+	}
+	sort.Strings(keys)
+
+	work := make([]*PushWork, 0)
+	for i := 0; ; i++ {
+		added := false
+		for _, key := range keys {
+			if i < len(pairs[key]) {
+				work = append(work, pairs[key][i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	return work
+}
+
+// copyMetric copies the metric through this client, backfilling it into
+// its new location.
+func copyMetric(work *MigrateWork) error {
+	metric, err := GetMetricData(work.oldLocation, work.oldName)
+	if err != nil {
+		return err
+	}
+	metric.Name = work.newName
+	return PostMetric(work.newLocation, metric)
+}
+
+// PushMetrics asks the source server of the batch to push each metric
+// straight to the destination server, which backfills it.  done is called
+// with each move that succeeded.  Daemons without the /push API, or that
+// refuse to push to the destination, have their metrics copied through
+// this client.  Failures are logged and an
+// error returned.
+func PushMetrics(work *PushWork, done func(*MigrateWork)) error {
+	var failed error
+	for _, chunk := range rateChunks(work) {
+		if err := pushChunk(chunk, done); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// rateChunks splits the batch into chunks of about a second of transfer
+// at the rate of the limiter, so pushes between daemons can be paced by
+// this client.  Without a rate the batch is returned whole.
+func rateChunks(work *PushWork) []*PushWork {
+	rate := getLimiter().Rate()
+	if rate == 0 {
+		return []*PushWork{work}
+	}
+	names := make([]string, len(work.moves))
+	for i, m := range work.moves {
+		names[i] = m.oldName
+	}
+	sizes := make(map[string]int64)
+	// Metrics that cannot be stat'd fail when pushed
+	BatchStat(work.from, names, func(stat *MetricData) {
+		sizes[stat.Name] = stat.Size
+	})
+
+	chunks := make([]*PushWork, 0)
+	var chunk *PushWork
+	for _, m := range work.moves {
+		if chunk == nil || (chunk.size > 0 && chunk.size+sizes[m.oldName] > rate) {
+			chunk = &PushWork{from: work.from, to: work.to}
+			chunks = append(chunks, chunk)
+		}
+		chunk.moves = append(chunk.moves, m)
+		chunk.size += sizes[m.oldName]
+	}
+	return chunks
+}
+
+// pushChunk pushes the metrics of the batch once the limiter allows its
+// size and a transfer from the source and to the destination are free.
+func pushChunk(work *PushWork, done func(*MigrateWork)) error {
+	var failed error
+	dest, err := SanitizeHostPort(work.to)
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return err
+	}
+	src, err := SanitizeHostPort(work.from)
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return err
+	}
+
+	items := make([]interface{}, len(work.moves))
+	for i, m := range work.moves {
+		items[i] = &PushItem{Name: m.oldName, NewName: m.newName}
+	}
+	query := url.Values{"dest": []string{dest}}.Encode()
+	i := 0
+	getLimiter().Wait(work.size)
+	// Sources before destinations so waiting transfers cannot deadlock
+	releaseSrc := sourceSlots.acquire(src, sourceLimit)
+	releaseDest := destSlots.acquire(dest, destLimit)
+	err = postBatch(work.from, "/push", query, items, func(result *BatchResult) {
+		// Results arrive in the order of the moves
+		if i >= len(work.moves) {
+			return
+		}
+		m := work.moves[i]
+		i++
+		if result.Status != 200 {
+			log.Printf("Error: Push of [%s] %s => [%s] %s failed: %s",
+				m.oldLocation, m.oldName, m.newLocation, m.newName, result.Error)
+			failed = fmt.Errorf("Push failed: %s", result.Error)
+			return
+		}
+		if Verbose {
+			log.Printf("Pushed [%s] %s => [%s] %s", m.oldLocation, m.oldName,
+				m.newLocation, m.newName)
+		}
+		done(m)
+	})
+	releaseDest()
+	releaseSrc()
+	if err == errBatchUnsupported || err == errBatchRefused {
+		log.Printf("%s cannot push to %s, copying through this client", work.from, dest)
+		for _, m := range work.moves {
+			if err := copyMetric(m); err != nil {
+				// errors already handled
+				failed = err
+			} else {
+				done(m)
+			}
+		}
+		return failed
+	}
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+// pushWorker pushes each batch of metrics, calling done with each move
+// that succeeded.
+func pushWorker(workIn chan *PushWork, done func(*MigrateWork), wg *sync.WaitGroup) {
+	for work := range workIn {
+		if err := PushMetrics(work, done); err != nil {
+			workerErrors = true
+		}
+	}
+	wg.Done()
+}
@@ -3,22 +3,44 @@ package main
 import (
 	"fmt"
 	"log"
-	"sort"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+import . "github.com/jjneely/buckytools/metrics"
+
 var doDelete bool
 var noOp bool
 
+// rebalanceJournal is the file each move is recorded in.
+var rebalanceJournal string
+
+// rebalanceResume is the journal of the rebalance to resume.
+var rebalanceResume string
+
+// rebalancePlanOut is the file the plan of the rebalance is written to
+// rather than running it.
+var rebalancePlanOut string
+
+// rebalancePlanIn is the file of the plan to run.
+var rebalancePlanIn string
+
 func init() {
 	usage := "[options] [additional buckyd servers...]"
 	short := "Rebalance a server or the entire cluster."
 	long := `Locate metrics on the wrong server and move them.
 
 Rebalance is a non-destructive operation that will find metrics that
-are on the wrong server or that have duplicates and will near-atomically
-move them to the correct server and backfill as needed.
+are on the wrong server or that have duplicates and will move them to the
+correct server and backfill as needed.
+
+When the cluster stores more than one replica of each metric, copies on any
+replica server are in the right place.  Copies elsewhere are moved to a
+replica server missing the metric, or merged into one that has it.  Other
+replicas missing the metric are filled from a correct copy, which is never
+deleted.
 
 You may optionally specify the network locations of other Buckyd daemons
 as arguments to this command.  Metrics found via these daemons will be
@@ -32,58 +54,270 @@ result in metrics that live on a different host will be completed, so other
 hosts will be affected even with -s.
 
 Use --delete to delete metric source locations.  The default is to not remove
-the source metrics.
+the source metrics.  Sources are deleted in batches of the size given by
+-batch once they have been backfilled in place and found on their new
+server.  Before a source is deleted both daemons digest its points over
+the time span of the points of the source.  Sources whose points differ on
+the new server, such as when it already held other points of the metric
+in that span, are kept and reported as failed.
 
 The --no-op option will not alter any metrics and print a report of what
 would have been done.
 
-Set -w to change the number of worker threads used to upload the Whisper
-DBs to the remote servers.`
+Use -ring or -ring-nodes to place metrics by a proposed hash ring rather
+than the cluster's, such as when adding servers.  The servers of the
+proposed ring must run buckyd and are searched for metrics as well.
+Metrics can then be copied to their new servers before carbon-relay and the
+buckyd daemons switch to the new ring.  Once they have, run rebalance with
+--delete to backfill the points written in between and delete the sources.
+Daemons will not push to servers outside of their hash ring so those
+metrics are copied through this client.
+
+Use --plan-out to write the moves to a JSON file rather than making them.
+The plan lists the source, destination, metric and size of each move along
+with the metrics and bytes each server sends and receives.  Once reviewed,
+--plan-in checks the cluster is healthy and runs exactly the moves in the
+plan without scanning the cluster, or prints them with -no-op.  They may be
+combined with -journal.
+
+Each source server is asked to push its metrics straight to their new
+server in batches of the size given by -batch.  Set -w to change the number
+of batches moved at once.  Metrics on servers that cannot push are copied
+through this client.  Use -max-per-source and -max-per-dest to cap the
+batches moved at once from and to any one server and -rate to limit the
+bytes moved per second.  The rate may be changed while running by writing
+it to the file given by -rate-file.
+
+Use -journal to record each move as it is planned, copied, verified on its
+new server and its source deleted.  The journal must not exist yet.  If the
+rebalance is interrupted use -resume with the journal to continue each move
+from its last step without scanning the cluster again.  Moves that failed
+are retried.  Give --delete again to delete the sources of the resumed
+moves.  A summary of the moves and any that failed is printed at the end.`
 
 	c := NewCommand(rebalanceCommand, "rebalance", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
+	SetupBatch(c)
+	SetupTransfer(c)
+	SetupTargetRing(c)
 
 	c.Flag.BoolVar(&doDelete, "delete", false,
 		"Delete metrics after moving them.")
 	c.Flag.BoolVar(&noOp, "no-op", false,
 		"Do not alter metrics and print report.")
 	c.Flag.IntVar(&metricWorkers, "w", 5,
-		"Downloader threads.")
+		"Batches moved at once.")
 	c.Flag.IntVar(&metricWorkers, "workers", 5,
-		"Downloader threads.")
+		"Batches moved at once.")
 	c.Flag.BoolVar(&listForce, "f", false,
 		"Force the remote daemons to rebuild their cache.")
+	c.Flag.StringVar(&rebalanceJournal, "journal", "",
+		"Record each move in this file.")
+	c.Flag.StringVar(&rebalanceResume, "resume", "",
+		"Resume the rebalance recorded in this journal.")
+	c.Flag.StringVar(&rebalancePlanOut, "plan-out", "",
+		"Write the plan of moves to this file and exit.")
+	c.Flag.StringVar(&rebalancePlanIn, "plan-in", "",
+		"Run the moves in this plan file.")
 }
 
-func rebalanceWorker(workIn chan *MigrateWork, wg *sync.WaitGroup) {
-	for work := range workIn {
-		if Verbose {
-			log.Printf("Relocating [%s] %s => [%s] %s  Delete Source: %t",
-				work.oldLocation, work.oldName,
-				work.newLocation, work.newName, doDelete)
+// rebalanceWork is a batch of moves and the last step they completed.
+type rebalanceWork struct {
+	work  *PushWork
+	state string
+}
+
+// recordFailed records the moves of all not in ok as failed with err.
+func recordFailed(journal *Journal, all, ok []*MigrateWork, err error) {
+	succeeded := make(map[string]bool)
+	for _, m := range ok {
+		succeeded[journalKey(m)] = true
+	}
+	for _, m := range all {
+		if !succeeded[journalKey(m)] {
+			journal.Record(moveFailed, m, err)
 		}
-		metric, err := GetMetricData(work.oldLocation, work.oldName)
-		if err != nil {
-			// errors already handled
-			workerErrors = true
-			continue
+	}
+}
+
+// verifyMoves checks that each moved metric exists on server and returns
+// the moves that verified.
+func verifyMoves(server string, moves []*MigrateWork, journal *Journal) []*MigrateWork {
+	names := make([]string, len(moves))
+	for i, m := range moves {
+		names[i] = m.newName
+	}
+	found := make(map[string]bool)
+	err := BatchStat(server, names, func(stat *MetricData) {
+		found[stat.Name] = true
+	})
+
+	verified := make([]*MigrateWork, 0)
+	for _, m := range moves {
+		if found[m.newName] {
+			journal.Record(moveVerified, m, nil)
+			verified = append(verified, m)
 		}
-		metric.Name = work.newName
-		err = PostMetric(work.newLocation, metric)
+	}
+	if len(verified) < len(moves) {
+		workerErrors = true
+		recordFailed(journal, moves, verified, fmt.Errorf("Verify failed: %s", err))
+	}
+	return verified
+}
+
+// digestMoves compares the points of the source of each move with those
+// of its destination over the time span of the source's points, and
+// returns the moves whose destination holds the same points.  The others
+// are recorded as failed so their sources are not deleted.
+func digestMoves(work *PushWork, moves []*MigrateWork, journal *Journal) []*MigrateWork {
+	names := make([]string, len(moves))
+	for i, m := range moves {
+		names[i] = m.oldName
+	}
+	var failed error
+	spans := make(map[string]*BatchItem)
+	err := BatchDigest(work.from, names, 0, time.Now().Unix(), func(result *BatchResult) {
+		if result.Status != 200 || result.Digest == nil {
+			log.Printf("Error: Digest of [%s] %s failed: %s", work.from, result.Name,
+				result.Error)
+			failed = fmt.Errorf("Digest failed: %s", result.Error)
+			return
+		}
+		if from, until, ok := result.Digest.PointSpan(); ok {
+			spans[result.Name] = &BatchItem{Name: result.Name, From: from, Until: until}
+		} else {
+			spans[result.Name] = &BatchItem{Name: result.Name}
+		}
+	})
+	if err != nil {
+		failed = err
+	}
+
+	// Digest both copies over the span of the source
+	srcItems := make([]*BatchItem, 0, len(moves))
+	dstItems := make([]*BatchItem, 0, len(moves))
+	for _, m := range moves {
+		if span, ok := spans[m.oldName]; ok && span.Until != 0 {
+			srcItems = append(srcItems, span)
+			dstItems = append(dstItems, &BatchItem{Name: m.newName, From: span.From,
+				Until: span.Until})
+		}
+	}
+	digests := func(server string, items []*BatchItem) map[string]*MetricDigest {
+		ret := make(map[string]*MetricDigest)
+		if len(items) == 0 {
+			return ret
+		}
+		err := BatchDigestItems(server, items, func(result *BatchResult) {
+			if result.Status == 200 && result.Digest != nil {
+				ret[result.Name] = result.Digest
+			} else if result.Status != 404 {
+				log.Printf("Error: Digest of [%s] %s failed: %s", server, result.Name,
+					result.Error)
+				failed = fmt.Errorf("Digest failed: %s", result.Error)
+			}
+		})
 		if err != nil {
-			// errors already handled
-			workerErrors = true
-			continue
+			failed = err
 		}
+		return ret
+	}
+	src := digests(work.from, srcItems)
+	dst := digests(work.to, dstItems)
 
-		// We only delete if there are no errors present
-		if doDelete {
-			err = DeleteMetric(work.oldLocation, work.oldName)
+	matched := make([]*MigrateWork, 0)
+	for _, m := range moves {
+		span, ok := spans[m.oldName]
+		switch {
+		case !ok:
+		case span.Until == 0:
+			// The source has no points to lose
+			matched = append(matched, m)
+		case src[m.oldName] != nil && dst[m.newName] != nil && src[m.oldName].Equal(dst[m.newName]):
+			matched = append(matched, m)
+		case src[m.oldName] != nil:
+			log.Printf("Error: [%s] %s differs from [%s] %s, keeping the source",
+				work.to, m.newName, work.from, m.oldName)
+			failed = fmt.Errorf("Destination differs from source")
+		}
+	}
+	if len(matched) < len(moves) {
+		workerErrors = true
+		recordFailed(journal, moves, matched, fmt.Errorf("Verify failed: %s", failed))
+	}
+	return matched
+}
+
+// deleteMoves deletes the source of each move from server and returns the
+// moves deleted.
+func deleteMoves(server string, moves []*MigrateWork, journal *Journal) []*MigrateWork {
+	if len(moves) == 0 {
+		return moves
+	}
+	byName := make(map[string]*MigrateWork)
+	names := make([]string, len(moves))
+	for i, m := range moves {
+		byName[m.oldName] = m
+		names[i] = m.oldName
+	}
+	deleted := make([]*MigrateWork, 0)
+	err := BatchDelete(server, names, func(name string) {
+		if m, ok := byName[name]; ok {
+			journal.Record(moveDeleted, m, nil)
+			deleted = append(deleted, m)
+		}
+	})
+	if len(deleted) < len(moves) {
+		workerErrors = true
+		recordFailed(journal, moves, deleted, fmt.Errorf("Delete failed: %s", err))
+	}
+	return deleted
+}
+
+// rebalanceWorker takes each batch of moves through the steps after the
+// one they last completed: copying, verifying the copy and deleting the
+// source if doDelete is set and the move is not a fill.  Sources are only
+// deleted once their points are found on the destination.  Each step is
+// recorded in the journal and done is called with each move that
+// finishes.
+func rebalanceWorker(workIn chan *rebalanceWork, journal *Journal, done func(*MigrateWork), wg *sync.WaitGroup) {
+	for w := range workIn {
+		moves := w.work.moves
+		if w.state == movePlanned {
+			copied := make([]*MigrateWork, 0)
+			err := PushMetrics(w.work, func(m *MigrateWork) {
+				journal.Record(moveCopied, m, nil)
+				copied = append(copied, m)
+			})
 			if err != nil {
 				workerErrors = true
+				recordFailed(journal, moves, copied, fmt.Errorf("Copy failed: %s", err))
+			}
+			moves = copied
+		}
+		if len(moves) > 0 && (w.state == movePlanned || w.state == moveCopied) {
+			moves = verifyMoves(w.work.to, moves, journal)
+		}
+		if len(moves) > 0 && doDelete {
+			kept := make([]*MigrateWork, 0)
+			sources := make([]*MigrateWork, 0)
+			for _, m := range moves {
+				if m.fill {
+					kept = append(kept, m)
+				} else {
+					sources = append(sources, m)
+				}
+			}
+			if len(sources) > 0 {
+				sources = digestMoves(w.work, sources, journal)
 			}
+			moves = append(kept, deleteMoves(w.work.from, sources, journal)...)
+		}
+		for _, m := range moves {
+			done(m)
 		}
 	}
 	wg.Done()
@@ -98,100 +332,244 @@ func countMap(metricsMap map[string][]string) int {
 	return c
 }
 
+// planRebalance finds the metrics on the wrong server of the target ring,
+// or duplicates, and returns the moves to the correct server.  Replicas
+// missing a copy are filled from a correct replica, which is kept.
+// Additional host:port strings can be given via extraHostPorts to locate
+// additional Buckyd daemons not in the current hash ring.
+func planRebalance(extraHostPorts []string) ([]*MigrateWork, error) {
+	target, err := GetTargetRing()
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+	hostPorts := mergeHostPorts(Cluster.HostPorts(), target.HostPorts(), extraHostPorts)
+	if len(hostPorts) == 0 || !Cluster.Healthy {
+		log.Printf("Cluster is unhealthy or error finding cluster members.")
+		return nil, fmt.Errorf("Cluster is unhealthy.")
+	}
+
+	jobs := make([]*MigrateWork, 0)
+	moves := make(map[string]int)
+	fills := make(map[string]int)
+	deferred := 0
+	// Only the moves are held in memory as the listings stream by
+	requests := allMetricsRequests(hostPorts, listForce)
+	err = streamLocations(requests, func(m string, have []string) {
+		want, misplaced, missing, healthy := replicaSets(m, have, target)
+
+		// Each misplaced copy moves to a missing replica, or is merged
+		// into the first replica once none are missing
+		for i, server := range misplaced {
+			work := &MigrateWork{oldName: m, newName: m, oldLocation: server}
+			if i < len(missing) {
+				work.newLocation = missing[i]
+			} else {
+				work.newLocation = want[0]
+			}
+			jobs = append(jobs, work)
+			moves[server]++
+		}
+		// Other missing replicas are filled from a correct replica
+		if len(missing) > len(misplaced) {
+			if len(healthy) == 0 {
+				deferred += len(missing) - len(misplaced)
+				return
+			}
+			for _, server := range missing[len(misplaced):] {
+				work := &MigrateWork{oldName: m, newName: m, fill: true,
+					oldLocation: healthy[0], newLocation: server}
+				jobs = append(jobs, work)
+				fills[server]++
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("Error retrieving metric lists: %s", err)
+		return nil, err
+	}
+
+	if noOp {
+		logMoves(jobs)
+	}
+	for _, server := range hostPorts {
+		if moves[server] > 0 {
+			log.Printf("%d metrics on %s must be relocated", moves[server], server)
+		}
+		if fills[server] > 0 {
+			log.Printf("%d metrics are missing a replica on %s", fills[server], server)
+		}
+	}
+	if deferred > 0 {
+		log.Printf("%d missing replicas have no correct copy to fill from "+
+			"yet, rebalance again once the moves are complete.", deferred)
+	}
+	return jobs, nil
+}
+
+// logMoves logs each move for a no-op report.
+func logMoves(jobs []*MigrateWork) {
+	for _, work := range jobs {
+		op := "=>"
+		if work.fill {
+			op = "fill"
+		}
+		log.Printf("[%s] %s %s %s", work.oldLocation, work.oldName, op,
+			work.newLocation)
+	}
+}
+
 // RebalanceMetrics will relocate metrics on the wrong server or duplicate
 // metrics and move them to the correct server, backfilling as needed.
-// It will clean up the old location unless doDelete is false.  The goal
-// is to be near atomic as we can.  Metrics are removed directly after
-// they have been backfilled in place.
+// It will clean up the old location unless doDelete is false.  Metrics
+// are removed in batches per server after they have been backfilled in
+// place.
 //
 // Additional host:port strings can be given via extraHostPorts to
 // locate additional Buckyd daemons not in the current hash ring.  This
 // will effectively drain all metrics off of these hosts.
+//
+// With rebalancePlanOut set the moves are written to that file as a
+// RebalancePlan instead of being run.
 func RebalanceMetrics(extraHostPorts []string) error {
-	hostPorts := Cluster.HostPorts()
-	hostPorts = append(hostPorts, extraHostPorts...)
-	if len(hostPorts) == 0 || !Cluster.Healthy {
-		log.Printf("Cluster is unhealthy or error finding cluster members.")
-		return fmt.Errorf("Cluster is unhealthy.")
-	}
-
-	metricMap, err := InconsistentMetrics(hostPorts)
+	jobs, err := planRebalance(extraHostPorts)
 	if err != nil {
-		return err // error already reported
+		return err
 	}
-	if len(metricMap) == 0 {
+	if len(jobs) == 0 {
 		log.Printf("Cluster is balanced.")
 		return nil
 	}
 
-	l := countMap(metricMap)
-	log.Printf("Relocating %d metrics.", l)
-	workIn := make(chan *MigrateWork, 25)
-	wg := new(sync.WaitGroup)
-	wg.Add(metricWorkers)
-	for i := 0; i < metricWorkers; i++ {
-		go rebalanceWorker(workIn, wg)
+	if rebalancePlanOut != "" {
+		plan, err := NewRebalancePlan(jobs, time.Now().Unix())
+		if err != nil {
+			log.Printf("Error sizing the moves: %s", err)
+			return err
+		}
+		plan.Log()
+		if err = WriteRebalancePlan(rebalancePlanOut, plan); err != nil {
+			log.Printf("Error writing plan: %s", err)
+			return err
+		}
+		log.Printf("Plan written to %s.", rebalancePlanOut)
+		return nil
 	}
+	if noOp {
+		log.Fatal("Halting.  No-op mode enganged.")
+	}
+	return MoveMetrics(jobs)
+}
 
-	// build an order of jobs not dependent on location
-	jobs := make(map[string]*MigrateWork)
-	moves := make(map[string]int)
-	servers := make([]string, 0)
-	for server, metrics := range metricMap {
-		servers = append(servers, server)
-		for _, m := range metrics {
-			work := new(MigrateWork)
-			work.oldName = m
-			work.newName = m
-			work.oldLocation = server
-			work.newLocation = Cluster.Hash.GetNode(work.newName).Server
-
-			id := fmt.Sprintf("[%s] %s", server, m)
-			jobs[id] = work
-			moves[server]++
-
-			if noOp {
-				log.Printf("%s => %s", id, work.newLocation)
-			}
+// MoveMetrics runs the moves.  Each move is recorded in the journal at
+// rebalanceJournal, if set, so an interrupted rebalance can be resumed
+// with ResumeRebalance.
+func MoveMetrics(jobs []*MigrateWork) error {
+	var err error
+	journal := newJournal()
+	if rebalanceJournal != "" {
+		journal, err = CreateJournal(rebalanceJournal)
+		if err != nil {
+			log.Printf("Error creating journal: %s", err)
+			return err
 		}
+		defer journal.Close()
 	}
-
-	sort.Strings(servers)
-	for _, server := range servers {
-		log.Printf("%d metrics on %s must be relocated", moves[server], server)
+	for _, work := range jobs {
+		journal.Record(movePlanned, work, nil)
 	}
+	return runRebalance(journal)
+}
 
+// RunRebalancePlan runs the moves of the plan written to path by
+// -plan-out.  As when planning, the cluster must be healthy and in no-op
+// mode the moves are only logged.
+func RunRebalancePlan(path string) error {
+	if !Cluster.Healthy {
+		log.Printf("Cluster is unhealthy or error finding cluster members.")
+		return fmt.Errorf("Cluster is unhealthy.")
+	}
+	jobs, err := ReadRebalancePlan(path)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	log.Printf("Running the %d moves of %s.", len(jobs), path)
 	if noOp {
-		close(workIn)
+		logMoves(jobs)
 		log.Fatal("Halting.  No-op mode enganged.")
 	}
+	return MoveMetrics(jobs)
+}
 
-	// Queue up and process work
-	c := 0
+// ResumeRebalance finishes the moves of the rebalance recorded in the
+// journal at path, including those that failed.  Moves continue from the
+// last step they completed.
+func ResumeRebalance(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("Error opening journal: %s", err)
+		return err
+	}
+	journal, err := OpenJournal(path)
+	if err != nil {
+		log.Printf("Error opening journal: %s", err)
+		return err
+	}
+	defer journal.Close()
+	return runRebalance(journal)
+}
+
+// runRebalance runs the moves in the journal that have not finished.
+func runRebalance(journal *Journal) error {
+	pending := journal.Pending(doDelete)
+	l := 0
+	for _, moves := range pending {
+		l += len(moves)
+	}
+	log.Printf("Relocating %d metrics.", l)
+	workIn := make(chan *rebalanceWork, metricWorkers)
+	wg := new(sync.WaitGroup)
+
+	// Report progress as moves complete
+	var c int64
 	t := time.Now().Unix()
-	for work := range jobs {
-		workIn <- jobs[work]
-		c++
-		if c%10 == 0 {
-			now := time.Now().Unix()
-			s := now - t
+	done := func(work *MigrateWork) {
+		n := atomic.AddInt64(&c, 1)
+		if n%100 == 0 {
+			s := time.Now().Unix() - t
 			if s == 0 {
 				s = 1
 			}
 			log.Printf("Progress %d / %d: %.2f%%  Metrics/second: %.2f  Delete: %t",
-				c, l,
-				100*float64(c)/float64(l),
-				float64(c)/float64(s),
+				n, l,
+				100*float64(n)/float64(l),
+				float64(n)/float64(s),
 				doDelete)
 		}
 	}
 
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go rebalanceWorker(workIn, journal, done, wg)
+	}
+
+	// Queue up and process work
+	for _, state := range []string{movePlanned, moveCopied, moveVerified} {
+		for _, work := range pushBatches(pending[state]) {
+			workIn <- &rebalanceWork{work, state}
+		}
+	}
+
 	close(workIn)
 	wg.Wait()
 
 	log.Printf("Rebalance complete.")
-	if workerErrors {
+	if journal.Summary() > 0 || workerErrors {
 		log.Printf("Errors are present in rebalance.")
+		if journal.fd != nil {
+			log.Printf("Retry the failed moves with: bucky rebalance -resume %s",
+				journal.fd.Name())
+		}
 		return fmt.Errorf("Errors present.")
 	}
 	return nil
@@ -205,6 +583,25 @@ func rebalanceCommand(c Command) int {
 		return 1
 	}
 
+	if err = StartTransfers(); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if rebalanceResume != "" {
+		if err = ResumeRebalance(rebalanceResume); err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	if rebalancePlanIn != "" {
+		if err = RunRebalancePlan(rebalancePlanIn); err != nil {
+			return 1
+		}
+		return 0
+	}
+
 	var oldBuckyd []string
 	for i := 0; i < c.Flag.NArg(); i++ {
 		oldBuckyd = append(oldBuckyd, c.Flag.Arg(i))
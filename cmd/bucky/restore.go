@@ -43,6 +43,7 @@ DBs to the remote servers.`
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
+	SetupTransfer(c)
 
 	c.Flag.IntVar(&metricWorkers, "w", 5,
 		"Downloader threads.")
@@ -54,7 +55,7 @@ DBs to the remote servers.`
 
 func restoreTarWorker(workIn chan *MetricData, servers []string, wg *sync.WaitGroup) {
 	for work := range workIn {
-		server := Cluster.Hash.GetNode(work.Name).Server
+		server := Cluster.Hash.GetNode(HashKey(work.Name)).Server
 		if SingleHost && server != servers[0] {
 			log.Printf("In single mode, skipping metric %s for server %s", work.Name, server)
 			continue
@@ -140,6 +141,11 @@ func restoreCommand(c Command) int {
 		return 1
 	}
 
+	if err = StartTransfers(); err != nil {
+		log.Print(err)
+		return 1
+	}
+
 	if c.Flag.NArg() == 0 {
 		log.Fatal("At least one argument is required.")
 	}
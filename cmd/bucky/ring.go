@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// ringFile is a JSON hash ring, as served by buckyd's /hashring, that
+// metrics are placed by instead of the cluster's.
+var ringFile string
+
+// ringNodes is a comma separated list of nodes of the hash ring metrics
+// are placed by instead of the cluster's.
+var ringNodes string
+
+// ringAlgo and ringReplicas configure the hash ring of ringNodes.
+var ringAlgo string
+var ringReplicas int
+
+// TargetRing is the hash ring that decides where metrics belong.
+type TargetRing struct {
+	// Hash places the metrics
+	Hash hashing.HashRing
+
+	// Servers is a list of the distinct servers in the ring
+	Servers []string
+
+	// Replicas is the number of servers each metric is stored on
+	Replicas int
+}
+
+// Ring returns the hash ring of the cluster.
+func (c *ClusterConfig) Ring() *TargetRing {
+	return &TargetRing{c.Hash, c.Servers, c.Replicas}
+}
+
+// SetupTargetRing installs the flags that give a hash ring other than the
+// cluster's to place metrics by.
+func SetupTargetRing(c Command) {
+	c.Flag.StringVar(&ringFile, "ring", "",
+		"JSON file of the target hash ring as served by buckyd's /hashring.")
+	c.Flag.StringVar(&ringNodes, "ring-nodes", "",
+		"Comma separated HOST[:PORT][=INSTANCE] nodes of the target hash ring.")
+	c.Flag.StringVar(&ringAlgo, "ring-algo", "",
+		"Hash algorithm of -ring-nodes.  Defaults to the cluster's.")
+	c.Flag.IntVar(&ringReplicas, "ring-replicas", 0,
+		"Replicas of -ring-nodes.  Defaults to the cluster's.")
+}
+
+// GetTargetRing returns the hash ring given by -ring or -ring-nodes or,
+// without either, the cluster's.  GetClusterConfig must have been called.
+func GetTargetRing() (*TargetRing, error) {
+	if ringFile == "" && ringNodes == "" {
+		return Cluster.Ring(), nil
+	}
+	if ringFile != "" && ringNodes != "" {
+		return nil, fmt.Errorf("Only one of -ring and -ring-nodes may be given.")
+	}
+
+	ring := new(hashing.JSONRingType)
+	if ringFile != "" {
+		blob, err := ioutil.ReadFile(ringFile)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(blob, ring); err != nil {
+			return nil, fmt.Errorf("Error reading hash ring %s: %s", ringFile, err)
+		}
+	} else {
+		ring.Algo = ringAlgo
+		if ring.Algo == "" {
+			ring.Algo = Cluster.Algo
+		}
+		ring.Replicas = ringReplicas
+		if ring.Replicas == 0 {
+			ring.Replicas = Cluster.Replicas
+		}
+		for _, s := range strings.Split(ringNodes, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			node, err := hashing.NewNodeParser(s)
+			if err != nil {
+				return nil, err
+			}
+			ring.Nodes = append(ring.Nodes, node)
+		}
+	}
+	if len(ring.Nodes) == 0 {
+		return nil, fmt.Errorf("The target hash ring has no nodes.")
+	}
+
+	target := &TargetRing{Replicas: ring.Replicas}
+	if target.Replicas < 1 {
+		target.Replicas = 1
+	}
+	var err error
+	target.Hash, err = ring.HashRing()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, n := range ring.Nodes {
+		if !seen[n.Server] {
+			seen[n.Server] = true
+			target.Servers = append(target.Servers, n.Server)
+		}
+	}
+	return target, nil
+}
+
+// ReplicaServers returns the servers that should hold the metric.  These
+// are the first Replicas distinct servers the ring returns for it, as
+// buckyd places them.
+func (t *TargetRing) ReplicaServers(metric string) []string {
+	nodes := hashing.ReplicaNodes(t.Hash, HashKey(metric), t.Replicas)
+	servers := make([]string, len(nodes))
+	for i, n := range nodes {
+		servers[i] = n.Server
+	}
+	return servers
+}
+
+// HostPorts returns the HOST:PORT of the buckyd daemon on each server of
+// the ring.
+func (t *TargetRing) HostPorts() []string {
+	ret := make([]string, 0)
+	for _, v := range t.Servers {
+		ret = append(ret, fmt.Sprintf("%s:%s", v, Cluster.Port))
+	}
+	return ret
+}
+
+// mergeHostPorts returns the distinct HOST:PORT strings of the lists.
+func mergeHostPorts(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0)
+	for _, list := range lists {
+		for _, v := range list {
+			if !seen[v] {
+				seen[v] = true
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+// testRing returns a TargetRing of the servers with two instances each.
+func testRing(t *testing.T, replicas int, servers ...string) *TargetRing {
+	ring := &hashing.JSONRingType{Algo: "carbon", Replicas: replicas}
+	for _, server := range servers {
+		ring.Nodes = append(ring.Nodes,
+			hashing.NewNode(server, 0, "a"), hashing.NewNode(server, 0, "b"))
+	}
+	hash, err := ring.HashRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TargetRing{Hash: hash, Servers: servers, Replicas: replicas}
+}
+
+func TestReplicaServersDiverse(t *testing.T) {
+	tests := []struct {
+		servers  []string
+		replicas int
+		want     int
+	}{
+		{[]string{"a", "b", "c"}, 1, 1},
+		{[]string{"a", "b", "c"}, 2, 2},
+		{[]string{"a", "b", "c"}, 3, 3},
+		{[]string{"a", "b"}, 3, 2},
+	}
+	for _, test := range tests {
+		target := testRing(t, test.replicas, test.servers...)
+		for i := 0; i < 500; i++ {
+			m := fmt.Sprintf("replica.metric%d", i)
+			servers := target.ReplicaServers(m)
+			if len(servers) != test.want {
+				t.Fatalf("%d replicas on %v placed %s on %v", test.replicas,
+					test.servers, m, servers)
+			}
+			seen := make(map[string]bool)
+			for _, s := range servers {
+				if seen[s] {
+					t.Fatalf("%s placed twice on %s: %v", m, s, servers)
+				}
+				seen[s] = true
+			}
+		}
+	}
+}
+
+func TestGetTargetRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucky_ring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ringJSON := filepath.Join(dir, "ring.json")
+	err = ioutil.WriteFile(ringJSON, []byte(`{"Algo": "carbon", "Nodes": [
+		{"Server": "c", "Port": 2003, "Instance": "a"},
+		{"Server": "d", "Port": 2003, "Instance": "a"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(c *ClusterConfig) { Cluster = c }(Cluster)
+	Cluster = &ClusterConfig{Port: "4242", Servers: []string{"a", "b"},
+		Algo: "carbon", Replicas: 2, Hash: testRing(t, 2, "a", "b").Hash}
+	defer func() { ringFile, ringNodes, ringReplicas = "", "", 0 }()
+
+	tests := []struct {
+		file     string
+		nodes    string
+		replicas int
+		servers  []string
+		want     int
+		ok       bool
+	}{
+		{"", "", 0, []string{"a", "b"}, 2, true},
+		{"", "a:2003=a, a:2003=b, c:2003=a", 0, []string{"a", "c"}, 2, true},
+		{"", "a=a,b=a,c=a", 3, []string{"a", "b", "c"}, 3, true},
+		{ringJSON, "", 0, []string{"c", "d"}, 1, true},
+		{ringJSON, "a=a", 0, nil, 0, false},
+		{"", " , ", 0, nil, 0, false},
+		{"", "a:x", 0, nil, 0, false},
+		{filepath.Join(dir, "missing.json"), "", 0, nil, 0, false},
+	}
+	for _, test := range tests {
+		ringFile, ringNodes, ringReplicas = test.file, test.nodes, test.replicas
+		target, err := GetTargetRing()
+		if (err == nil) != test.ok {
+			t.Errorf("-ring %q -ring-nodes %q returned %v", test.file, test.nodes, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if !reflect.DeepEqual(target.Servers, test.servers) || target.Replicas != test.want {
+			t.Errorf("-ring %q -ring-nodes %q has servers %v and %d replicas",
+				test.file, test.nodes, target.Servers, target.Replicas)
+		}
+	}
+}
+
+func TestReplicaSetsProposedRing(t *testing.T) {
+	defer func(c *ClusterConfig) { Cluster = c }(Cluster)
+	Cluster = &ClusterConfig{Port: "4242"}
+	current := testRing(t, 2, "a", "b", "c")
+	proposed := testRing(t, 2, "a", "b", "c", "d")
+
+	hostPorts := func(servers []string) []string {
+		ret := make([]string, len(servers))
+		for i, s := range servers {
+			ret[i] = s + ":4242"
+		}
+		return ret
+	}
+	moved := 0
+	for i := 0; i < 500; i++ {
+		m := fmt.Sprintf("proposed.metric%d", i)
+		have := hostPorts(current.ReplicaServers(m))
+		want, misplaced, missing, healthy := replicaSets(m, have, proposed)
+		if !reflect.DeepEqual(want, hostPorts(proposed.ReplicaServers(m))) {
+			t.Fatalf("%s wanted on %v", m, want)
+		}
+
+		// Each copy is kept or moved and each replica kept or filled
+		if len(healthy)+len(misplaced) != len(have) || len(healthy)+len(missing) != len(want) {
+			t.Fatalf("%s on %v: misplaced %v, missing %v, healthy %v", m, have,
+				misplaced, missing, healthy)
+		}
+		for _, s := range misplaced {
+			if containsString(want, s) {
+				t.Fatalf("%s is misplaced on %s, a replica", m, s)
+			}
+		}
+		for _, s := range missing {
+			if containsString(have, s) || s != "d:4242" {
+				t.Fatalf("%s is missing from %s", m, s)
+			}
+		}
+		if len(misplaced) > 0 {
+			moved++
+		}
+
+		// Unchanged under the current ring
+		_, misplaced, missing, _ = replicaSets(m, have, current)
+		if len(misplaced) != 0 || len(missing) != 0 {
+			t.Fatalf("%s on %v is misplaced %v, missing %v under the current ring",
+				m, have, misplaced, missing)
+		}
+	}
+	if moved == 0 || moved == 500 {
+		t.Errorf("Adding a server moved %d of 500 metrics", moved)
+	}
+}
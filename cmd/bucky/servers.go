@@ -1,10 +1,23 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 )
 
+import . "github.com/jjneely/buckytools/metrics"
+
+// serversFull is the percentage of disk space or inodes used at which a
+// server is flagged as full.
+var serversFull float64
+
 func init() {
 	usage := "[options]"
 	short := "List out servers in the Graphite cluster."
@@ -13,12 +26,197 @@ of the Graphite cluster.  You will need to supply a HOST:PORT to locate one of t
 buckyd daemons running on the Graphite cluster.  This command exists with an error
 if a host in the cluster doesn't respond or has a different hash ring configuration
 than the other members.  Using -s for a single host check tests if the given host
-is alive.`
+is alive.
+
+A status table of the servers follows with the buckyd version, uptime,
+number of metrics and age of the metric cache, and the highest percentage of
+disk space and inodes used by any of the server's whisper stores.  Servers
+are flagged with:
+
+    DOWN     The server did not report its status.
+    FULL     A whisper store has used more than -full percent of its disk
+             space or inodes.
+    VERSION  The server runs a different buckyd version than most of the
+             cluster.
+    STALE    The metric cache is older than the daemon's cache timeout.
+
+This command also exits with an error if any server is flagged.  Use -j to
+dump the status of each server as JSON, which exits the same way.`
 
 	c := NewCommand(serversCommand, "servers", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
+	SetupJSON(c)
+
+	c.Flag.Float64Var(&serversFull, "full", 90,
+		"Flag servers with a whisper store this percent full.")
+}
+
+// GetServerStatus retrieves the /status of the buckyd daemon at server.
+func GetServerStatus(server string) (*ServerStatus, error) {
+	u := &url.URL{
+		Scheme: URLScheme(),
+		Host:   server,
+		Path:   "/status",
+	}
+
+	resp, err := GetHTTP().Get(u.String())
+	if err != nil {
+		log.Printf("Error retrieving URL: %s", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		log.Printf("/status API on %s returned: %s", server, resp.Status)
+		return nil, fmt.Errorf("/status API called returned: %s", resp.Status)
+	}
+	blob, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading response body: %s", err)
+		return nil, err
+	}
+	status := new(ServerStatus)
+	err = json.Unmarshal(blob, status)
+	if err != nil {
+		log.Printf("Could not unmarshal JSON from host %s: %s", server, err)
+		return nil, err
+	}
+	return status, nil
+}
+
+// GetClusterStatus retrieves the status of each server in parallel.
+// Servers that fail to respond are absent from the result.
+func GetClusterStatus(servers []string) map[string]*ServerStatus {
+	statusMap := make(map[string]*ServerStatus)
+	lock := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			status, err := GetServerStatus(server)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			statusMap[server] = status
+			lock.Unlock()
+		}(server)
+	}
+	wg.Wait()
+	return statusMap
+}
+
+// usedPercent returns the highest percentage of disk space and of inodes
+// used by the whisper stores in status.
+func usedPercent(status *ServerStatus) (float64, float64) {
+	var disk, inodes float64
+	for _, r := range status.Roots {
+		if r.Total > 0 {
+			if p := 100 * float64(r.Total-r.Free) / float64(r.Total); p > disk {
+				disk = p
+			}
+		}
+		if r.Inodes > 0 {
+			if p := 100 * float64(r.Inodes-r.FreeInodes) / float64(r.Inodes); p > inodes {
+				inodes = p
+			}
+		}
+	}
+	return disk, inodes
+}
+
+// commonVersion returns the buckyd version run by most servers.
+func commonVersion(statusMap map[string]*ServerStatus) string {
+	counts := make(map[string]int)
+	for _, status := range statusMap {
+		counts[status.Version]++
+	}
+	best := ""
+	for version, n := range counts {
+		if n > counts[best] || (n == counts[best] && version > best) {
+			best = version
+		}
+	}
+	return best
+}
+
+// statusFlags returns the problems with the server.
+func statusFlags(status *ServerStatus, version string) []string {
+	flags := make([]string, 0)
+	if status == nil {
+		return append(flags, "DOWN")
+	}
+	disk, inodes := usedPercent(status)
+	if disk >= serversFull || inodes >= serversFull {
+		flags = append(flags, "FULL")
+	}
+	if status.Version != version {
+		flags = append(flags, "VERSION")
+	}
+	if status.CacheAge > status.CacheTimeOut {
+		flags = append(flags, "STALE")
+	}
+	return flags
+}
+
+// formatAge formats seconds with its two largest units, such as 3d4h.
+func formatAge(seconds int64) string {
+	if seconds < 0 {
+		return "-"
+	}
+	units := []struct {
+		name string
+		secs int64
+	}{{"d", 86400}, {"h", 3600}, {"m", 60}, {"s", 1}}
+	for i, u := range units[:len(units)-1] {
+		if seconds >= u.secs {
+			next := units[i+1]
+			result := fmt.Sprintf("%d%s", seconds/u.secs, u.name)
+			if rem := seconds % u.secs / next.secs; rem > 0 {
+				result += fmt.Sprintf("%d%s", rem, next.name)
+			}
+			return result
+		}
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
+
+// printClusterStatus writes the status table to STDOUT and returns true if
+// any server was flagged.
+func printClusterStatus(servers []string, statusMap map[string]*ServerStatus) bool {
+	sort.Strings(servers)
+	version := commonVersion(statusMap)
+	flagged := false
+
+	fmt.Printf("%-30s %-8s %8s %10s %8s %6s %6s  %s\n", "Server", "Version",
+		"Uptime", "Metrics", "Cache", "Disk", "Inodes", "Flags")
+	for _, server := range servers {
+		status := statusMap[server]
+		flags := statusFlags(status, version)
+		if len(flags) > 0 {
+			flagged = true
+		} else {
+			flags = append(flags, "OK")
+		}
+		if status == nil {
+			fmt.Printf("%-30s %-8s %8s %10s %8s %6s %6s  %s\n", server, "-",
+				"-", "-", "-", "-", "-", strings.Join(flags, ","))
+			continue
+		}
+
+		disk, inodes := usedPercent(status)
+		cache := formatAge(status.CacheAge)
+		if status.Refreshing {
+			cache = "refresh"
+		}
+		fmt.Printf("%-30s %-8s %8s %10d %8s %5.1f%% %5.1f%%  %s\n", server,
+			status.Version, formatAge(status.Uptime), status.Metrics, cache,
+			disk, inodes, strings.Join(flags, ","))
+	}
+	return flagged
 }
 
 // serversCommand runs this subcommand.
@@ -29,19 +227,53 @@ func serversCommand(c Command) int {
 		return 1
 	}
 
+	servers := Cluster.HostPorts()
+	if SingleHost {
+		servers = []string{HostPort}
+	}
+	statusMap := GetClusterStatus(servers)
+	if JSONOutput {
+		blob, err := json.Marshal(statusMap)
+		if err != nil {
+			log.Printf("%s", err)
+			return 1
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+		version := commonVersion(statusMap)
+		flagged := false
+		for _, server := range servers {
+			if len(statusFlags(statusMap[server], version)) > 0 {
+				flagged = true
+			}
+		}
+		return serversExit(flagged)
+	}
+
 	fmt.Printf("Buckd daemons are using port: %s\n", Cluster.Port)
 	fmt.Printf("Hashing algorithm: %v\n", Cluster.Hash)
-	fmt.Printf("Number of replicas: %d\n", Cluster.Hash.Replicas())
+	fmt.Printf("Number of replicas: %d\n", Cluster.Replicas)
 	fmt.Printf("Found these servers:\n")
 
 	for _, v := range Cluster.Servers {
 		fmt.Printf("\t%s\n", v)
 	}
-	fmt.Printf("\nIs cluster healthy: %v\n", Cluster.Healthy)
+	fmt.Printf("\nIs cluster healthy: %v\n\n", Cluster.Healthy)
+
+	return serversExit(printClusterStatus(servers, statusMap))
+}
+
+// serversExit returns the exit code of this subcommand, an error if the
+// cluster is inconsistent or any server was flagged.
+func serversExit(flagged bool) int {
 	if !Cluster.Healthy {
 		log.Printf("Cluster is inconsistent.")
 		return 1
 	}
+	if flagged {
+		log.Printf("Problems found with servers in the cluster.")
+		return 1
+	}
 
 	return 0
 }
@@ -33,6 +33,7 @@ BUCKYSERVER environment variable.`
 	SetupHostname(c)
 	SetupSingle(c)
 	SetupJSON(c)
+	SetupBatch(c)
 
 	c.Flag.BoolVar(&listRegexMode, "r", false,
 		"Filter by a regular expression.")
@@ -42,13 +43,13 @@ BUCKYSERVER environment variable.`
 		"Worker threads.")
 }
 
-func statWorker(workIn chan *DeleteWork, workOut chan *MetricData, wg *sync.WaitGroup) {
+func statWorker(workIn chan *BatchWork, workOut chan *MetricData, wg *sync.WaitGroup) {
 	for work := range workIn {
-		stat, err := StatRemoteMetric(work.server, work.name)
+		err := BatchStat(work.server, work.names, func(stat *MetricData) {
+			workOut <- stat
+		})
 		if err != nil {
 			workerErrors = true
-		} else {
-			workOut <- stat
 		}
 	}
 	wg.Done()
@@ -62,10 +63,10 @@ func statResults(workOut chan *MetricData, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
-func statMetrics(metricMap map[string][]string) error {
+func statMetrics(requests []metricListRequest) error {
 	wg := new(sync.WaitGroup)
 	wg2 := new(sync.WaitGroup)
-	workIn := make(chan *DeleteWork, 25)
+	workIn := make(chan *BatchWork, metricWorkers)
 	workOut := make(chan *MetricData, 25)
 
 	wg.Add(metricWorkers)
@@ -77,21 +78,13 @@ func statMetrics(metricMap map[string][]string) error {
 	go statResults(workOut, wg2)
 
 	c := 0
-	l := countMap(metricMap)
-	for server, metrics := range metricMap {
-		if len(metrics) == 0 {
-			continue
-		}
-		for _, m := range metrics {
-			work := new(DeleteWork)
-			work.server = server
-			work.name = m
-			workIn <- work
-			c++
-			if c%100 == 0 {
-				log.Printf("Progress: %d/%d %.2f%%", c, l, float64(c)/float64(l)*100)
-			}
-		}
+	err := streamBatches(requests, func(work *BatchWork) {
+		workIn <- work
+		c = c + len(work.names)
+		log.Printf("Progress: %d metrics", c)
+	})
+	if err != nil {
+		workerErrors = true
 	}
 
 	close(workIn)
@@ -109,21 +102,16 @@ func statMetrics(metricMap map[string][]string) error {
 }
 
 func StatRegexMetrics(servers []string, regex string, force bool) error {
-	metricMap, err := ListRegexMetrics(servers, regex, force)
-	if err != nil {
-		return err
-	}
-
-	return statMetrics(metricMap)
+	return statMetrics(regexMetricsRequests(servers, regex, force))
 }
 
 func StatSliceMetrics(servers []string, metrics []string, force bool) error {
-	metricMap, err := ListSliceMetrics(servers, metrics, force)
+	requests, err := sliceMetricsRequests(servers, metrics, force)
 	if err != nil {
 		return err
 	}
 
-	return statMetrics(metricMap)
+	return statMetrics(requests)
 }
 
 func StatJSONMetrics(servers []string, fd io.Reader, force bool) error {
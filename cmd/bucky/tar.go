@@ -2,28 +2,41 @@ package main
 
 import (
 	"archive/tar"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"sort"
 	"sync"
 	"time"
 )
 
 import "github.com/golang/crypto/ssh/terminal"
+import "github.com/golang/snappy"
+import "github.com/klauspost/compress/zstd"
 import "github.com/jjneely/buckytools/metrics"
 
 var metricWorkers int
 var workerErrors bool
 
+// tarGlobMode treats the first argument as a Graphite glob.
+var tarGlobMode bool
+
+// tarCompress is the compression asked of the buckyd daemons for the
+// archive streams.
+var tarCompress string
+
 type MetricWork struct {
 	Name   string
 	Server string
 }
 
+// tarEntry is one file of the tar archive.
+type tarEntry struct {
+	header *tar.Header
+	data   []byte
+}
+
 func init() {
 	usage := "[options] <metric expression>"
 	short := "Build a tarball of given metrics."
@@ -36,11 +49,22 @@ from STDIN as our list of metrics.
 Use -r to enable regular expression mode.  The first argument is a regular
 expression.  If metrics names match they will be included in the output.
 
-Use -s to only delete metrics found on the server specified by -h or the
+Use -g to enable glob mode.  The first argument is a Graphite style glob
+such as 'servers.web*.cpu.{user,system}'.
+
+Use -s to only archive metrics found on the server specified by -h or the
 BUCKYSERVER environment variable.
 
-Set -w to change the number of worker threads used to download the Whisper
-DBs from the remote servers.
+Each buckyd daemon streams a tar archive of its matching metrics, compressed
+as given by -z, and the streams are combined into one archive.  Metrics found
+on more than one server are archived once.  Daemons that do not support
+streaming archives are asked for one metric at a time and -w sets the
+number of worker threads used to download their Whisper DBs.
+
+The --older-than, --newer-than, --min-size and --max-size flags further
+restrict the metrics by their modification time and size as last seen by
+the remote daemons.  With one of these flags the metric expression may be
+left out to select from all metrics.
 
 The tar archive is written to STDOUT and will not be written to a
 terminal.`
@@ -50,54 +74,69 @@ terminal.`
 	SetupHostname(c)
 	SetupSingle(c)
 	SetupJSON(c)
+	SetupStatFilters(c)
+	SetupTransfer(c)
 
 	c.Flag.BoolVar(&listForce, "f", false,
 		"Force metric re-inventory.")
 	c.Flag.BoolVar(&listRegexMode, "r", false,
 		"Filter by a regular expression.")
+	c.Flag.BoolVar(&tarGlobMode, "g", false,
+		"Filter by a Graphite glob.")
+	c.Flag.StringVar(&tarCompress, "z", "snappy",
+		"Compression of the archive streams: snappy, zstd or identity.")
 	c.Flag.IntVar(&metricWorkers, "w", 5,
 		"Downloader threads.")
 	c.Flag.IntVar(&metricWorkers, "workers", 5,
 		"Downloader threads.")
 }
 
-func writeTar(workOut chan *metrics.MetricData, wg *sync.WaitGroup) {
+// writeTar writes the entries to a tar archive on STDOUT skipping any
+// metric already written.
+func writeTar(workOut chan *tarEntry, wg *sync.WaitGroup) {
 	tw := tar.NewWriter(os.Stdout)
+	seen := make(map[string]bool)
+	c := 0
+	t := time.Now().Unix()
 	for work := range workOut {
+		if seen[work.header.Name] {
+			log.Printf("Skipping duplicate %s", work.header.Name)
+			continue
+		}
+		seen[work.header.Name] = true
 		if Verbose {
-			log.Printf("Writing %s...", work.Name)
+			log.Printf("Writing %s...", work.header.Name)
 		}
-		th := new(tar.Header)
-		th.Name = metrics.MetricToRelative(work.Name)
-		th.Size = work.Size
-		th.Mode = work.Mode
-		th.ModTime = time.Unix(work.ModTime, 0)
 
-		data, err := MetricDecode(work)
-		if err != nil {
-			log.Printf("Skipping %s due to error: %s", work.Name, err)
-			continue
-		}
-		err = tw.WriteHeader(th)
+		err := tw.WriteHeader(work.header)
 		if err != nil {
 			log.Fatalf("Error writing tar: %s", err)
 		}
-		_, err = tw.Write(data)
+		_, err = tw.Write(work.data)
 		if err != nil {
 			log.Fatalf("Error writing data to tar file: %s", err)
 		}
+
+		c++
+		if c%100 == 0 {
+			s := time.Now().Unix() - t
+			if s == 0 {
+				s = 1
+			}
+			log.Printf("Progress %d  wsp/s: %.2f", c, float64(c)/float64(s))
+		}
 	}
 
 	err := tw.Close()
 	if err != nil {
 		log.Fatalf("Error closing tar archive: %s", err)
 	}
+	log.Printf("Archived %d metrics.", c)
 
 	wg.Done()
 }
 
-func getMetricWorker(workIn chan *MetricWork, workOut chan *metrics.MetricData, wg *sync.WaitGroup) {
-	var data []byte
+func getMetricWorker(workIn chan *MetricWork, workOut chan *tarEntry, wg *sync.WaitGroup) {
 	for w := range workIn {
 		metric, err := GetMetricData(w.Server, w.Name)
 		if err != nil {
@@ -107,75 +146,136 @@ func getMetricWorker(workIn chan *MetricWork, workOut chan *metrics.MetricData,
 
 		// Decompress the metric here so that we store uncompressed data
 		// in the tar file which can then be better compressed.
-		data, err = MetricDecode(metric)
-		if err == nil {
-			metric.Data = data
-			metric.Encoding = metrics.EncIdentity
-			workOut <- metric
-		} else {
+		data, err := MetricDecode(metric)
+		if err != nil {
 			workerErrors = true
+			continue
 		}
+		th := new(tar.Header)
+		th.Name = metrics.MetricToRelative(metric.Name)
+		th.Size = int64(len(data))
+		th.Mode = metric.Mode
+		th.ModTime = time.Unix(metric.ModTime, 0)
+		workOut <- &tarEntry{th, data}
 	}
 
 	wg.Done()
 }
 
-func multiplexTar(metricMap map[string][]string) error {
-	wgTar := new(sync.WaitGroup)
-	wgWork := new(sync.WaitGroup)
+// fetchEachMetric archives the metrics selected by the list request one
+// metric at a time for daemons without the /archive API.
+func fetchEachMetric(r metricListRequest, workOut chan *tarEntry) error {
+	metricMap, err := getMetricCache(r.url, r.body)
+	if err != nil {
+		return err
+	}
+
+	wg := new(sync.WaitGroup)
 	workIn := make(chan *MetricWork, 25)
-	workOut := make(chan *metrics.MetricData, 25)
-
-	// Sort our work queue for sanity and balancing across the cluster
-	servers := make(map[string]string)
-	sorted := make([]string, 0)
-	for server, metrics := range metricMap {
-		for _, m := range metrics {
-			servers[m] = server
-			sorted = append(sorted, m)
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go getMetricWorker(workIn, workOut, wg)
+	}
+	for _, m := range metricMap[r.url.Host] {
+		workIn <- &MetricWork{m, r.url.Host}
+	}
+	close(workIn)
+	wg.Wait()
+	return nil
+}
+
+// fetchArchive streams the tar archive of the metrics selected by the
+// list request from its buckyd daemon and sends each file to workOut.
+func fetchArchive(r metricListRequest, workOut chan *tarEntry) error {
+	u := r.url
+	u.Path = "/archive"
+	query := u.Query()
+	query.Set("compress", tarCompress)
+	u.RawQuery = query.Encode()
+
+	resp, err := HTTPFetch(u, r.body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		log.Printf("%s does not support archives, fetching each metric", u.Host)
+		return fetchEachMetric(r, workOut)
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("Error: Archive from %s returned %s: %s", u.Host,
+			resp.Status, string(msg))
+		return fmt.Errorf("Archive returned %s", resp.Status)
+	}
+
+	// Each daemon streams a single archive so only the rate applies
+	var body io.Reader = throttleReader(resp.Body)
+	switch resp.Header.Get("Content-Encoding") {
+	case "snappy":
+		body = snappy.NewReader(body)
+	case "zstd":
+		dec, err := zstd.NewReader(body)
+		if err != nil {
+			log.Printf("Error decompressing archive from %s: %s", u.Host, err)
+			return err
 		}
+		defer dec.Close()
+		body = dec
 	}
-	sort.Strings(sorted)
-	log.Printf("Total metrics selected for tar: %d", len(sorted))
 
-	// Start writers and workers
-	wgTar.Add(1)
-	go writeTar(workOut, wgTar)
+	count := 0
+	tr := tar.NewReader(body)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("Error reading archive from %s: %s", u.Host, err)
+			return err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			log.Printf("Error reading %s from %s: %s", th.Name, u.Host, err)
+			return err
+		}
+		workOut <- &tarEntry{th, data}
+		count++
+	}
 
-	wgWork.Add(metricWorkers)
-	for i := 0; i < metricWorkers; i++ {
-		go getMetricWorker(workIn, workOut, wgWork)
+	// Trailers are only available once the body is consumed
+	io.Copy(ioutil.Discard, resp.Body)
+	if msg := resp.Trailer.Get("X-Archive-Error"); msg != "" {
+		log.Printf("Error: Archive from %s is incomplete: %s", u.Host, msg)
+		return fmt.Errorf("Archive incomplete: %s", msg)
 	}
+	log.Printf("%s archived %d metrics", u.Host, count)
+	return nil
+}
 
-	// Feed work in
-	c := 0
-	l := len(sorted)
-	t := time.Now().Unix()
-	for _, m := range sorted {
-		work := new(MetricWork)
-		work.Name = m
-		work.Server = servers[m]
-		workIn <- work
-		c++
-		if c%10 == 0 {
-			now := time.Now().Unix()
-			s := now - t
-			if s == 0 {
-				s = 1
+// multiplexTar fetches the archive for each list request in parallel
+// and combines them into one tar archive on STDOUT.
+func multiplexTar(requests []metricListRequest) error {
+	wgTar := new(sync.WaitGroup)
+	wgWork := new(sync.WaitGroup)
+	workOut := make(chan *tarEntry, 25)
+
+	wgTar.Add(1)
+	go writeTar(workOut, wgTar)
+
+	wgWork.Add(len(requests))
+	for _, r := range requests {
+		go func(r metricListRequest) {
+			defer wgWork.Done()
+			if err := fetchArchive(r, workOut); err != nil {
+				workerErrors = true
 			}
-			rate := float64(c) / float64(s)
-			log.Printf("Progress %d / %d: %.2f%%  wsp/s: %.2f  ETA: %s",
-				c, l,
-				100*float64(c)/float64(l),
-				rate,
-				time.Until(time.Unix(int64(float64(l-c)/rate), 0)).String(),
-			)
-		}
+		}(r)
 	}
-	close(workIn)
 	wgWork.Wait()
 
-	// All workers are complete, close workOut
+	// All servers are complete, close workOut
 	close(workOut)
 	wgTar.Wait() // Wait for tar writer to complete
 
@@ -186,38 +286,16 @@ func multiplexTar(metricMap map[string][]string) error {
 	return nil
 }
 
-func TarRegexMetrics(servers []string, regex string, force bool) error {
-	metricMap, err := ListRegexMetrics(servers, regex, listForce)
-	if err != nil {
-		return err
-	}
-
-	return multiplexTar(metricMap)
-}
-
-func TarSliceMetrics(servers []string, metrics []string, force bool) error {
-	metricMap, err := ListSliceMetrics(servers, metrics, listForce)
-	if err != nil {
-		return err
-	}
-
-	return multiplexTar(metricMap)
-}
-
-func TarJSONMetrics(servers []string, fd io.Reader, force bool) error {
-	// Read the JSON from the file-like object
-	blob, err := ioutil.ReadAll(fd)
-	metrics := make([]string, 0)
-
-	err = json.Unmarshal(blob, &metrics)
-	// We could just package this up and query the server, but lets check the
-	// JSON is valid first.
-	if err != nil {
-		log.Printf("Error unmarshalling JSON data: %s", err)
-		return err
+// globMetricsRequests builds the requests for the metrics matching the
+// Graphite glob on each of the host:port strings in servers.
+func globMetricsRequests(servers []string, glob string, force bool) []metricListRequest {
+	requests := allMetricsRequests(servers, force)
+	for i := range requests {
+		query := requests[i].url.Query()
+		query.Set("glob", glob)
+		requests[i].url.RawQuery = query.Encode()
 	}
-
-	return TarSliceMetrics(servers, metrics, force)
+	return requests
 }
 
 // tarCommand runs this subcommand.
@@ -228,9 +306,19 @@ func tarCommand(c Command) int {
 		return 1
 	}
 
-	if c.Flag.NArg() == 0 {
+	if err = StartTransfers(); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if c.Flag.NArg() == 0 && !statFiltersSet() {
 		log.Fatal("At least one argument is required.")
 	}
+	switch tarCompress {
+	case "snappy", "zstd", "identity":
+	default:
+		log.Fatalf("Unknown compression: %s", tarCompress)
+	}
 
 	if terminal.IsTerminal(int(os.Stdout.Fd())) {
 		log.Fatal("Refusing to write tar file to terminal.")
@@ -240,14 +328,17 @@ func tarCommand(c Command) int {
 		log.Printf("Warning: Cluster is not optimal.")
 	}
 
-	if listRegexMode && c.Flag.NArg() > 0 {
-		err = TarRegexMetrics(Cluster.HostPorts(), c.Flag.Arg(0), listForce)
-	} else if c.Flag.Arg(0) != "-" {
-		err = TarSliceMetrics(Cluster.HostPorts(), c.Flag.Args(), listForce)
+	var requests []metricListRequest
+	if tarGlobMode && c.Flag.NArg() > 0 {
+		requests = globMetricsRequests(Cluster.HostPorts(), c.Flag.Arg(0), listForce)
 	} else {
-		err = TarJSONMetrics(Cluster.HostPorts(), os.Stdin, listForce)
+		requests, err = listRequests(c)
+		if err != nil {
+			return 1
+		}
 	}
 
+	err = multiplexTar(requests)
 	if err != nil {
 		return 1
 	}
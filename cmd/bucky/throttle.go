@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// sourceLimit and destLimit cap the transfers running at once from and to
+// each server.  0 is unlimited.
+var sourceLimit int
+var destLimit int
+
+// transferRate is the bytes per second of all transfers and rateFile a
+// file it is read from again while running.
+var transferRate string
+var rateFile string
+
+// rateCheckInterval is how often rateFile is checked for changes.
+var rateCheckInterval = 2 * time.Second
+
+// limiter paces the bytes of all transfers.  Use getLimiter().
+var limiter *rateLimiter
+var limiterErr error
+var limiterOnce sync.Once
+
+// sourceSlots and destSlots hold the transfers running from and to each
+// server.
+var sourceSlots = newHostSlots()
+var destSlots = newHostSlots()
+
+// SetupTransfer installs the flags that throttle the transfers of
+// metrics in the given Command.
+func SetupTransfer(c Command) {
+	c.Flag.IntVar(&sourceLimit, "max-per-source", 0,
+		"Transfers at once from each server.  0 is unlimited.")
+	c.Flag.IntVar(&destLimit, "max-per-dest", 0,
+		"Transfers at once to each server.  0 is unlimited.")
+	c.Flag.StringVar(&transferRate, "rate", "",
+		"Bytes per second of all transfers, such as 20M.  Unlimited by default.")
+	c.Flag.StringVar(&rateFile, "rate-file", "",
+		"File holding the -rate, read again when it changes or on SIGHUP.")
+}
+
+// hostSlots limits the transfers running at once for each server.
+type hostSlots struct {
+	lock  sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostSlots() *hostSlots {
+	return &hostSlots{slots: make(map[string]chan struct{})}
+}
+
+// acquire waits for one of the limit slots of the host and returns the
+// function that frees it.  A limit of 0 does not wait.
+func (h *hostSlots) acquire(host string, limit int) func() {
+	if limit <= 0 {
+		return func() {}
+	}
+	h.lock.Lock()
+	slots, ok := h.slots[host]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		h.slots[host] = slots
+	}
+	h.lock.Unlock()
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+// rateLimiter paces a flow of bytes to a rate in bytes per second.
+type rateLimiter struct {
+	lock    sync.Mutex
+	rate    int64
+	next    time.Time     // when the bytes reserved so far are paid off
+	changed chan struct{} // closed when the rate changes
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{changed: make(chan struct{})}
+}
+
+// Rate returns the rate in bytes per second.  0 is unlimited.
+func (l *rateLimiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// SetRate changes the rate.  A rate of 0 is unlimited.
+func (l *rateLimiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	if rate == l.rate {
+		return
+	}
+	l.rate = rate
+	l.next = time.Now()
+	close(l.changed)
+	l.changed = make(chan struct{})
+	if rate > 0 {
+		log.Printf("Transfers limited to %.2f MiB/s", float64(rate)/float64(1024*1024))
+	} else {
+		log.Printf("Transfers unlimited.")
+	}
+}
+
+// Wait blocks until the bytes reserved before are paid off at the rate and
+// then reserves n more bytes.  A change of rate while waiting reserves the
+// bytes again at the new rate.
+func (l *rateLimiter) Wait(n int64) {
+	for {
+		l.lock.Lock()
+		if l.rate <= 0 {
+			l.lock.Unlock()
+			return
+		}
+		now := time.Now()
+		if l.next.Before(now) {
+			l.next = now
+		}
+		delay := l.next.Sub(now)
+		l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+		changed := l.changed
+		l.lock.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			return
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
+// StartTransfers sets the rate of the limiter of all transfers from
+// -rate, or -rate-file if it exists, and starts watching -rate-file.
+// Commands that transfer metrics call it first so an invalid rate is
+// reported before any transfer starts.
+func StartTransfers() error {
+	limiterOnce.Do(func() {
+		limiter = newRateLimiter()
+		if transferRate != "" {
+			rate, err := ParseSize(transferRate)
+			if err != nil {
+				limiterErr = fmt.Errorf("Invalid -rate: %s", err)
+				return
+			}
+			limiter.SetRate(rate)
+		}
+		if rateFile != "" {
+			var modTime time.Time
+			if fi, err := os.Stat(rateFile); err == nil {
+				modTime = fi.ModTime()
+				if limiterErr = readRateFile(limiter, rateFile); limiterErr != nil {
+					return
+				}
+			}
+			go watchRateFile(limiter, rateFile, modTime)
+		}
+	})
+	return limiterErr
+}
+
+// getLimiter returns the limiter of all transfers, starting it if the
+// command has not.
+func getLimiter() *rateLimiter {
+	if err := StartTransfers(); err != nil {
+		log.Fatal(err)
+	}
+	return limiter
+}
+
+// readRateFile sets the rate of the limiter to the size in the file at
+// path.  An empty file is unlimited.
+func readRateFile(l *rateLimiter, path string) error {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading rate file: %s", err)
+	}
+	s := strings.TrimSpace(string(blob))
+	if s == "" {
+		s = "0"
+	}
+	rate, err := ParseSize(s)
+	if err != nil {
+		return fmt.Errorf("Error in rate file %s: %s", path, err)
+	}
+	l.SetRate(rate)
+	return nil
+}
+
+// watchRateFile reads the rate file at path again when its modification
+// time changes or on SIGHUP.
+func watchRateFile(l *rateLimiter, path string, modTime time.Time) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	tick := time.NewTicker(rateCheckInterval)
+	for {
+		select {
+		case <-hup:
+		case <-tick.C:
+			fi, err := os.Stat(path)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+		}
+		if err := readRateFile(l, path); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// throttledReader paces the reads of r to the rate of the limiter.
+type throttledReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the flow smooth
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := t.r.Read(p)
+	t.l.Wait(int64(n))
+	return n, err
+}
+
+// throttleReader returns a reader of r paced to the transfer rate.
+func throttleReader(r io.Reader) io.Reader {
+	return &throttledReader{r, getLimiter()}
+}
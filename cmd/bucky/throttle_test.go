@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStartTransfers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucky_rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { transferRate, rateFile = "", "" }()
+
+	tests := []struct {
+		rate string
+		file string // contents of -rate-file, "-" for none
+		want int64
+		ok   bool
+	}{
+		{"", "-", 0, true},
+		{"20M", "-", 20 * 1024 * 1024, true},
+		{"20M", "1K\n", 1024, true},
+		{"20M", "", 0, true},
+		{"", "junk", 0, false},
+		{"fast", "-", 0, false},
+		{"-1", "-", 0, false},
+	}
+	for i, test := range tests {
+		transferRate, rateFile = test.rate, ""
+		if test.file != "-" {
+			rateFile = filepath.Join(dir, "rate")
+			if err := ioutil.WriteFile(rateFile, []byte(test.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		limiterOnce, limiterErr = sync.Once{}, nil
+		err := StartTransfers()
+		if (err == nil) != test.ok {
+			t.Errorf("%d: -rate %q and rate file %q returned %v", i, test.rate, test.file, err)
+			continue
+		}
+		if test.ok && limiter.Rate() != test.want {
+			t.Errorf("%d: -rate %q and rate file %q set rate %d", i, test.rate,
+				test.file, limiter.Rate())
+		}
+	}
+	limiterOnce, limiterErr = sync.Once{}, nil
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		rate  int64
+		sizes []int64
+		min   time.Duration
+		max   time.Duration
+	}{
+		{0, []int64{1 << 30, 1 << 30}, 0, 50 * time.Millisecond},
+		{1000, []int64{100}, 0, 50 * time.Millisecond},
+		{1000, []int64{100, 100, 100}, 200 * time.Millisecond, 300 * time.Millisecond},
+		{10000, []int64{1000, 1000, 1000}, 200 * time.Millisecond, 300 * time.Millisecond},
+	}
+	for _, test := range tests {
+		l := newRateLimiter()
+		l.SetRate(test.rate)
+		start := time.Now()
+		for _, n := range test.sizes {
+			l.Wait(n)
+		}
+		if d := time.Since(start); d < test.min || d > test.max {
+			t.Errorf("Waiting for %v at %d bytes/s took %s", test.sizes, test.rate, d)
+		}
+	}
+
+	// Lifting the limit releases a waiting transfer
+	l := newRateLimiter()
+	l.SetRate(10)
+	l.Wait(100)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.SetRate(0)
+	}()
+	start := time.Now()
+	l.Wait(100)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Wait after the rate was lifted took %s", d)
+	}
+}
+
+func TestHostSlots(t *testing.T) {
+	tests := []struct {
+		limit   int
+		hosts   []string
+		blocked bool // whether the last acquire waits
+	}{
+		{0, []string{"a", "a", "a"}, false},
+		{1, []string{"a", "b"}, false},
+		{1, []string{"a", "a"}, true},
+		{2, []string{"a", "a"}, false},
+		{2, []string{"a", "b", "a", "a"}, true},
+	}
+	for _, test := range tests {
+		h := newHostSlots()
+		var releases []func()
+		last := len(test.hosts) - 1
+		for _, host := range test.hosts[:last] {
+			releases = append(releases, h.acquire(host, test.limit))
+		}
+		acquired := make(chan func())
+		go func() { acquired <- h.acquire(test.hosts[last], test.limit) }()
+
+		select {
+		case release := <-acquired:
+			if test.blocked {
+				t.Errorf("Limit %d acquired %v", test.limit, test.hosts)
+			}
+			release()
+		case <-time.After(50 * time.Millisecond):
+			if !test.blocked {
+				t.Errorf("Limit %d blocked acquiring %v", test.limit, test.hosts)
+			}
+			// Freeing a slot of the host lets it through
+			for i, host := range test.hosts[:last] {
+				if host == test.hosts[last] {
+					releases[i]()
+					releases[i] = func() {}
+					break
+				}
+			}
+			(<-acquired)()
+		}
+		for _, release := range releases {
+			release()
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// useTLS connects to the buckyd daemons with HTTPS.
+var useTLS bool
+
+// tlsCA is a PEM CA bundle to verify the buckyd daemons with rather than
+// the system roots.
+var tlsCA string
+
+// tlsCert and tlsKey are a PEM client certificate and key to present to
+// the buckyd daemons.
+var tlsCert, tlsKey string
+
+// SetupTLS installs the --tls, --tls-ca, --tls-cert and --tls-key flags in
+// the given Command.  These default to the BUCKYTLS, BUCKYTLSCA,
+// BUCKYTLSCERT and BUCKYTLSKEY environment variables.
+func SetupTLS(c Command) {
+	c.Flag.BoolVar(&useTLS, "tls", os.Getenv("BUCKYTLS") != "",
+		"Use HTTPS to talk to the buckyd daemons.")
+	c.Flag.StringVar(&tlsCA, "tls-ca", os.Getenv("BUCKYTLSCA"),
+		"PEM CA bundle to verify the buckyd daemons.  Implies -tls.")
+	c.Flag.StringVar(&tlsCert, "tls-cert", os.Getenv("BUCKYTLSCERT"),
+		"PEM client certificate for the buckyd daemons.  Implies -tls.")
+	c.Flag.StringVar(&tlsKey, "tls-key", os.Getenv("BUCKYTLSKEY"),
+		"PEM private key for -tls-cert.")
+}
+
+// URLScheme returns the URL scheme used to reach the buckyd daemons.
+func URLScheme() string {
+	if useTLS || tlsCA != "" || tlsCert != "" {
+		return "https"
+	}
+	return "http"
+}
+
+// clientTLSConfig builds the TLS configuration for the HTTP client from
+// the TLS flags.  nil is returned if the defaults will do.
+func clientTLSConfig() (*tls.Config, error) {
+	if tlsCA == "" && tlsCert == "" {
+		return nil, nil
+	}
+	config := new(tls.Config)
+
+	if tlsCA != "" {
+		pem, err := ioutil.ReadFile(tlsCA)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA bundle: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", tlsCA)
+		}
+	}
+	if tlsCert != "" {
+		key := tlsKey
+		if key == "" {
+			// Allow the key to be bundled with the certificate
+			key = tlsCert
+		}
+		cert, err := tls.LoadX509KeyPair(tlsCert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
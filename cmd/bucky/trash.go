@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// trashDate limits the trash operations to metrics deleted on this day.
+var trashDate string
+
+// trashForce allows restores to replace existing metrics.
+var trashForce bool
+
+func init() {
+	usage := "[options] list|restore|purge [regex]"
+	short := "Manage metrics deleted into the buckyd trash."
+	long := `List, restore or permanently remove deleted metrics across the cluster.
+
+When buckyd runs with -trash deleted metrics are moved into a trash
+directory named for the day they were deleted, in the store they were
+deleted from, and are kept for the daemon's -trash-retention.
+
+The first argument is the action:
+
+    list     Print the server, deletion date, size and name of each metric
+             in the trash.
+    restore  Move the most recent deleted copy of each metric back into
+             place.  Existing metrics are only replaced with -force.
+    purge    Permanently remove the deleted copies of each metric.
+
+The optional regex argument limits the metrics acted on.  Use -date to
+only consider metrics deleted on the given YYYY-MM-DD day.  Unless
+-noconfirm is given restore and purge ask for confirmation on each server.
+
+Use -s to only work with the server specified by -h or the BUCKYSERVER
+environment variable.`
+
+	c := NewCommand(trashCommand, "trash", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+	SetupJSON(c)
+
+	c.Flag.StringVar(&trashDate, "date", "",
+		"Only metrics deleted on this YYYY-MM-DD day.")
+	c.Flag.BoolVar(&trashForce, "force", false,
+		"Restore over existing metrics.")
+	c.Flag.BoolVar(&deleteForce, "noconfirm", false,
+		"No confirmation.")
+}
+
+// trashURL returns the URL of the trash API on server for the metric,
+// which may be empty for the whole trash.
+func trashURL(server, metric string, query url.Values) (*url.URL, error) {
+	var err error
+	u := &url.URL{
+		Scheme:   URLScheme(),
+		Path:     "/trash",
+		RawQuery: query.Encode(),
+	}
+	if metric != "" {
+		u.Path = "/trash/" + metric
+	}
+	u.Host, err = SanitizeHostPort(server)
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetTrash returns the trash entries on server matching regex and date,
+// if not empty.
+func GetTrash(server, regex, date string) ([]TrashEntry, error) {
+	query := url.Values{}
+	if regex != "" {
+		query.Set("regex", regex)
+	}
+	if date != "" {
+		query.Set("date", date)
+	}
+	u, err := trashURL(server, "", query)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := GetHTTP().Get(u.String())
+	if err != nil {
+		log.Printf("Error communicating with %s: %s", server, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading trash from %s: %s", server, err)
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		log.Printf("Error listing trash on %s: %s: %s", server, resp.Status, body)
+		return nil, fmt.Errorf("Error listing trash on %s: %s", server, resp.Status)
+	}
+
+	entries := make([]TrashEntry, 0)
+	err = json.Unmarshal(body, &entries)
+	if err != nil {
+		log.Printf("Error unmarshalling trash from %s: %s", server, err)
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListTrash queries the trash of each of the given servers in parallel.
+func ListTrash(servers []string, regex, date string) (map[string][]TrashEntry, error) {
+	trashMap := make(map[string][]TrashEntry)
+	lock := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	var failed bool
+
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			entries, err := GetTrash(server, regex, date)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				failed = true
+				return
+			}
+			trashMap[server] = entries
+		}(server)
+	}
+	wg.Wait()
+
+	if failed {
+		return trashMap, fmt.Errorf("Errors occured listing the trash.")
+	}
+	return trashMap, nil
+}
+
+// TrashMetric restores the metric from the trash on server with a POST
+// or purges it with a DELETE.
+func TrashMetric(server, method, metric, date string) error {
+	query := url.Values{}
+	if date != "" {
+		query.Set("date", date)
+	}
+	if method == "POST" && trashForce {
+		query.Set("force", "true")
+	}
+	u, err := trashURL(server, metric, query)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		log.Printf("Error building request: %s", err)
+		return err
+	}
+	resp, err := GetHTTP().Do(r)
+	if err != nil {
+		log.Printf("Error communicating: %s", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		if method == "POST" {
+			log.Printf("RESTORED: %s on %s", metric, server)
+		} else {
+			log.Printf("PURGED: %s on %s", metric, server)
+		}
+	case 404:
+		log.Printf("Not found in trash: %s on %s", metric, server)
+		return fmt.Errorf("Metric not found in trash.")
+	case 409:
+		log.Printf("Not restored, metric exists: %s on %s", metric, server)
+		return fmt.Errorf("Metric exists.")
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("Error: %s: %s", resp.Status, string(msg))
+		return fmt.Errorf("Unknown response from server.  Code %s", resp.Status)
+	}
+	return nil
+}
+
+// printTrash writes the trash entries of each server to STDOUT.
+func printTrash(trashMap map[string][]TrashEntry) {
+	if JSONOutput {
+		blob, err := json.Marshal(trashMap)
+		if err != nil {
+			log.Printf("%s", err)
+		} else {
+			os.Stdout.Write(blob)
+			os.Stdout.Write([]byte("\n"))
+		}
+		return
+	}
+
+	servers := make([]string, 0, len(trashMap))
+	for server := range trashMap {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		for _, e := range trashMap[server] {
+			fmt.Printf("%s\t%s\t%.2fKiB\t%s\n", server, e.Date,
+				float64(e.Size)/1024.0, e.Name)
+		}
+	}
+}
+
+// trashMetrics restores or purges, depending on method, the metrics in
+// the trash of each server after confirmation.
+func trashMetrics(trashMap map[string][]TrashEntry, method string) error {
+	action := "Restoring"
+	if method == "DELETE" {
+		action = "Purging"
+	}
+
+	for server, entries := range trashMap {
+		// A restore brings back only the newest copy of each metric
+		// so each metric is sent once.
+		metrics := make([]string, 0, len(entries))
+		for i, e := range entries {
+			if i == 0 || entries[i-1].Name != e.Name {
+				metrics = append(metrics, e.Name)
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+
+		msg := fmt.Sprintf("%s %d metrics on %s: Please Confirm:", action, len(metrics), server)
+		if !deleteForce && !askForConfirmation(msg) {
+			continue
+		}
+		log.Printf("%s %d metrics on %s...", action, len(metrics), server)
+		for _, m := range metrics {
+			if TrashMetric(server, method, m, trashDate) != nil {
+				workerErrors = true
+			}
+		}
+	}
+
+	if workerErrors {
+		log.Printf("Errors occured in trash operation.")
+		return fmt.Errorf("Errors occured in trash operations.")
+	}
+	return nil
+}
+
+// trashCommand runs this subcommand.
+func trashCommand(c Command) int {
+	if c.Flag.NArg() == 0 {
+		log.Fatal("An action of list, restore or purge is required.")
+	}
+	action := c.Flag.Arg(0)
+	// Allow flags after the action
+	c.Flag.Parse(c.Flag.Args()[1:])
+	if c.Flag.NArg() > 1 {
+		log.Fatal("Only one regular expression may be given.")
+	}
+
+	var method string
+	switch action {
+	case "list":
+	case "restore":
+		method = "POST"
+	case "purge":
+		method = "DELETE"
+	default:
+		log.Fatalf("Unknown trash action: %s", action)
+	}
+
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	trashMap, err := ListTrash(Cluster.HostPorts(), c.Flag.Arg(0), trashDate)
+	if err != nil {
+		return 1
+	}
+	if method == "" {
+		printTrash(trashMap)
+		return 0
+	}
+
+	err = trashMetrics(trashMap, method)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// verifySample is the number of metrics to check.  0 checks them all.
+var verifySample int
+
+// verifySince and verifyLag bound the time span of the points compared.
+var verifySince string
+var verifyLag string
+
+// verifyHeal fills the copies of divergent metrics from each other.
+var verifyHeal bool
+
+// VerifyResult is a metric whose replicas differ.  Digests holds the
+// digest of each copy by HOST:PORT and Missing the replica servers
+// without a copy.
+type VerifyResult struct {
+	Metric  string
+	Digests map[string]*MetricDigest
+	Missing []string `json:",omitempty"`
+}
+
+// verifyMetric is a metric with the replica servers that should hold it
+// and those that do.
+type verifyMetric struct {
+	name string
+	want []string
+	have []string
+}
+
+func init() {
+	usage := "[options] [metric expression]"
+	short := "Compare the datapoints of each replica of metrics."
+	long := `Check that every copy of a metric on its replica servers holds the
+same datapoints and report those that diverge.
+
+Each buckyd daemon holding a copy digests its datapoints so only the
+digests cross the network.  Copies differ when any archive holds a
+different set of points.  Replica servers without a copy are reported as
+missing.  Copies on servers outside the hash ring's replicas are left to
+bucky inconsistent and rebalance.
+
+All metrics in the cluster are checked unless a list of metrics, a "-" to
+read a JSON array from STDIN, or with -r a regular expression is given.
+Use -sample to check only that many metrics picked at random.
+
+The points of the last -lag, which carbon may not have written to every
+replica yet, are not compared.  Use -since to only compare the points
+written since then.
+
+Use --heal to merge the copies of each divergent metric.  Every copy is
+filled into one replica, which then fills the others.  Filling adds the
+points missing from a copy, so copies holding different values for the
+same point may still differ afterwards and are reported again.
+
+Use -j to print the divergent metrics with their digests as JSON.`
+
+	c := NewCommand(verifyCommand, "verify", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupJSON(c)
+	SetupBatch(c)
+	SetupTransfer(c)
+
+	c.Flag.BoolVar(&listRegexMode, "r", false,
+		"Filter by a regular expression.")
+	c.Flag.BoolVar(&listForce, "f", false,
+		"Force the remote daemons to rebuild their cache.")
+	c.Flag.IntVar(&metricWorkers, "w", 5,
+		"Batches checked or healed at once.")
+	c.Flag.IntVar(&verifySample, "sample", 0,
+		"Check this many metrics picked at random.  0 checks all.")
+	c.Flag.StringVar(&verifySince, "since", "",
+		"Only compare points newer than this age, such as 7d.")
+	c.Flag.StringVar(&verifyLag, "lag", "10m",
+		"Do not compare points newer than this age.")
+	c.Flag.BoolVar(&verifyHeal, "heal", false,
+		"Fill the copies of divergent metrics from each other.")
+}
+
+// verifySpan returns the time span of the points to compare.
+func verifySpan() (int64, int64, error) {
+	now := time.Now().Unix()
+	lag, err := ParseAge(verifyLag)
+	if err != nil {
+		return 0, 0, err
+	}
+	var from int64
+	if verifySince != "" {
+		since, err := ParseAge(verifySince)
+		if err != nil {
+			return 0, 0, err
+		}
+		from = now - since
+	}
+	if from >= now-lag {
+		return 0, 0, fmt.Errorf("-since must be older than -lag.")
+	}
+	return from, now - lag, nil
+}
+
+// verifyMetrics lists the metrics and returns those that have a copy on
+// one of their replica servers, or a random sample of them.  Only the
+// returned metrics are held in memory as the listings stream by.
+func verifyMetrics(requests []metricListRequest, target *TargetRing) ([]*verifyMetric, error) {
+	rand.Seed(time.Now().UnixNano())
+	list := make([]*verifyMetric, 0)
+	seen := 0
+	err := streamLocations(requests, func(m string, have []string) {
+		want, _, _, healthy := replicaSets(m, have, target)
+		if len(healthy) == 0 {
+			return
+		}
+		seen++
+		if verifySample <= 0 || len(list) < verifySample {
+			list = append(list, &verifyMetric{m, want, healthy})
+		} else if i := rand.Intn(seen); i < verifySample {
+			// Each metric seen so far is kept with equal chance
+			list[i] = &verifyMetric{m, want, healthy}
+		}
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list, err
+}
+
+// DigestMetrics digests the copy of each metric on each of the servers
+// that have it and returns the digests by metric and server.  Copies that
+// were removed in the meantime are left out.
+func DigestMetrics(list []*verifyMetric, from, until int64) (map[string]map[string]*MetricDigest, error) {
+	metricMap := make(map[string][]string)
+	for _, m := range list {
+		for _, server := range m.have {
+			metricMap[server] = append(metricMap[server], m.name)
+		}
+	}
+
+	var failed error
+	digests := make(map[string]map[string]*MetricDigest)
+	lock := new(sync.Mutex)
+	workIn := make(chan *BatchWork, metricWorkers)
+	wg := new(sync.WaitGroup)
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for work := range workIn {
+				err := BatchDigest(work.server, work.names, from, until, func(result *BatchResult) {
+					lock.Lock()
+					defer lock.Unlock()
+					switch {
+					case result.Status == 200 && result.Digest != nil:
+						if digests[result.Name] == nil {
+							digests[result.Name] = make(map[string]*MetricDigest)
+						}
+						digests[result.Name][work.server] = result.Digest
+					case result.Status != 404:
+						log.Printf("Error: Digest of [%s] %s failed: %s", work.server,
+							result.Name, result.Error)
+						failed = fmt.Errorf("Digest failed: %s", result.Error)
+					}
+				})
+				if err != nil {
+					lock.Lock()
+					failed = err
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	c := 0
+	l := countMap(metricMap)
+	for _, work := range batches(metricMap) {
+		workIn <- work
+		c = c + len(work.names)
+		if Verbose {
+			log.Printf("Progress: %d/%d %.2f%%", c, l, float64(c)/float64(l)*100)
+		}
+	}
+	close(workIn)
+	wg.Wait()
+	return digests, failed
+}
+
+// divergentMetrics compares the digests of the copies of each metric and
+// returns the metrics whose copies differ or miss a replica.
+func divergentMetrics(list []*verifyMetric, digests map[string]map[string]*MetricDigest) []*VerifyResult {
+	results := make([]*VerifyResult, 0)
+	for _, m := range list {
+		copies := digests[m.name]
+		if len(copies) == 0 {
+			// Removed since the metrics were listed
+			continue
+		}
+		result := &VerifyResult{Metric: m.name, Digests: copies}
+		for _, server := range m.want {
+			if copies[server] == nil {
+				result.Missing = append(result.Missing, server)
+			}
+		}
+		diverged := len(result.Missing) > 0
+		var first *MetricDigest
+		for _, d := range copies {
+			if first == nil {
+				first = d
+			} else if !first.Equal(d) {
+				diverged = true
+			}
+		}
+		if diverged {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// digestPoints returns the number of points in each archive of a digest.
+func digestPoints(d *MetricDigest) string {
+	points := make([]string, len(d.Archives))
+	for i, a := range d.Archives {
+		points[i] = fmt.Sprintf("%d", a.Points)
+	}
+	return strings.Join(points, "/")
+}
+
+// printVerify writes each copy of the divergent metrics to STDOUT.
+func printVerify(results []*VerifyResult) {
+	if JSONOutput {
+		blob, err := json.Marshal(results)
+		if err != nil {
+			log.Printf("%s", err)
+			return
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+		return
+	}
+	for _, r := range results {
+		servers := make([]string, 0, len(r.Digests))
+		for server := range r.Digests {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+		for _, server := range servers {
+			fmt.Printf("%s: %s (%s points)\n", server, r.Metric,
+				digestPoints(r.Digests[server]))
+		}
+		for _, server := range r.Missing {
+			fmt.Printf("%s: %s (missing)\n", server, r.Metric)
+		}
+	}
+}
+
+// runFills fills each move's destination from its source.
+func runFills(moves []*MigrateWork) {
+	workIn := make(chan *PushWork, metricWorkers)
+	wg := new(sync.WaitGroup)
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go pushWorker(workIn, func(*MigrateWork) {}, wg)
+	}
+	for _, work := range pushBatches(moves) {
+		workIn <- work
+	}
+	close(workIn)
+	wg.Wait()
+}
+
+// healMoves returns the fills that merge the copies of each divergent
+// metric.  The gather fills fill each copy into the copy with the most
+// points, the hub, and the spread fills then fill the other replica
+// servers, including those missing the metric, from the hub.
+func healMoves(results []*VerifyResult) (gather, spread []*MigrateWork) {
+	gather = make([]*MigrateWork, 0)
+	spread = make([]*MigrateWork, 0)
+	for _, r := range results {
+		hub, most := "", -1
+		servers := make([]string, 0, len(r.Digests))
+		for server, d := range r.Digests {
+			servers = append(servers, server)
+			points := 0
+			for _, a := range d.Archives {
+				points += a.Points
+			}
+			if points > most || (points == most && server < hub) {
+				hub, most = server, points
+			}
+		}
+		sort.Strings(servers)
+		for _, server := range append(servers, r.Missing...) {
+			if server == hub {
+				continue
+			}
+			if r.Digests[server] != nil {
+				gather = append(gather, &MigrateWork{
+					oldName:     r.Metric,
+					newName:     r.Metric,
+					oldLocation: server,
+					newLocation: hub,
+					fill:        true,
+				})
+			}
+			spread = append(spread, &MigrateWork{
+				oldName:     r.Metric,
+				newName:     r.Metric,
+				oldLocation: hub,
+				newLocation: server,
+				fill:        true,
+			})
+		}
+	}
+	return gather, spread
+}
+
+// HealMetrics merges the copies of each divergent metric.  Each copy is
+// filled into the copy with the most points, which then fills the other
+// replica servers including those missing the metric.
+func HealMetrics(results []*VerifyResult) {
+	gather, spread := healMoves(results)
+	log.Printf("Healing %d metrics: %d fills into and %d fills out of the fullest copy.",
+		len(results), len(gather), len(spread))
+	runFills(gather)
+	runFills(spread)
+}
+
+// verifyCommand runs this subcommand.
+func verifyCommand(c Command) int {
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if err = StartTransfers(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	if !Cluster.Healthy {
+		log.Printf("Warning: Cluster is not healthy!")
+	}
+	from, until, err := verifySpan()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	requests, err := listRequests(c)
+	if err != nil {
+		return 1
+	}
+	metrics, err := verifyMetrics(requests, Cluster.Ring())
+	if err != nil {
+		log.Printf("Error retrieving metric lists: %s", err)
+		return 1
+	}
+	log.Printf("Verifying %d metrics.", len(metrics))
+
+	digests, err := DigestMetrics(metrics, from, until)
+	if err != nil {
+		workerErrors = true
+	}
+	results := divergentMetrics(metrics, digests)
+	log.Printf("%d of %d metrics have divergent replicas.", len(results), len(metrics))
+
+	if verifyHeal && len(results) > 0 {
+		HealMetrics(results)
+		byName := make(map[string]*verifyMetric)
+		for _, m := range metrics {
+			byName[m.name] = m
+		}
+		healed := make([]*verifyMetric, 0, len(results))
+		for _, r := range results {
+			// Every replica server should now have a copy
+			m := byName[r.Metric]
+			healed = append(healed, &verifyMetric{m.name, m.want, m.want})
+		}
+		digests, err = DigestMetrics(healed, from, until)
+		if err != nil {
+			workerErrors = true
+		}
+		results = divergentMetrics(healed, digests)
+		log.Printf("%d metrics still have divergent replicas after healing.", len(results))
+	}
+
+	printVerify(results)
+	if workerErrors || len(results) > 0 {
+		return 1
+	}
+	return 0
+}
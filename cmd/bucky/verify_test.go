@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// testDigest returns a digest with an archive of each number of points
+// that sum to sum.
+func testDigest(sum string, points ...int) *MetricDigest {
+	d := new(MetricDigest)
+	for _, n := range points {
+		d.Archives = append(d.Archives, ArchiveDigest{Step: 60, Points: n, Sum: sum})
+	}
+	return d
+}
+
+func TestVerifySpan(t *testing.T) {
+	defer func() { verifySince, verifyLag = "", "10m" }()
+	tests := []struct {
+		since string
+		lag   string
+		from  int64 // seconds before now, 0 for the epoch
+		until int64 // seconds before now
+		ok    bool
+	}{
+		{"", "10m", 0, 600, true},
+		{"7d", "10m", 7 * 86400, 600, true},
+		{"1h", "0", 3600, 0, true},
+		{"10m", "10m", 0, 0, false},
+		{"5m", "10m", 0, 0, false},
+		{"week", "10m", 0, 0, false},
+		{"", "soon", 0, 0, false},
+	}
+	for _, test := range tests {
+		verifySince, verifyLag = test.since, test.lag
+		now := time.Now().Unix()
+		from, until, err := verifySpan()
+		if (err == nil) != test.ok {
+			t.Errorf("-since %q -lag %q returned %v", test.since, test.lag, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		wantFrom := int64(0)
+		if test.from != 0 {
+			wantFrom = now - test.from
+		}
+		// Allow for the clock ticking over during the call
+		if from-wantFrom > 1 || from < wantFrom || until-(now-test.until) > 1 || until < now-test.until {
+			t.Errorf("-since %q -lag %q spans %d to %d rather than %d to %d", test.since,
+				test.lag, from, until, wantFrom, now-test.until)
+		}
+	}
+}
+
+func TestDivergentMetrics(t *testing.T) {
+	same, other := testDigest("x", 10, 2), testDigest("y", 10, 2)
+	tests := []struct {
+		name    string
+		want    []string
+		copies  map[string]*MetricDigest
+		missing []string
+		diverge bool
+	}{
+		{"equal", []string{"a", "b"}, map[string]*MetricDigest{"a": same, "b": testDigest("x", 10, 2)}, nil, false},
+		{"differ", []string{"a", "b"}, map[string]*MetricDigest{"a": same, "b": other}, nil, true},
+		{"missing", []string{"a", "b"}, map[string]*MetricDigest{"a": same}, []string{"b"}, true},
+		{"single", []string{"a"}, map[string]*MetricDigest{"a": same}, nil, false},
+		{"removed", []string{"a", "b"}, map[string]*MetricDigest{}, nil, false},
+		{"archives", []string{"a", "b"}, map[string]*MetricDigest{"a": same, "b": testDigest("x", 10)}, nil, true},
+	}
+
+	list := make([]*verifyMetric, 0)
+	digests := make(map[string]map[string]*MetricDigest)
+	diverged := make(map[string]bool)
+	for _, test := range tests {
+		have := make([]string, 0)
+		for server := range test.copies {
+			have = append(have, server)
+		}
+		list = append(list, &verifyMetric{test.name, test.want, have})
+		digests[test.name] = test.copies
+		diverged[test.name] = test.diverge
+	}
+
+	results := divergentMetrics(list, digests)
+	found := make(map[string]*VerifyResult)
+	for _, r := range results {
+		found[r.Metric] = r
+	}
+	for _, test := range tests {
+		r := found[test.name]
+		if (r != nil) != test.diverge {
+			t.Errorf("%s: Reported as divergent: %t", test.name, r != nil)
+			continue
+		}
+		if r != nil && !reflect.DeepEqual(r.Missing, test.missing) {
+			t.Errorf("%s: Missing from %v rather than %v", test.name, r.Missing, test.missing)
+		}
+	}
+}
+
+func TestHealMoves(t *testing.T) {
+	tests := []struct {
+		result *VerifyResult
+		gather []string // fills as SRC>DST
+		spread []string
+	}{
+		{
+			// The copy with the most points is the hub
+			&VerifyResult{Metric: "m", Digests: map[string]*MetricDigest{
+				"a": testDigest("x", 5, 1),
+				"b": testDigest("y", 10, 2),
+				"c": testDigest("z", 3),
+			}},
+			[]string{"a>b", "c>b"},
+			[]string{"b>a", "b>c"},
+		},
+		{
+			// Ties go to the first server by name
+			&VerifyResult{Metric: "m", Digests: map[string]*MetricDigest{
+				"b": testDigest("x", 5),
+				"a": testDigest("y", 5),
+			}},
+			[]string{"b>a"},
+			[]string{"a>b"},
+		},
+		{
+			// Missing replicas are only filled from the hub
+			&VerifyResult{Metric: "m", Digests: map[string]*MetricDigest{
+				"a": testDigest("x", 5),
+			}, Missing: []string{"b", "c"}},
+			[]string{},
+			[]string{"a>b", "a>c"},
+		},
+	}
+	fills := func(moves []*MigrateWork) []string {
+		ret := make([]string, 0)
+		for _, m := range moves {
+			if !m.fill || m.oldName != "m" || m.newName != "m" {
+				t.Errorf("Heal moves %+v rather than filling", *m)
+			}
+			ret = append(ret, m.oldLocation+">"+m.newLocation)
+		}
+		sort.Strings(ret)
+		return ret
+	}
+	for i, test := range tests {
+		gather, spread := healMoves([]*VerifyResult{test.result})
+		if g := fills(gather); !reflect.DeepEqual(g, test.gather) {
+			t.Errorf("%d: Gathered %v rather than %v", i, g, test.gather)
+		}
+		if s := fills(spread); !reflect.DeepEqual(s, test.spread) {
+			t.Errorf("%d: Spread %v rather than %v", i, s, test.spread)
+		}
+	}
+}
+
+func TestVerifyMetricsSample(t *testing.T) {
+	var onA, onB []string
+	for i := 0; i < 100; i++ {
+		onA = append(onA, fmt.Sprintf("sample.metric%03d", i))
+	}
+	onB = []string{"sample.other"}
+	requests, hosts, cleanup := fakeLists(t, onA, onB)
+	defer cleanup()
+
+	// Only the first daemon is a replica server
+	u, _ := url.Parse("http://" + hosts[0])
+	defer func(c *ClusterConfig) { Cluster = c }(Cluster)
+	Cluster = &ClusterConfig{Port: u.Port()}
+	target := testRing(t, 1, u.Hostname())
+	defer func() { verifySample = 0 }()
+
+	for _, sample := range []int{0, 10, 100, 200} {
+		verifySample = sample
+		list, err := verifyMetrics(requests, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sample
+		if sample == 0 || sample > len(onA) {
+			want = len(onA)
+		}
+		if len(list) != want {
+			t.Errorf("Sample of %d returned %d metrics", sample, len(list))
+		}
+		seen := make(map[string]bool)
+		for i, m := range list {
+			if !strings.HasPrefix(m.name, "sample.metric") || seen[m.name] {
+				t.Errorf("Sample of %d returned %s", sample, m.name)
+			}
+			if i > 0 && list[i-1].name > m.name {
+				t.Errorf("Sample of %d is not sorted", sample)
+			}
+			if !reflect.DeepEqual(m.have, hosts[:1]) || !reflect.DeepEqual(m.want, hosts[:1]) {
+				t.Errorf("%s is on %v and wanted on %v", m.name, m.have, m.want)
+			}
+			seen[m.name] = true
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+import "github.com/golang/snappy"
+import "github.com/klauspost/compress/zstd"
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// archiveEncoding returns the compression the client asked for with the
+// compress parameter or the Accept-Encoding header, or "" for none.
+func archiveEncoding(r *http.Request) (string, error) {
+	switch r.FormValue("compress") {
+	case "snappy", "zstd":
+		return r.FormValue("compress"), nil
+	case "", "identity":
+	default:
+		return "", fmt.Errorf("Unknown compression: %s", r.FormValue("compress"))
+	}
+
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(strings.SplitN(enc, ";", 2)[0])
+		if enc == "snappy" || enc == "zstd" {
+			return enc, nil
+		}
+	}
+	return "", nil
+}
+
+// archiveWriter wraps w with the compressor for the encoding.  Closing
+// it flushes the compressor without closing w.
+func archiveWriter(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "snappy":
+		return snappy.NewBufferedWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nopCloser{w}, nil
+}
+
+// nopCloser is an io.WriteCloser whose Close does nothing.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// writeArchiveMetric writes the metric to the tar archive.  The file is
+// locked while it is read so the archive holds a consistent copy.
+// Metrics removed since the cache was built are skipped.
+func writeArchiveMetric(tw *tar.Writer, metric string) error {
+	path := findMetric(metric)
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Printf("Error opening %s for archive: %s", path, err)
+		return err
+	}
+	defer fd.Close()
+	if err = flock(fd); err != nil {
+		log.Printf("Error locking %s: %s", path, err)
+		return err
+	}
+	s, err := fd.Stat()
+	if err != nil {
+		log.Printf("Error stat'ing %s: %s", path, err)
+		return err
+	}
+
+	th := &tar.Header{
+		Name:    MetricToRelative(metric),
+		Size:    s.Size(),
+		Mode:    int64(s.Mode().Perm()),
+		ModTime: s.ModTime(),
+	}
+	if err = tw.WriteHeader(th); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, fd, th.Size)
+	return err
+}
+
+// serveArchive streams a tar archive of the local metrics selected by the
+// same parameters as /metrics, optionally compressed with snappy or zstd.
+// As errors can only be reported once the archive has started they are
+// sent in the X-Archive-Error trailer.
+func serveArchive(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > listMaxBytes {
+		msg := fmt.Sprintf("Query larger than %d bytes", listMaxBytes)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, listMaxBytes)
+
+	if r.FormValue("force") != "" {
+		metricsCache.Force()
+	}
+	idx, ok := metricsCache.GetIndex()
+	if !ok {
+		http.Error(w, "Cache update in progress.", http.StatusAccepted)
+		return
+	}
+	filter, err := parseMetricFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	encoding, err := archiveEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Trailer", "X-Archive-Error")
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	cw, err := archiveWriter(w, encoding)
+	if err != nil {
+		log.Printf("Error starting %s compression: %s", encoding, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tw := tar.NewWriter(cw)
+	err = filter.Each(idx, func(m string) error {
+		return writeArchiveMetric(tw, m)
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		log.Printf("Error writing archive: %s", err)
+		w.Header().Set("X-Archive-Error", err.Error())
+	}
+}
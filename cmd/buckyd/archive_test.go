@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+import "github.com/golang/snappy"
+import "github.com/klauspost/compress/zstd"
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestServeArchive(t *testing.T) {
+	_, cleanup := setupTestServer(t, 12)
+	defer cleanup()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/archive", serveArchive)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	archive := func(query, accept string) map[string][]byte {
+		r, _ := http.NewRequest("GET", server.URL+"/archive"+query, nil)
+		if accept != "" {
+			r.Header.Set("Accept-Encoding", accept)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /archive%s returned %s", query, resp.Status)
+		}
+
+		var body io.Reader = resp.Body
+		switch resp.Header.Get("Content-Encoding") {
+		case "snappy":
+			body = snappy.NewReader(resp.Body)
+		case "zstd":
+			dec, err := zstd.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dec.Close()
+			body = dec
+		}
+
+		files := make(map[string][]byte)
+		tr := tar.NewReader(body)
+		for {
+			th, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			files[th.Name], err = ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msg := resp.Trailer.Get("X-Archive-Error"); msg != "" {
+			t.Errorf("Archive error: %s", msg)
+		}
+		return files
+	}
+
+	expected, err := ioutil.ReadFile(metrics.MetricToPath("test.metric1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		query, accept, encoding string
+		count                   int
+	}{
+		{"?regex=metric1", "", "", 3},
+		{"?glob=test.metric1*&compress=zstd", "", "zstd", 3},
+		{"?list=%5B%22test.metric1%22%5D", "gzip, snappy", "snappy", 1},
+	} {
+		files := archive(test.query, test.accept)
+		if len(files) != test.count {
+			t.Errorf("%s: expected %d files, got %d", test.query, test.count, len(files))
+		}
+		data, ok := files[metrics.MetricToRelative("test.metric1")]
+		if !ok || string(data) != string(expected) {
+			t.Errorf("%s: test.metric1 missing or corrupt", test.query)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/archive?compress=lzma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unknown compression returned %s", resp.Status)
+	}
+
+	os.Remove(metrics.MetricToPath("test.metric10"))
+	if files := archive("?glob=test.metric1?", ""); len(files) != 1 {
+		t.Errorf("Expected removed metrics to be skipped, got %d files", len(files))
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// auditFile is the path of the audit log.  Empty disables auditing.
+var auditFile string
+
+// auditLog is the open audit log that entries are appended to.
+var auditLog *os.File
+
+// auditLock serializes writes to the audit log.
+var auditLock sync.Mutex
+
+// auditKey is the context key of the *AuditEntry of a request.
+type auditKey struct{}
+
+// auditRecorder captures the status and any error message of a response.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	msg    []byte
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	if a.status >= 400 && len(a.msg) < 256 {
+		a.msg = append(a.msg, b...)
+	}
+	return a.ResponseWriter.Write(b)
+}
+
+// openAuditLog opens the audit log for appending.
+func openAuditLog(path string) error {
+	var err error
+	auditLog, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return err
+}
+
+// writeAudit appends the entry to the audit log as a line of JSON.
+func writeAudit(entry *AuditEntry) {
+	blob, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding audit entry: %s", err)
+		return
+	}
+	blob = append(blob, '\n')
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if _, err := auditLog.Write(blob); err != nil {
+		log.Printf("Error writing audit log: %s", err)
+	}
+}
+
+// auditUser records the authenticated user of the request in its audit
+// entry, if it has one.
+func auditUser(r *http.Request, user string) {
+	if entry, ok := r.Context().Value(auditKey{}).(*AuditEntry); ok {
+		entry.User = user
+	}
+}
+
+// auditedMetric returns the metric a request modifies and true if the
+// request is to be audited.  Cache refreshes and batch requests are
+// audited with an empty metric.
+func auditedMetric(r *http.Request) (string, bool) {
+	for _, prefix := range []string{"/metrics/", "/trash/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return r.URL.Path[len(prefix):], needsWrite(r)
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/batch/") {
+		return "", needsWrite(r)
+	}
+	return "", r.URL.Path == "/metrics" || r.URL.Path == "/archive"
+}
+
+// auditItem writes an entry for one metric changed by a batch request.
+func auditItem(r *http.Request, metric string, before, after int64, status int, msg string) {
+	request, ok := r.Context().Value(auditKey{}).(*AuditEntry)
+	if !ok {
+		return
+	}
+	entry := *request
+	entry.Time = time.Now().Unix()
+	entry.Metric = metric
+	entry.SizeBefore = before
+	entry.SizeAfter = after
+	entry.Status = status
+	entry.Error = msg
+	writeAudit(&entry)
+}
+
+// metricSize returns the size of the metric on disk or -1 if it does not
+// exist.
+func metricSize(metric string) int64 {
+	if metric == "" {
+		return -1
+	}
+	s, err := os.Stat(findMetric(metric))
+	if err != nil {
+		return -1
+	}
+	return s.Size()
+}
+
+// auditHandler wraps the handler so that requests that change metrics or
+// force a cache refresh are written to the audit log.  It must wrap the
+// authHandler so that refused requests are recorded as well.
+func auditHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metric, audit := auditedMetric(r)
+		if auditLog == nil || !audit {
+			h(w, r)
+			return
+		}
+
+		entry := &AuditEntry{
+			Time:       time.Now().Unix(),
+			Client:     r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Metric:     metric,
+			SizeBefore: metricSize(metric),
+		}
+		r = r.WithContext(context.WithValue(r.Context(), auditKey{}, entry))
+		rec := &auditRecorder{ResponseWriter: w}
+		h(rec, r)
+
+		// Form is only parsed if the request got as far as the handler
+		entry.Force = r.Form.Get("force") != "" || r.URL.Query().Get("force") != ""
+		entry.Status = rec.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		if metric == "" && !entry.Force && (entry.Status < 400 || !strings.HasPrefix(r.URL.Path, "/batch/")) {
+			// Batch requests that ran audit each metric themselves
+			return
+		}
+		entry.SizeAfter = metricSize(metric)
+		if entry.Status >= 400 {
+			entry.Error = strings.TrimSpace(string(rec.msg))
+		}
+		writeAudit(entry)
+	}
+}
+
+// parseAuditTime parses a Unix timestamp or an age, such as 2h, that is
+// taken as that long before now.
+func parseAuditTime(s string, now time.Time) (int64, error) {
+	if t, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return t, nil
+	}
+	age, err := ParseAge(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time: %s", s)
+	}
+	return now.Unix() - age, nil
+}
+
+// serveAudit streams the audit log entries between the from and until
+// times that match the regex parameter as a JSON array.
+func serveAudit(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != "GET" {
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+	if auditFile == "" {
+		http.Error(w, "Audit log not enabled.", http.StatusNotFound)
+		return
+	}
+
+	var err error
+	now := time.Now()
+	from, until := int64(0), now.Unix()
+	if r.FormValue("from") != "" {
+		from, err = parseAuditTime(r.FormValue("from"), now)
+	}
+	if err == nil && r.FormValue("until") != "" {
+		until, err = parseAuditTime(r.FormValue("until"), now)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var regex *regexp.Regexp
+	if r.FormValue("regex") != "" {
+		regex, err = regexp.Compile(r.FormValue("regex"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	fd, err := os.Open(auditFile)
+	if err != nil {
+		log.Printf("Error reading audit log: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer fd.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	buf := bufio.NewWriter(w)
+	buf.WriteByte('[')
+	first := true
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		entry := new(AuditEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			log.Printf("Skipping corrupt audit log entry: %s", err)
+			continue
+		}
+		if entry.Time < from || entry.Time > until {
+			continue
+		}
+		if regex != nil && !regex.MatchString(entry.Metric) {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		buf.Write(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		// Headers are gone, the client sees a truncated body
+		log.Printf("Error reading audit log: %s", err)
+		return
+	}
+	buf.WriteByte(']')
+	buf.Flush()
+}
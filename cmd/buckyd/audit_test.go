@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/auth"
+import "github.com/jjneely/buckytools/metrics"
+
+func TestAuditLog(t *testing.T) {
+	_, cleanup := setupTestServer(t, 3)
+	defer cleanup()
+
+	auditFile = filepath.Join(tmpDir, "audit.log")
+	if err := openAuditLog(auditFile); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		auditLog.Close()
+		auditLog, auditFile = nil, ""
+	}()
+	credentials = auth.Credentials{
+		"reader": &auth.Credential{Name: "reader", Secret: "r"},
+		"admin":  &auth.Credential{Name: "admin", Secret: "w", Write: true},
+	}
+	defer func() { credentials = nil }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", auditHandler(authHandler(listMetrics)))
+	mux.HandleFunc("/metrics/", auditHandler(authHandler(serveMetrics)))
+	mux.HandleFunc("/batch/", auditHandler(authHandler(serveBatch)))
+	mux.HandleFunc("/audit", authHandler(serveAudit))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	do := func(method, path, token string) *http.Response {
+		r, _ := http.NewRequest(method, server.URL+path, strings.NewReader(`["test.metric2"]`))
+		auth.SetBearer(r, token)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	query := func(q string) []metrics.AuditEntry {
+		resp := do("GET", "/audit"+q, "r")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /audit%s returned %s", q, resp.Status)
+		}
+		entries := make([]metrics.AuditEntry, 0)
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	// Reads are not audited
+	do("GET", "/metrics", "r").Body.Close()
+	do("HEAD", "/metrics/test.metric0", "r").Body.Close()
+	if entries := query(""); len(entries) != 0 {
+		t.Fatalf("Reads were audited: %v", entries)
+	}
+
+	do("DELETE", "/metrics/test.metric0", "r").Body.Close()
+	do("DELETE", "/metrics/test.metric1", "w").Body.Close()
+	do("DELETE", "/metrics/test.metric9", "w").Body.Close()
+	do("GET", "/metrics?force=true", "r").Body.Close()
+
+	entries := query("")
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 audit entries, got %v", entries)
+	}
+	e := entries[0]
+	if e.User != "reader" || e.Metric != "test.metric0" || e.Status != http.StatusForbidden ||
+		e.Error == "" || e.SizeBefore <= 0 || e.SizeAfter != e.SizeBefore {
+		t.Errorf("Unexpected refused delete entry: %+v", e)
+	}
+	e = entries[1]
+	if e.User != "admin" || e.Method != "DELETE" || e.Status != http.StatusOK ||
+		e.SizeBefore <= 0 || e.SizeAfter != -1 || e.Client == "" {
+		t.Errorf("Unexpected delete entry: %+v", e)
+	}
+	if e = entries[2]; e.Status != http.StatusNotFound || e.SizeBefore != -1 {
+		t.Errorf("Unexpected missing metric entry: %+v", e)
+	}
+	if e = entries[3]; !e.Force || e.Path != "/metrics" || e.Metric != "" {
+		t.Errorf("Unexpected cache refresh entry: %+v", e)
+	}
+
+	if entries := query("?regex=metric1$"); len(entries) != 1 || entries[0].Metric != "test.metric1" {
+		t.Errorf("Regex query returned %v", entries)
+	}
+	if entries := query(fmt.Sprintf("?from=1h&until=%d", time.Now().Unix()-60)); len(entries) != 0 {
+		t.Errorf("Time range query returned %v", entries)
+	}
+	if entries := query("?from=5m"); len(entries) != 4 {
+		t.Errorf("Recent query returned %v", entries)
+	}
+
+	// Batch deletes audit each metric
+	do("POST", "/batch/delete", "r").Body.Close()
+	do("POST", "/batch/delete", "w").Body.Close()
+	entries = query("?from=5m&regex=metric2")
+	if len(entries) != 1 || entries[0].Path != "/batch/delete" || entries[0].User != "admin" ||
+		entries[0].SizeAfter != -1 {
+		t.Errorf("Unexpected batch delete entries: %v", entries)
+	}
+	if entries := query(""); len(entries) != 6 || entries[4].Status != http.StatusForbidden {
+		t.Errorf("Refused batch delete was not audited: %v", entries)
+	}
+
+	if resp := do("GET", "/audit?from=yesterday", "r"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Invalid time returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/auth"
+
+// credentials are the clients allowed to use the API.  When nil
+// authentication is disabled.
+var credentials auth.Credentials
+
+// needsWrite returns true if the request modifies or deletes metrics.
+func needsWrite(r *http.Request) bool {
+	if r.URL.Path == "/batch/delete" || r.URL.Path == "/push" {
+		return true
+	}
+	if strings.HasPrefix(r.URL.Path, "/jobs") {
+		return r.Method == "POST" || r.Method == "DELETE"
+	}
+	if !strings.HasPrefix(r.URL.Path, "/metrics/") &&
+		!strings.HasPrefix(r.URL.Path, "/trash/") {
+		return false
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		return false
+	}
+	return true
+}
+
+// userKey is the context key of the name of the credential a request was
+// made with.
+type userKey struct{}
+
+// requestUser returns the name of the credential the request was made
+// with or "" if authentication is disabled.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// authHandler wraps the handler so that requests must carry valid
+// credentials with the permissions the request needs.
+func authHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if credentials == nil {
+			h(w, r)
+			return
+		}
+
+		cred, err := credentials.Authenticate(r, time.Now())
+		if err != nil {
+			log.Printf("%s - Authentication failed for %s %s: %s",
+				r.RemoteAddr, r.Method, r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", auth.BearerScheme)
+			http.Error(w, "Authentication required.", http.StatusUnauthorized)
+			return
+		}
+		auditUser(r, cred.Name)
+		r = r.WithContext(context.WithValue(r.Context(), userKey{}, cred.Name))
+		if needsWrite(r) && !cred.Write {
+			log.Printf("%s - %s lacks write permission for %s %s",
+				r.RemoteAddr, cred.Name, r.Method, r.URL.Path)
+			http.Error(w, "Write permission required.", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
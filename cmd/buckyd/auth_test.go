@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/auth"
+
+func TestAuthHandler(t *testing.T) {
+	_, cleanup := setupTestServer(t, 2)
+	defer cleanup()
+
+	credentials = auth.Credentials{
+		"reader": &auth.Credential{Name: "reader", Secret: "r"},
+		"admin":  &auth.Credential{Name: "admin", Secret: "w", Write: true},
+	}
+	defer func() { credentials = nil }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", authHandler(listMetrics))
+	mux.HandleFunc("/metrics/", authHandler(serveMetrics))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	do := func(method, path string, sign func(*http.Request)) int {
+		r, _ := http.NewRequest(method, server.URL+path, nil)
+		if sign != nil {
+			sign(r)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { auth.SetBearer(r, token) }
+	}
+	hmac := func(name, secret string) func(*http.Request) {
+		return func(r *http.Request) { auth.Sign(r, name, secret, time.Now()) }
+	}
+
+	tests := []struct {
+		method, path string
+		sign         func(*http.Request)
+		status       int
+	}{
+		{"GET", "/metrics", nil, http.StatusUnauthorized},
+		{"GET", "/metrics", bearer("bad"), http.StatusUnauthorized},
+		{"GET", "/metrics", bearer("r"), http.StatusOK},
+		{"GET", "/metrics?regex=metric", hmac("reader", "r"), http.StatusOK},
+		{"HEAD", "/metrics/test.metric0", hmac("reader", "r"), http.StatusOK},
+		{"DELETE", "/metrics/test.metric0", nil, http.StatusUnauthorized},
+		{"DELETE", "/metrics/test.metric0", bearer("r"), http.StatusForbidden},
+		{"DELETE", "/metrics/test.metric0", hmac("reader", "r"), http.StatusForbidden},
+		{"DELETE", "/metrics/test.metric0", hmac("admin", "r"), http.StatusUnauthorized},
+		{"DELETE", "/metrics/test.metric0", hmac("admin", "w"), http.StatusOK},
+		{"DELETE", "/metrics/test.metric1", bearer("w"), http.StatusOK},
+	}
+	for _, test := range tests {
+		if status := do(test.method, test.path, test.sign); status != test.status {
+			t.Errorf("%s %s returned %d rather than %d", test.method, test.path,
+				status, test.status)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+// batchOps are the operations of the /batch/ endpoint.  Each returns the
+// result for a single metric.
+var batchOps = map[string]func(r *http.Request, item *BatchItem) *BatchResult{
+	"stat":   batchStat,
+	"exists": batchExists,
+	"delete": batchDelete,
+	"digest": batchDigest,
+}
+
+// serveBatch runs the operation named in the path on each metric listed
+// in the body of a POST and streams back a BatchResult for each as
+// NDJSON.  The list of BatchItems is either NDJSON or a JSON array.
+func serveBatch(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	op, ok := batchOps[strings.TrimPrefix(r.URL.Path, "/batch/")]
+	if !ok {
+		http.Error(w, "Unknown batch operation.", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > listMaxBytes {
+		msg := fmt.Sprintf("Query larger than %d bytes", listMaxBytes)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, listMaxBytes)
+
+	list := make([]*BatchItem, 0)
+	dec := json.NewDecoder(r.Body)
+	var err error
+	if isNDJSON(r.Header.Get("Content-Type")) {
+		for dec.More() {
+			item := new(BatchItem)
+			if err = dec.Decode(item); err != nil {
+				break
+			}
+			list = append(list, item)
+		}
+	} else {
+		err = dec.Decode(&list)
+	}
+	if err != nil {
+		http.Error(w, "Invalid metric list: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", NDJSON)
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	for _, item := range list {
+		if err := enc.Encode(op(r, item)); err != nil {
+			// Headers are gone, the client sees a truncated body
+			log.Printf("Error writing batch results: %s", err)
+			return
+		}
+	}
+	buf.Flush()
+}
+
+// batchError builds the result for a metric that failed with err.
+func batchError(metric string, err error) *BatchResult {
+	if os.IsNotExist(err) {
+		return &BatchResult{Name: metric, Status: http.StatusNotFound,
+			Error: "Metric not found."}
+	}
+	return &BatchResult{Name: metric, Status: http.StatusInternalServerError,
+		Error: err.Error()}
+}
+
+// batchStat stats the metric like a HEAD request.
+func batchStat(r *http.Request, item *BatchItem) *BatchResult {
+	metric := item.Name
+	stat, err := statMetric(metric, findMetric(metric))
+	if err != nil {
+		return batchError(metric, err)
+	}
+	return &BatchResult{Name: metric, Status: http.StatusOK, Stat: stat}
+}
+
+// batchExists checks that the metric exists.
+func batchExists(r *http.Request, item *BatchItem) *BatchResult {
+	metric := item.Name
+	if _, err := os.Stat(findMetric(metric)); err != nil {
+		return batchError(metric, err)
+	}
+	return &BatchResult{Name: metric, Status: http.StatusOK}
+}
+
+// batchDelete deletes the metric like a DELETE request.
+func batchDelete(r *http.Request, item *BatchItem) *BatchResult {
+	metric := item.Name
+	before := metricSize(metric)
+	result := &BatchResult{Name: metric, Status: http.StatusOK}
+	path := findMetric(metric)
+	if err := removeMetric(path); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error deleting metric %s: %s", path, err)
+		}
+		result = batchError(metric, err)
+	}
+	auditItem(r, metric, before, metricSize(metric), result.Status, result.Error)
+	return result
+}
+
+// batchDigest digests the datapoints of each archive of the metric
+// between the from and until query parameters, given in Unix seconds,
+// or the From and Until of the item.  The span defaults to the retention
+// of the metric up to now.  Only points whose whole interval lies within
+// the span are included so the point still being written to is left out.
+func batchDigest(r *http.Request, item *BatchItem) *BatchResult {
+	metric := item.Name
+	from, until, err := digestSpan(r, item)
+	if err != nil {
+		return &BatchResult{Name: metric, Status: http.StatusBadRequest,
+			Error: err.Error()}
+	}
+	digest, err := digestMetric(findMetric(metric), from, until)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error digesting metric %s: %s", metric, err)
+		}
+		return batchError(metric, err)
+	}
+	return &BatchResult{Name: metric, Status: http.StatusOK, Digest: digest}
+}
+
+// digestSpan returns the time span of a digest given by the item or the
+// query of the request.
+func digestSpan(r *http.Request, item *BatchItem) (int64, int64, error) {
+	query := r.URL.Query()
+	from, until := int64(0), time.Now().Unix()
+	var err error
+	if s := query.Get("from"); s != "" {
+		if from, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Invalid from time: %s", s)
+		}
+	}
+	if s := query.Get("until"); s != "" {
+		if until, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Invalid until time: %s", s)
+		}
+	}
+	if item.From != 0 {
+		from = item.From
+	}
+	if item.Until != 0 {
+		until = item.Until
+	}
+	if from > until {
+		return 0, 0, fmt.Errorf("From time is after until time.")
+	}
+	return from, until, nil
+}
+
+// digestMetric reads the points of each archive of the whisper file at
+// path between from and until and returns their digest.  The archives
+// are clipped to their retention as of until, rather than now, so daemons
+// asked at slightly different times digest the same points.
+func digestMetric(path string, from, until int64) (*MetricDigest, error) {
+	wsp, err := whisper.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer wsp.Close()
+
+	digest := &MetricDigest{From: from, Until: until}
+	buf := make([]byte, 16)
+	for i, retention := range wsp.Retentions() {
+		step := int64(retention.SecondsPerPoint())
+		start := until - int64(retention.MaxRetention()) + step
+		if start < from {
+			start = from
+		}
+		archive := ArchiveDigest{Step: retention.SecondsPerPoint()}
+		sum := sha1.New()
+		var series *whisper.TimeSeries
+		if start <= until-step {
+			// FetchArchive leaves out the point at the start of the span
+			series, err = wsp.FetchArchiveAt(i, int(start)-1, int(until-step), int(until))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if series != nil {
+			for _, p := range series.Points() {
+				if math.IsNaN(p.Value) {
+					continue
+				}
+				binary.BigEndian.PutUint64(buf, uint64(p.Time))
+				binary.BigEndian.PutUint64(buf[8:], math.Float64bits(p.Value))
+				sum.Write(buf)
+				if archive.Points == 0 {
+					archive.First = int64(p.Time)
+				}
+				archive.Last = int64(p.Time)
+				archive.Points++
+			}
+		}
+		archive.Sum = hex.EncodeToString(sum.Sum(nil))
+		digest.Archives = append(digest.Archives, archive)
+	}
+	return digest, nil
+}
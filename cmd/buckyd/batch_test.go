@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+func TestServeBatch(t *testing.T) {
+	_, cleanup := setupTestServer(t, 3)
+	defer cleanup()
+
+	batch := func(op, contentType, body string) []metrics.BatchResult {
+		r := httptest.NewRequest("POST", "/batch/"+op, strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		serveBatch(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST /batch/%s returned %d: %s", op, w.Code, w.Body)
+		}
+		results := make([]metrics.BatchResult, 0)
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var result metrics.BatchResult
+			if err := dec.Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, result)
+		}
+		return results
+	}
+
+	results := batch("stat", metrics.NDJSON, "\"test.metric0\"\n\"test.missing\"\n")
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 stat results, got %v", results)
+	}
+	if r := results[0]; r.Status != 200 || r.Stat == nil || r.Stat.Name != "test.metric0" || r.Stat.Size == 0 {
+		t.Errorf("Unexpected stat result: %+v", r)
+	}
+	if r := results[1]; r.Name != "test.missing" || r.Status != 404 || r.Stat != nil {
+		t.Errorf("Unexpected stat result for a missing metric: %+v", r)
+	}
+
+	results = batch("exists", "application/json", `["test.metric1", "test.missing"]`)
+	if len(results) != 2 || results[0].Status != 200 || results[1].Status != 404 {
+		t.Errorf("Unexpected exists results: %v", results)
+	}
+
+	// Leave the default span ending now to include the latest point
+	until := time.Now().Unix() + 60
+	results = batch(fmt.Sprintf("digest?until=%d", until), metrics.NDJSON,
+		"\"test.metric0\"\n\"test.metric1\"\n\"test.missing\"\n")
+	if len(results) != 3 || results[2].Status != 404 {
+		t.Fatalf("Unexpected digest results: %v", results)
+	}
+	d0, d1 := results[0].Digest, results[1].Digest
+	if d0 == nil || d1 == nil || len(d0.Archives) != 1 || d0.Archives[0].Step != 60 {
+		t.Fatalf("Unexpected digests: %+v %+v", d0, d1)
+	}
+	if d0.Archives[0].Points != 1 || d0.Archives[0].First == 0 || d0.Equal(d1) {
+		t.Errorf("Expected digests of 1 different point: %+v %+v", d0, d1)
+	}
+	last := d0.Archives[0].Last
+	results = batch(fmt.Sprintf("digest?from=%d&until=%d", last, last+60), metrics.NDJSON, "\"test.metric0\"\n")
+	if d := results[0].Digest; d == nil || !d.Equal(d0) {
+		t.Errorf("Digest of the interval of the point differs: %+v", d)
+	}
+	results = batch(fmt.Sprintf("digest?until=%d", last+59), metrics.NDJSON, "\"test.metric0\"\n")
+	if d := results[0].Digest; d == nil || d.Archives[0].Points != 0 {
+		t.Errorf("Expected no points before the interval of the first ends: %+v", d)
+	}
+	// The span of an item overrides that of the request
+	body := fmt.Sprintf(`[{"Name": "test.metric0", "From": %d, "Until": %d}, "test.metric1"]`,
+		last, last+60)
+	results = batch(fmt.Sprintf("digest?until=%d", last), "application/json", body)
+	if d := results[0].Digest; len(results) != 2 || d == nil || !d.Equal(d0) {
+		t.Errorf("Digest of the span of the item differs: %+v", results)
+	} else if d := results[1].Digest; d == nil || d.Archives[0].Points != 0 {
+		t.Errorf("Expected no points in the span of the request: %+v", d)
+	}
+	results = batch("digest?from=bogus", metrics.NDJSON, "\"test.metric0\"\n")
+	if results[0].Status != http.StatusBadRequest {
+		t.Errorf("Expected a bad request for an invalid span: %+v", results[0])
+	}
+
+	results = batch("delete", metrics.NDJSON, "\"test.metric1\"\n\"test.metric2\"\n\"test.missing\"\n")
+	if len(results) != 3 || results[0].Status != 200 || results[1].Status != 200 ||
+		results[2].Status != 404 {
+		t.Errorf("Unexpected delete results: %v", results)
+	}
+	for _, m := range []string{"test.metric1", "test.metric2"} {
+		if _, err := os.Stat(metrics.MetricToPath(m)); !os.IsNotExist(err) {
+			t.Errorf("%s was not deleted", m)
+		}
+	}
+
+	for _, test := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/batch/rename", "[]", http.StatusNotFound},
+		{"GET", "/batch/stat", "", http.StatusBadRequest},
+		{"POST", "/batch/stat", "[bogus", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		serveBatch(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%s %s returned %d rather than %d", test.method, test.path,
+				w.Code, test.status)
+		}
+	}
+}
+
+func TestDigestMetricAsOfUntil(t *testing.T) {
+	_, cleanup := setupTestServer(t, 0)
+	defer cleanup()
+	path := metrics.MetricToPath("test.short")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	retentions, _ := whisper.ParseRetentionDefs("1s:10s")
+	wsp, err := whisper.Create(path, retentions, whisper.Sum, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	for i := int64(3); i < 10; i++ {
+		wsp.Update(float64(i), int(now-i))
+	}
+	wsp.Close()
+
+	// The oldest point ages out of the retention between the digests
+	until := now - 3
+	first, err := digestMetric(path, 0, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	second, err := digestMetric(path, 0, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Equal(second) || first.Archives[0].Points != 6 {
+		t.Errorf("Digests as of %d differ: %v and %v", until, first, second)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import "github.com/jjneely/buckytools"
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+// metricFilter selects metrics from the sorted metrics cache for a
+// /metrics request.
+type metricFilter struct {
+	regex  *regexp.Regexp
+	glob   *regexp.Regexp
+	list   map[string]bool
+	prefix string
+
+	// cursor is the last metric the client has seen.  Only metrics
+	// sorting after it are selected.
+	cursor string
+
+	// limit is the maximum number of metrics to return, 0 for no limit
+	limit int
+
+	// Unix time bounds on the modification time of the metric, 0
+	// for no bound.  olderThan is exclusive and newerThan inclusive.
+	olderThan int64
+	newerThan int64
+
+	// Bounds in bytes on the size of the metric, both inclusive, 0
+	// for no bound.
+	minSize int64
+	maxSize int64
+
+	// noDataSince is a Unix time, 0 for no bound.  Metrics modified
+	// before it or holding no valid data point at or after it are
+	// selected.  Recently modified metrics must be opened to check.
+	noDataSince int64
+}
+
+// parseMetricFilter builds a metricFilter from the query parameters of
+// the request and, for NDJSON bodies, the list of metrics in the body.
+func parseMetricFilter(r *http.Request) (*metricFilter, error) {
+	var err error
+	f := new(metricFilter)
+
+	if r.FormValue("regex") != "" {
+		f.regex, err = regexp.Compile(r.FormValue("regex"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.FormValue("glob") != "" {
+		f.glob, err = globToRegexp(r.FormValue("glob"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.FormValue("list") != "" {
+		list, err := unmarshalList(r.FormValue("list"))
+		if err != nil {
+			return nil, err
+		}
+		f.setList(list)
+	} else if r.Method == "POST" && isNDJSON(r.Header.Get("Content-Type")) {
+		list, err := readNDJSONList(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		f.setList(list)
+	}
+	f.prefix = r.FormValue("prefix")
+	f.cursor = r.FormValue("cursor")
+	if r.FormValue("limit") != "" {
+		f.limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || f.limit < 0 {
+			return nil, fmt.Errorf("Invalid limit: %s", r.FormValue("limit"))
+		}
+	}
+
+	now := time.Now().Unix()
+	if v := r.FormValue("older_than"); v != "" {
+		age, err := ParseAge(v)
+		if err != nil {
+			return nil, err
+		}
+		f.olderThan = now - age
+	}
+	if v := r.FormValue("newer_than"); v != "" {
+		age, err := ParseAge(v)
+		if err != nil {
+			return nil, err
+		}
+		f.newerThan = now - age
+	}
+	if v := r.FormValue("no_data_since"); v != "" {
+		age, err := ParseAge(v)
+		if err != nil {
+			return nil, err
+		}
+		f.noDataSince = now - age
+	}
+	if v := r.FormValue("min_size"); v != "" {
+		if f.minSize, err = ParseSize(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := r.FormValue("max_size"); v != "" {
+		if f.maxSize, err = ParseSize(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// setList restricts the filter to the given metrics.
+func (f *metricFilter) setList(list []string) {
+	f.list = make(map[string]bool)
+	for _, m := range list {
+		f.list[HashKey(m)] = true
+	}
+}
+
+// Match returns true if the metric at index i of idx is selected by all
+// of the filters other than the cursor and limit.
+func (f *metricFilter) Match(idx *MetricIndex, i int) bool {
+	metric := idx.Metrics[i]
+	if f.list != nil && !f.list[metric] {
+		return false
+	}
+	if f.prefix != "" && !strings.HasPrefix(metric, f.prefix) {
+		return false
+	}
+	if f.olderThan != 0 && idx.ModTime[i] >= f.olderThan {
+		return false
+	}
+	if f.newerThan != 0 && idx.ModTime[i] < f.newerThan {
+		return false
+	}
+	if f.minSize != 0 && idx.Size[i] < f.minSize {
+		return false
+	}
+	if f.maxSize != 0 && idx.Size[i] > f.maxSize {
+		return false
+	}
+	if f.regex != nil && !f.regex.MatchString(metric) {
+		return false
+	}
+	if f.glob != nil && !f.glob.MatchString(metric) {
+		return false
+	}
+	if f.noDataSince != 0 && idx.ModTime[i] >= f.noDataSince {
+		// Checked last as this reads the whisper file
+		return lastValidDataPoint(metric) < f.noDataSince
+	}
+	return true
+}
+
+// globToRegexp compiles a Graphite style glob into an anchored regular
+// expression.  * and ? match within a single node of the metric name,
+// [...] matches a character class and {a,b} matches either alternative.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	buf := new(strings.Builder)
+	buf.WriteString("^")
+	braces := 0
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			buf.WriteString(`[^.]*`)
+		case '?':
+			buf.WriteString(`[^.]`)
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("Invalid glob: %s", glob)
+			}
+			buf.WriteString(glob[i : i+end+1])
+			i = i + end
+		case '{':
+			braces++
+			buf.WriteString("(?:")
+		case '}':
+			if braces == 0 {
+				return nil, fmt.Errorf("Invalid glob: %s", glob)
+			}
+			braces--
+			buf.WriteString(")")
+		case ',':
+			if braces > 0 {
+				buf.WriteString("|")
+			} else {
+				buf.WriteString(",")
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if braces != 0 {
+		return nil, fmt.Errorf("Invalid glob: %s", glob)
+	}
+	buf.WriteString("$")
+	re, err := regexp.Compile(buf.String())
+	if err != nil {
+		return nil, fmt.Errorf("Invalid glob: %s", glob)
+	}
+	return re, nil
+}
+
+// lastValidDataPoint returns the Unix time of the most recent valid data
+// point in the metric.  Metrics that cannot be read are reported as
+// current so they are never selected as stale.
+func lastValidDataPoint(metric string) int64 {
+	path := findMetric(metric)
+	wsp, err := whisper.Open(path)
+	if err != nil {
+		log.Printf("Error opening %s: %s", path, err)
+		return math.MaxInt64
+	}
+	defer wsp.Close()
+
+	last, err := buckytools.LastValidDataPoint(wsp)
+	if err != nil {
+		log.Printf("Error reading data points in %s: %s", path, err)
+		return math.MaxInt64
+	}
+	return int64(last)
+}
+
+// Each calls fn for each selected metric in the index until the limit
+// is reached or fn returns an error.  Searching starts after the cursor
+// or at the prefix, whichever sorts later.
+func (f *metricFilter) Each(idx *MetricIndex, fn func(string) error) error {
+	metrics := idx.Metrics
+	start := sort.SearchStrings(metrics, f.prefix)
+	if f.cursor >= f.prefix {
+		start = sort.SearchStrings(metrics, f.cursor)
+		if start < len(metrics) && metrics[start] == f.cursor {
+			start++
+		}
+	}
+
+	count := 0
+	for i := start; i < len(metrics); i++ {
+		if f.limit > 0 && count >= f.limit {
+			break
+		}
+		m := metrics[i]
+		if f.prefix != "" && m > f.prefix && !strings.HasPrefix(m, f.prefix) {
+			// Sorted past all metrics with this prefix
+			break
+		}
+		if !f.Match(idx, i) {
+			continue
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+		count++
+	}
+	return nil
+}
+
+// isNDJSON returns true if the given Content-Type or Accept header value
+// names NDJSON.
+func isNDJSON(header string) bool {
+	return strings.Contains(header, NDJSON)
+}
+
+// readNDJSONList decodes a stream of JSON strings, one per line, into a
+// slice of metric names.
+func readNDJSONList(body io.Reader) ([]string, error) {
+	list := make([]string, 0)
+	dec := json.NewDecoder(body)
+	for {
+		var m string
+		err := dec.Decode(&m)
+		if err == io.EOF {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+}
+
+// writeMetricList streams the metrics selected by the filter to the
+// client.  NDJSON writes one JSON string per line, otherwise a single
+// JSON array is written.
+func writeMetricList(w http.ResponseWriter, idx *MetricIndex, f *metricFilter, ndjson bool) {
+	buf := bufio.NewWriter(w)
+	first := true
+	write := func(m string) error {
+		blob, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if !ndjson && !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		buf.Write(blob)
+		if ndjson {
+			buf.WriteByte('\n')
+		}
+		return nil
+	}
+
+	if ndjson {
+		w.Header().Set("Content-Type", NDJSON)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		buf.WriteByte('[')
+	}
+	err := f.Each(idx, write)
+	if err != nil {
+		// Headers are gone, the client sees a truncated body
+		log.Printf("Error writing metric list: %s", err)
+		return
+	}
+	if !ndjson {
+		buf.WriteByte(']')
+	}
+	if err := buf.Flush(); err != nil {
+		log.Printf("Error writing metric list: %s", err)
+	}
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 )
 
+import "github.com/jjneely/buckytools/hashing"
+
+import . "github.com/jjneely/buckytools/metrics"
+
 // listHashring encodes the hashing members in JSON and sends them to the
 // client.
 func listHashring(w http.ResponseWriter, r *http.Request) {
@@ -24,3 +30,82 @@ func listHashring(w http.ResponseWriter, r *http.Request) {
 		w.Write(blob)
 	}
 }
+
+// localInstances returns the instances of this node in the hash ring in
+// ring order.
+func localInstances() []string {
+	instances := make([]string, 0)
+	for _, n := range hashring.Nodes {
+		if n.Server == hashring.Name {
+			instances = append(instances, n.Instance)
+		}
+	}
+	return instances
+}
+
+// ownerInstance returns the hash ring instance on this node that owns the
+// given metric.  The bool is false if the metric belongs to other nodes.
+func ownerInstance(metric string) (string, bool) {
+	for _, node := range hashing.ReplicaNodes(ring, HashKey(metric), hashring.Replicas) {
+		if node.Server == hashring.Name {
+			return node.Instance, true
+		}
+	}
+	return "", false
+}
+
+// metricRoot returns the whisper store root the given metric should be
+// written to.  This is the store of the local instance that owns the
+// metric.  Metrics owned by other nodes go to the store of this node's
+// first instance.
+func metricRoot(metric string) string {
+	instance, ok := ownerInstance(metric)
+	if !ok {
+		instances := localInstances()
+		if len(instances) == 0 {
+			return Roots()[0]
+		}
+		instance = instances[0]
+	}
+	root, _ := InstanceRoot(instance)
+	return root
+}
+
+// metricPath returns the file system path the given metric should be
+// written to.
+func metricPath(metric string) string {
+	return MetricToRootPath(metricRoot(metric), metric)
+}
+
+// findMetric returns the file system path where the given metric is
+// stored.  The store of the owning instance is checked first and then
+// the others.  If the metric doesn't exist the path it would be written
+// to is returned.
+func findMetric(metric string) string {
+	path := metricPath(metric)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	for _, root := range Roots() {
+		p := MetricToRootPath(root, metric)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return path
+}
+
+// checkInstanceRoots verifies that every instance of this node in the
+// hash ring has a whisper store when --instance-prefix is in use.
+func checkInstanceRoots() error {
+	if len(InstancePrefixes) == 0 {
+		return nil
+	}
+	for _, instance := range localInstances() {
+		if _, ok := InstanceRoot(instance); !ok {
+			return fmt.Errorf("No -instance-prefix given for instance %s:%s",
+				hashring.Name, instance)
+		}
+	}
+	return nil
+}
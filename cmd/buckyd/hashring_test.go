@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+import . "github.com/jjneely/buckytools/metrics"
+
+func TestOwnerInstanceReplicas(t *testing.T) {
+	saved, savedRing := hashring, ring
+	defer func() { hashring, ring = saved, savedRing }()
+
+	hashring = &hashing.JSONRingType{Name: "test", Algo: "carbon", Replicas: 2}
+	for _, server := range []string{"test", "other", "third"} {
+		hashring.Nodes = append(hashring.Nodes,
+			hashing.NewNode(server, 0, "a"), hashing.NewNode(server, 0, "b"))
+	}
+	var err error
+	ring, err = hashring.HashRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := 0
+	for i := 0; i < 1000; i++ {
+		m := fmt.Sprintf("replica.metric%d", i)
+		nodes := ring.GetNodes(HashKey(m))
+		if nodes[0].Server == nodes[1].Server {
+			shared++
+		}
+
+		replicas := hashing.ReplicaNodes(ring, HashKey(m), hashring.Replicas)
+		if len(replicas) != 2 || replicas[0].Server == replicas[1].Server {
+			t.Fatalf("Replicas of %s are not on 2 servers: %v", m, replicas)
+		}
+		want := ""
+		for _, n := range replicas {
+			if n.Server == "test" {
+				want = n.Instance
+			}
+		}
+		if instance, ok := ownerInstance(m); instance != want || ok != (want != "") {
+			t.Errorf("ownerInstance(%s) = %q, %v rather than %q", m, instance, ok, want)
+		}
+	}
+	if shared == 0 {
+		t.Errorf("No metric had its first two nodes on the same server")
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// collector is an instrument that can write its samples in the Prometheus
+// text format and the Graphite plaintext protocol.
+type collector interface {
+	writeProm(w io.Writer)
+	writeGraphite(w io.Writer, prefix string, now int64)
+}
+
+// registry holds every instrument in the order it was created.
+var registry []collector
+
+// latencyBuckets are the histogram bounds, in seconds, of request and
+// fill durations.  Heals of large DBs can take a while.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// lockBuckets are the histogram bounds, in seconds, of flock waits.
+var lockBuckets = []float64{.0001, .001, .01, .1, 1, 10}
+
+var (
+	httpRequests = newCounter("buckyd_http_requests_total",
+		"HTTP requests served.", "handler", "method", "status")
+	httpDuration = newHistogram("buckyd_http_request_duration_seconds",
+		"Time taken to serve HTTP requests.", latencyBuckets, "handler", "method")
+	httpBytes = newCounter("buckyd_http_bytes_total",
+		"Bytes of HTTP request and response bodies.", "direction", "encoding")
+	fillOps = newCounter("buckyd_fill_operations_total",
+		"Whisper DB backfills.", "result")
+	fillDuration = newHistogram("buckyd_fill_duration_seconds",
+		"Time taken to backfill Whisper DBs.", latencyBuckets)
+	flockWait = newHistogram("buckyd_flock_wait_seconds",
+		"Time spent waiting for Whisper DB locks.", lockBuckets)
+)
+
+func init() {
+	newGauge("buckyd_cache_metrics",
+		"Metrics in the metric cache.", func() float64 {
+			if idx := cacheSnapshot(); idx != nil {
+				return float64(len(idx.Metrics))
+			}
+			return math.NaN()
+		})
+	newGauge("buckyd_cache_refresh_duration_seconds",
+		"Time taken by the last metric cache refresh.", func() float64 {
+			if idx := cacheSnapshot(); idx != nil {
+				return idx.Duration.Seconds()
+			}
+			return math.NaN()
+		})
+	newGauge("buckyd_cache_timestamp_seconds",
+		"Unix time the metric cache was last refreshed.", func() float64 {
+			if idx := cacheSnapshot(); idx != nil {
+				return float64(idx.Timestamp)
+			}
+			return math.NaN()
+		})
+}
+
+// cacheSnapshot returns the last metric cache scan or nil if there is
+// none yet.
+func cacheSnapshot() *MetricIndex {
+	if metricsCache == nil {
+		return nil
+	}
+	return metricsCache.Snapshot()
+}
+
+// series is the value of an instrument for one set of label values.
+type series struct {
+	labels []string
+	value  float64
+
+	// Histograms only
+	counts []uint64
+	count  uint64
+}
+
+// vec is a counter or histogram with any number of labels.
+type vec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, kind string, buckets []float64, labels []string) *vec {
+	v := &vec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	registry = append(registry, v)
+	return v
+}
+
+// newCounter creates and registers a counter with the given labels.
+func newCounter(name, help string, labels ...string) *vec {
+	return newVec(name, help, "counter", nil, labels)
+}
+
+// newHistogram creates and registers a histogram with the given bucket
+// upper bounds and labels.
+func newHistogram(name, help string, buckets []float64, labels ...string) *vec {
+	return newVec(name, help, "histogram", buckets, labels)
+}
+
+// get returns the series for the label values.  The lock must be held.
+func (v *vec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", v.name,
+			len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: values, counts: make([]uint64, len(v.buckets))}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Add increments a counter by n.
+func (v *vec) Add(n float64, values ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.get(values).value += n
+}
+
+// Observe records the value, such as a duration in seconds, in a
+// histogram.
+func (v *vec) Observe(n float64, values ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	s := v.get(values)
+	s.value += n
+	s.count++
+	for i, bound := range v.buckets {
+		if n <= bound {
+			s.counts[i]++
+		}
+	}
+}
+
+// sorted returns a copy of the series sorted by label values.
+func (v *vec) sorted() []series {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]series, len(keys))
+	for i, key := range keys {
+		s := *v.series[key]
+		s.counts = append([]uint64(nil), s.counts...)
+		result[i] = s
+	}
+	return result
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabels formats the label pairs, with an optional extra pair, as a
+// Prometheus label set.
+func promLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i := range names {
+		pairs = append(pairs, names[i]+`="`+promEscaper.Replace(values[i])+`"`)
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+extra[1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat formats a sample value as Prometheus expects.
+func formatFloat(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "+Inf"
+	case math.IsInf(n, -1):
+		return "-Inf"
+	case math.IsNaN(n):
+		return "NaN"
+	}
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+func (v *vec) writeProm(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	for _, s := range v.sorted() {
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, promLabels(v.labels, s.labels),
+				formatFloat(s.value))
+			continue
+		}
+		for i, bound := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name,
+				promLabels(v.labels, s.labels, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name,
+			promLabels(v.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, promLabels(v.labels, s.labels),
+			formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, promLabels(v.labels, s.labels),
+			s.count)
+	}
+}
+
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// graphiteNode makes s safe to use as one node of a Graphite metric key.
+func graphiteNode(s string) string {
+	s = graphiteUnsafe.ReplaceAllString(strings.TrimPrefix(s, "/"), "_")
+	if s == "" {
+		return "_"
+	}
+	return s
+}
+
+func (v *vec) writeGraphite(w io.Writer, prefix string, now int64) {
+	for _, s := range v.sorted() {
+		key := prefix + "." + v.name
+		for _, l := range s.labels {
+			key = key + "." + graphiteNode(l)
+		}
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s %s %d\n", key, formatFloat(s.value), now)
+			continue
+		}
+		for i, bound := range v.buckets {
+			fmt.Fprintf(w, "%s.le_%s %d %d\n", key,
+				graphiteNode(formatFloat(bound)), s.counts[i], now)
+		}
+		fmt.Fprintf(w, "%s.sum %s %d\n", key, formatFloat(s.value), now)
+		fmt.Fprintf(w, "%s.count %d %d\n", key, s.count, now)
+	}
+}
+
+// gauge is an instrument whose value is read when it is collected.
+type gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// newGauge creates and registers a gauge that calls value when collected.
+func newGauge(name, help string, value func() float64) *gauge {
+	g := &gauge{name: name, help: help, value: value}
+	registry = append(registry, g)
+	return g
+}
+
+func (g *gauge) writeProm(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help,
+		g.name, g.name, formatFloat(g.value()))
+}
+
+func (g *gauge) writeGraphite(w io.Writer, prefix string, now int64) {
+	n := g.value()
+	if !math.IsNaN(n) {
+		fmt.Fprintf(w, "%s.%s %s %d\n", prefix, g.name, formatFloat(n), now)
+	}
+}
+
+// serveDebugMetrics writes every instrument in the Prometheus text format.
+func serveDebugMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf := bufio.NewWriter(w)
+	for _, c := range registry {
+		c.writeProm(buf)
+	}
+	buf.Flush()
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// instrumentWriter records the status and body size of a response.
+type instrumentWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (i *instrumentWriter) WriteHeader(status int) {
+	if i.status == 0 {
+		i.status = status
+	}
+	i.ResponseWriter.WriteHeader(status)
+}
+
+func (i *instrumentWriter) Write(b []byte) (int, error) {
+	if i.status == 0 {
+		i.status = http.StatusOK
+	}
+	n, err := i.ResponseWriter.Write(b)
+	i.n += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the sendfile path of the underlying ResponseWriter for
+// Whisper DBs served from disk.
+func (i *instrumentWriter) ReadFrom(r io.Reader) (int64, error) {
+	if i.status == 0 {
+		i.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := i.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(i.ResponseWriter, r)
+	}
+	i.n += n
+	return n, err
+}
+
+// encoding returns the name of a content encoding header value.
+func encoding(header string) string {
+	if header == "" {
+		return "identity"
+	}
+	return strings.ToLower(header)
+}
+
+// instrumentHandler wraps the handler registered for pattern to count
+// requests, their latency and the bytes transferred.
+func instrumentHandler(pattern string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		iw := &instrumentWriter{ResponseWriter: w}
+		h(iw, r)
+
+		if iw.status == 0 {
+			iw.status = http.StatusOK
+		}
+		httpRequests.Add(1, pattern, r.Method, strconv.Itoa(iw.status))
+		httpDuration.Observe(time.Since(start).Seconds(), pattern, r.Method)
+		httpBytes.Add(float64(body.n), "in", encoding(r.Header.Get("Content-Encoding")))
+		httpBytes.Add(float64(iw.n), "out", encoding(iw.Header().Get("Content-Encoding")))
+	}
+}
+
+// flock takes an exclusive lock on the file and records the time spent
+// waiting for it.
+func flock(fd *os.File) error {
+	start := time.Now()
+	err := syscall.Flock(int(fd.Fd()), syscall.LOCK_EX)
+	flockWait.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// timeFill runs a backfill and records its duration and result.
+func timeFill(fill func() error) error {
+	start := time.Now()
+	err := fill()
+	fillDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		fillOps.Add(1, "error")
+	} else {
+		fillOps.Add(1, "ok")
+	}
+	return err
+}
+
+// pushGraphite sends every instrument to the Graphite plaintext listener
+// at addr each interval.  It never returns.
+func pushGraphite(addr, prefix string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		if err != nil {
+			log.Printf("Error connecting to Graphite at %s: %s", addr, err)
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(interval))
+		buf := bufio.NewWriter(conn)
+		now := time.Now().Unix()
+		for _, c := range registry {
+			c.writeGraphite(buf, prefix, now)
+		}
+		if err := buf.Flush(); err != nil {
+			log.Printf("Error sending metrics to Graphite at %s: %s", addr, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVecFormats(t *testing.T) {
+	defer func(saved []collector) { registry = saved }(registry)
+	c := newCounter("test_total", "A test counter.", "path")
+	h := newHistogram("test_seconds", "A test histogram.", []float64{.1, 1})
+	c.Add(1, `/a "b"`)
+	c.Add(2, `/a "b"`)
+	h.Observe(.05)
+	h.Observe(.5)
+	h.Observe(5)
+
+	buf := new(bytes.Buffer)
+	c.writeProm(buf)
+	h.writeProm(buf)
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{path="/a \"b\""} 3
+# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if buf.String() != expected {
+		t.Errorf("Prometheus output was:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	c.writeGraphite(buf, "buckyd.node", 1000)
+	h.writeGraphite(buf, "buckyd.node", 1000)
+	expected = `buckyd.node.test_total.a_b_ 3 1000
+buckyd.node.test_seconds.le_0_1 1 1000
+buckyd.node.test_seconds.le_1 2 1000
+buckyd.node.test_seconds.sum 5.55 1000
+buckyd.node.test_seconds.count 3 1000
+`
+	if buf.String() != expected {
+		t.Errorf("Graphite output was:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestDebugMetrics(t *testing.T) {
+	_, cleanup := setupTestServer(t, 2)
+	defer cleanup()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics/", instrumentHandler("/metrics/", serveMetrics))
+	mux.HandleFunc("/debug/metrics", serveDebugMetrics)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	r, _ := http.NewRequest("GET", server.URL+"/metrics/test.metric0", nil)
+	r.Header.Set("Accept-Encoding", "snappy")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(server.URL + "/metrics/test.missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/debug/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, line := range []string{
+		`buckyd_http_requests_total{handler="/metrics/",method="GET",status="200"} `,
+		`buckyd_http_requests_total{handler="/metrics/",method="GET",status="404"} `,
+		`buckyd_http_request_duration_seconds_count{handler="/metrics/",method="GET"} `,
+		`buckyd_http_bytes_total{direction="out",encoding="snappy"} `,
+		`buckyd_flock_wait_seconds_count `,
+		"buckyd_cache_metrics ",
+	} {
+		if !strings.Contains(string(body), "\n"+line) {
+			t.Errorf("Missing %q in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import "github.com/pborman/uuid"
+
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/fill"
+import "github.com/jjneely/buckytools/whisper"
+
+// jobDir is the directory job state is kept in.  Empty disables jobs.
+var jobDir string
+
+// jobWorkers is the number of jobs run at once.
+var jobWorkers int
+
+// jobRetention is how long finished jobs are kept.
+var jobRetention = 7 * 24 * time.Hour
+
+// jobSaveInterval is how often the progress of a running job is saved.
+var jobSaveInterval = 5 * time.Second
+
+// jobs are the known jobs by ID.  jobLock guards the map and the jobs.
+var jobs = make(map[string]*Job)
+var jobLock sync.Mutex
+
+// jobSlots limits the number of running jobs to jobWorkers.
+var jobSlots chan struct{}
+
+// jobPath returns the path of the state file of the job.
+func jobPath(id string) string {
+	return filepath.Join(jobDir, id+".json")
+}
+
+// saveJob writes the state of the job to disk.  The file is replaced
+// with a rename so a crash leaves the old or new state.  Must be called
+// with jobLock held.
+func saveJob(job *Job) error {
+	blob, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(jobDir, ".job")
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(blob)
+	if err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err == nil {
+		err = os.Rename(fd.Name(), jobPath(job.ID))
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		log.Printf("Error saving job %s: %s", job.ID, err)
+	}
+	return err
+}
+
+// startJobs loads the jobs saved in jobDir and resumes those that had
+// not finished.  Finished jobs past jobRetention are removed.
+func startJobs() error {
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		return err
+	}
+	if jobSlots == nil {
+		jobSlots = make(chan struct{}, jobWorkers)
+	}
+	files, err := filepath.Glob(filepath.Join(jobDir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	resume := make([]*Job, 0)
+	for _, f := range files {
+		blob, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		job := new(Job)
+		if err := json.Unmarshal(blob, job); err != nil {
+			log.Printf("Skipping corrupt job %s: %s", f, err)
+			continue
+		}
+		if expiredJob(job, time.Now()) {
+			os.Remove(f)
+			continue
+		}
+		jobs[job.ID] = job
+		if job.State == JobQueued || job.State == JobRunning {
+			job.State = JobQueued
+			resume = append(resume, job)
+		}
+	}
+	sort.Slice(resume, func(i, j int) bool { return resume[i].Created < resume[j].Created })
+	for _, job := range resume {
+		log.Printf("Resuming job %s at %d of %d", job.ID, job.Done, job.Total)
+		go runJob(job)
+	}
+	go jobPurger()
+	return nil
+}
+
+// expiredJob returns true if the job finished more than jobRetention ago.
+func expiredJob(job *Job, now time.Time) bool {
+	switch job.State {
+	case JobQueued, JobRunning:
+		return false
+	}
+	return now.Sub(time.Unix(job.Updated, 0)) > jobRetention
+}
+
+// jobPurger removes finished jobs past jobRetention every hour.
+func jobPurger() {
+	for range time.Tick(time.Hour) {
+		jobLock.Lock()
+		for id, job := range jobs {
+			if expiredJob(job, time.Now()) {
+				os.Remove(jobPath(id))
+				delete(jobs, id)
+			}
+		}
+		jobLock.Unlock()
+	}
+}
+
+// runJob runs the job once a slot is free, saving its progress as it
+// goes.  The job is checked for cancellation before each item.
+func runJob(job *Job) {
+	jobSlots <- struct{}{}
+	defer func() { <-jobSlots }()
+
+	var retentions whisper.Retentions
+	if job.Type == "resize" {
+		// Validated when the job was submitted
+		retentions, _ = whisper.ParseRetentionDefs(job.Retention)
+	}
+
+	jobLock.Lock()
+	if job.State != JobQueued {
+		jobLock.Unlock()
+		return
+	}
+	job.State = JobRunning
+	saveJob(job)
+	saved := time.Now()
+	for job.State == JobRunning && job.Done < job.Total {
+		item := job.Items[job.Done]
+		jobLock.Unlock()
+		result := runJobItem(job, item, retentions)
+		jobLock.Lock()
+
+		job.Done++
+		if result.Status != http.StatusOK {
+			job.Failed++
+			job.Error = fmt.Sprintf("%s: %s", result.Name, result.Error)
+		}
+		job.Updated = time.Now().Unix()
+		if time.Since(saved) > jobSaveInterval {
+			saveJob(job)
+			saved = time.Now()
+		}
+	}
+	if job.State == JobRunning {
+		job.State = JobDone
+		if job.Failed > 0 {
+			job.State = JobFailed
+		}
+	}
+	job.Updated = time.Now().Unix()
+	saveJob(job)
+	log.Printf("Job %s %s: %d of %d items failed", job.ID, job.State,
+		job.Failed, job.Total)
+	jobLock.Unlock()
+}
+
+// runJobItem runs the operation of the job on one metric.  Changes to
+// local metrics are written to the audit log.
+func runJobItem(job *Job, item PushItem, retentions whisper.Retentions) *BatchResult {
+	before := metricSize(item.Name)
+	var result *BatchResult
+	switch job.Type {
+	case "fill":
+		return pushMetric(job.Dest, item)
+	case "move":
+		result = pushMetric(job.Dest, item)
+		if result.Status == http.StatusNotFound {
+			// Moved before a restart
+			result = &BatchResult{Name: item.Name, Status: http.StatusOK}
+			break
+		}
+		if result.Status == http.StatusOK {
+			result = verifyPush(job.Dest, item)
+		}
+		if result.Status == http.StatusOK {
+			result = removeJobMetric(item.Name)
+		}
+	case "delete":
+		result = removeJobMetric(item.Name)
+	case "resize":
+		result = &BatchResult{Name: item.Name, Status: http.StatusOK}
+		if err := resizeMetric(item.Name, retentions); err != nil {
+			log.Printf("Error resizing %s: %s", item.Name, err)
+			result = batchError(item.Name, err)
+		}
+	}
+	auditJob(job, item.Name, before, metricSize(item.Name), result)
+	return result
+}
+
+// verifyPush compares the points of the metric with those of the copy
+// pushed to dest over the time span of the local points, so a move only
+// deletes a metric whose points all reached dest.
+func verifyPush(dest string, item PushItem) *BatchResult {
+	path := findMetric(item.Name)
+	src, err := digestMetric(path, 0, time.Now().Unix())
+	if err != nil {
+		return batchError(item.Name, err)
+	}
+	from, until, ok := src.PointSpan()
+	if !ok {
+		// There are no points to lose
+		return &BatchResult{Name: item.Name, Status: http.StatusOK}
+	}
+	if src, err = digestMetric(path, from, until); err != nil {
+		return batchError(item.Name, err)
+	}
+
+	name := item.Name
+	if item.NewName != "" {
+		name = item.NewName
+	}
+	dst, err := digestPeer(dest, &BatchItem{Name: name, From: from, Until: until})
+	if err != nil {
+		log.Printf("Error digesting %s on %s: %s", name, dest, err)
+		return &BatchResult{Name: item.Name, Status: http.StatusBadGateway,
+			Error: err.Error()}
+	}
+	if !src.Equal(dst) {
+		log.Printf("Error: %s on %s differs from %s, keeping it", name, dest, item.Name)
+		return &BatchResult{Name: item.Name, Status: http.StatusConflict,
+			Error: fmt.Sprintf("%s on %s differs", name, dest)}
+	}
+	return &BatchResult{Name: item.Name, Status: http.StatusOK}
+}
+
+// removeJobMetric deletes the metric for a job.  A metric that is already
+// gone counts as deleted as progress is saved every jobSaveInterval and
+// items done before a restart are run again.
+func removeJobMetric(metric string) *BatchResult {
+	path := findMetric(metric)
+	if err := removeMetric(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error deleting metric %s: %s", path, err)
+		return batchError(metric, err)
+	}
+	return &BatchResult{Name: metric, Status: http.StatusOK}
+}
+
+// resizeMetric rewrites the metric with the given retentions keeping its
+// aggregation method and xFilesFactor.  The existing data is filled into
+// the new archives, as whisper-resize.py does, and the new file renamed
+// over the old while the old is locked.
+func resizeMetric(metric string, retentions whisper.Retentions) error {
+	path := findMetric(metric)
+	src, err := whisper.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// The name does not end in .wsp so it is never seen as a metric
+	tmp := filepath.Join(filepath.Dir(path), ".buckyd-resize-"+filepath.Base(path))
+	os.Remove(tmp) // left by a crash
+	dst, err := whisper.Create(tmp, retentions, src.AggregationMethod(), src.XFilesFactor())
+	if err != nil {
+		return err
+	}
+	err = timeFill(func() error {
+		return fill.OpenWSP(src, dst, int(time.Now().Unix()))
+	})
+	dst.Close()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// auditJob writes an audit log entry for a metric changed by the job.
+func auditJob(job *Job, metric string, before, after int64, result *BatchResult) {
+	if auditLog == nil || job.Type == "fill" {
+		return
+	}
+	writeAudit(&AuditEntry{
+		Time:       time.Now().Unix(),
+		Client:     job.Client,
+		User:       job.User,
+		Method:     job.Type,
+		Path:       "/jobs/" + job.ID,
+		Metric:     metric,
+		SizeBefore: before,
+		SizeAfter:  after,
+		Status:     result.Status,
+		Error:      result.Error,
+	})
+}
+
+// newJob validates the job submitted in the request and fills in its
+// ID, state and bookkeeping.
+func newJob(r *http.Request) (*Job, error) {
+	if r.ContentLength > listMaxBytes {
+		return nil, fmt.Errorf("Query larger than %d bytes", listMaxBytes)
+	}
+	job := new(Job)
+	err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, listMaxBytes)).Decode(job)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid job: %s", err)
+	}
+
+	switch job.Type {
+	case "move", "fill":
+		if !isPeer(job.Dest) {
+			return nil, fmt.Errorf("Destination is not in the hash ring.")
+		}
+	case "delete":
+	case "resize":
+		if _, err := whisper.ParseRetentionDefs(job.Retention); err != nil {
+			return nil, fmt.Errorf("Invalid retention: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown job type: %s", job.Type)
+	}
+	if len(job.Items) == 0 {
+		return nil, fmt.Errorf("No metrics given.")
+	}
+
+	now := time.Now().Unix()
+	job.ID = uuid.NewRandom().String()
+	job.State = JobQueued
+	job.Client = r.RemoteAddr
+	job.User = requestUser(r)
+	job.Total = len(job.Items)
+	job.Done, job.Failed, job.Error = 0, 0, ""
+	job.Created, job.Updated = now, now
+	return job, nil
+}
+
+// jobSummary returns a copy of the job without its list of metrics.
+// Must be called with jobLock held.
+func jobSummary(job *Job) *Job {
+	summary := *job
+	summary.Items = nil
+	return &summary
+}
+
+// serveJobs handles the /jobs and /jobs/<id> endpoints.  POST to /jobs
+// submits a job, GET lists the jobs or reports the status of one and
+// DELETE cancels one.
+func serveJobs(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if jobDir == "" {
+		http.Error(w, "Jobs not enabled.", http.StatusNotFound)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+
+	var result interface{}
+	status := http.StatusOK
+	switch {
+	case id == "" && r.Method == "POST":
+		job, err := newJob(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jobLock.Lock()
+		err = saveJob(job)
+		if err == nil {
+			jobs[job.ID] = job
+			result = jobSummary(job)
+		}
+		jobLock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Queued %s job %s of %d metrics", job.Type, job.ID, job.Total)
+		go runJob(job)
+		status = http.StatusCreated
+	case id == "" && r.Method == "GET":
+		list := make([]*Job, 0)
+		jobLock.Lock()
+		for _, job := range jobs {
+			list = append(list, jobSummary(job))
+		}
+		jobLock.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+		result = list
+	case id != "" && (r.Method == "GET" || r.Method == "DELETE"):
+		jobLock.Lock()
+		job, ok := jobs[id]
+		if ok && r.Method == "DELETE" && (job.State == JobQueued || job.State == JobRunning) {
+			job.State = JobCanceled
+			job.Updated = time.Now().Unix()
+			saveJob(job)
+			log.Printf("Canceled job %s at %d of %d", job.ID, job.Done, job.Total)
+		}
+		if ok {
+			result = jobSummary(job)
+		}
+		jobLock.Unlock()
+		if !ok {
+			http.Error(w, "Job not found.", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+
+	blob, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Error encoding jobs: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(blob)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+// waitJob polls the job until it is no longer queued or running.
+func waitJob(t *testing.T, id string) *metrics.Job {
+	for i := 0; i < 100; i++ {
+		r := httptest.NewRequest("GET", "/jobs/"+id, nil)
+		w := httptest.NewRecorder()
+		serveJobs(w, r)
+		job := new(metrics.Job)
+		if err := json.Unmarshal(w.Body.Bytes(), job); err != nil {
+			t.Fatalf("Job status returned %d: %s", w.Code, w.Body.String())
+		}
+		if job.State != metrics.JobQueued && job.State != metrics.JobRunning {
+			return job
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Job %s did not finish", id)
+	return nil
+}
+
+func TestServeJobs(t *testing.T) {
+	_, cleanup := setupTestServer(t, 3)
+	defer cleanup()
+	jobDir = filepath.Join(filepath.Dir(tmpDir), "jobs")
+	jobWorkers = 1
+	jobs = make(map[string]*metrics.Job)
+	defer func() { jobDir = "" }()
+	if err := startJobs(); err != nil {
+		t.Fatal(err)
+	}
+
+	submit := func(body string) (int, *metrics.Job) {
+		r := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		serveJobs(w, r)
+		job := new(metrics.Job)
+		json.Unmarshal(w.Body.Bytes(), job)
+		return w.Code, job
+	}
+
+	status, job := submit(`{"Type": "delete", "Items": [{"Name": "test.metric0"}, {"Name": "test.missing"}]}`)
+	if status != http.StatusCreated || job.ID == "" || job.Total != 2 || job.Items != nil {
+		t.Fatalf("Submitting delete job returned %d: %v", status, job)
+	}
+	job = waitJob(t, job.ID)
+	// test.missing may have been deleted before a restart
+	if job.State != metrics.JobDone || job.Done != 2 || job.Failed != 0 {
+		t.Errorf("Unexpected delete job result: %v", job)
+	}
+	if _, err := os.Stat(metrics.MetricToPath("test.metric0")); !os.IsNotExist(err) {
+		t.Errorf("Delete job did not remove test.metric0: %v", err)
+	}
+
+	status, job = submit(`{"Type": "resize", "Retention": "1m:1h,1h:1d", "Items": [{"Name": "test.metric1"}]}`)
+	if status != http.StatusCreated {
+		t.Fatalf("Submitting resize job returned %d", status)
+	}
+	job = waitJob(t, job.ID)
+	if job.State != metrics.JobDone {
+		t.Errorf("Unexpected resize job result: %v", job)
+	}
+	wsp, err := whisper.Open(metrics.MetricToPath("test.metric1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wsp.Retentions()) != 2 || wsp.AggregationMethod() != whisper.Sum {
+		t.Errorf("Resized metric has retentions %v and aggregation %v",
+			wsp.Retentions(), wsp.AggregationMethod())
+	}
+	wsp.Close()
+
+	for _, body := range []string{
+		`{"Type": "resize", "Retention": "bogus", "Items": [{"Name": "test.metric1"}]}`,
+		`{"Type": "move", "Dest": "elsewhere:4242", "Items": [{"Name": "test.metric1"}]}`,
+		`{"Type": "delete"}`,
+		`{"Type": "explode", "Items": [{"Name": "test.metric1"}]}`,
+	} {
+		if status, _ = submit(body); status != http.StatusBadRequest {
+			t.Errorf("Invalid job %s returned %d", body, status)
+		}
+	}
+
+	// Cancel a job before it has a slot to run in
+	jobSlots <- struct{}{}
+	status, job = submit(`{"Type": "delete", "Items": [{"Name": "test.metric2"}]}`)
+	r := httptest.NewRequest("DELETE", "/jobs/"+job.ID, nil)
+	w := httptest.NewRecorder()
+	serveJobs(w, r)
+	<-jobSlots
+	job = waitJob(t, job.ID)
+	if w.Code != http.StatusOK || job.State != metrics.JobCanceled || job.Done != 0 {
+		t.Errorf("Cancel returned %d: %v", w.Code, job)
+	}
+	if _, err := os.Stat(metrics.MetricToPath("test.metric2")); err != nil {
+		t.Errorf("Canceled job removed test.metric2: %v", err)
+	}
+
+	// Jobs are reloaded from disk
+	jobs = make(map[string]*metrics.Job)
+	if err := startJobs(); err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", "/jobs", nil)
+	w = httptest.NewRecorder()
+	serveJobs(w, r)
+	list := make([]metrics.Job, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 3 {
+		t.Errorf("Listing reloaded jobs returned %d: %s", w.Code, w.Body.String())
+	}
+	if status, _ = submit(`{"Type": "delete", "Items": []}`); status != http.StatusBadRequest {
+		t.Errorf("Empty job returned %d", status)
+	}
+}
+
+func TestMoveJobItem(t *testing.T) {
+	server, cleanup := setupTestServer(t, 2)
+	defer cleanup()
+	u, _ := url.Parse(server.URL)
+	job := &metrics.Job{Type: "move", Dest: u.Host}
+
+	result := runJobItem(job, metrics.PushItem{Name: "test.metric0", NewName: "test.moved0"}, nil)
+	if result.Status != http.StatusOK {
+		t.Errorf("Move returned %d: %s", result.Status, result.Error)
+	}
+	if _, err := os.Stat(metrics.MetricToPath("test.metric0")); !os.IsNotExist(err) {
+		t.Errorf("Move did not remove test.metric0: %v", err)
+	}
+	if _, err := os.Stat(metrics.MetricToPath("test.moved0")); err != nil {
+		t.Errorf("Move did not create test.moved0: %v", err)
+	}
+
+	// Run again after a restart the item finds the source gone
+	result = runJobItem(job, metrics.PushItem{Name: "test.metric0", NewName: "test.moved0"}, nil)
+	if result.Status != http.StatusOK {
+		t.Errorf("Repeated move returned %d: %s", result.Status, result.Error)
+	}
+
+	// The destination holds a point the source lacks so it differs
+	then := int(time.Now().Unix()) - 120
+	retentions, _ := whisper.ParseRetentionDefs("1m:30m")
+	wsp, err := whisper.Create(metrics.MetricToPath("test.moved1"), retentions, whisper.Sum, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsp.Update(42, then-60)
+	wsp.Close()
+	wsp, _ = whisper.Open(metrics.MetricToPath("test.metric1"))
+	wsp.Update(1, then-120)
+	wsp.Update(1, then)
+	wsp.Close()
+
+	result = runJobItem(job, metrics.PushItem{Name: "test.metric1", NewName: "test.moved1"}, nil)
+	if result.Status != http.StatusConflict {
+		t.Errorf("Move onto a differing metric returned %d: %s", result.Status, result.Error)
+	}
+	if _, err := os.Stat(metrics.MetricToPath("test.metric1")); err != nil {
+		t.Errorf("Move onto a differing metric removed test.metric1: %v", err)
+	}
+}
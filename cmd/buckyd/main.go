@@ -8,19 +8,28 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"time"
 )
 
 import . "github.com/jjneely/buckytools"
 import "github.com/jjneely/buckytools/metrics"
 import "github.com/jjneely/buckytools/hashing"
+import "github.com/jjneely/buckytools/auth"
 
 var metricsCache *metrics.MetricsCacheType
 var tmpDir string
 var hashring *hashing.JSONRingType
 
+// ring is the HashRing built from hashring used to find which local
+// instance, and so which whisper store, a metric belongs to.
+var ring hashing.HashRing
+
 // sparseFiles defines if we create and manage sparse files.
 var sparseFiles bool
 
+// listMaxBytes is the largest request body accepted by /metrics.
+var listMaxBytes int64
+
 func usage() {
 	t := []string{
 		"%s [options] <graphite-node1> <graphite-node2> ...\n",
@@ -62,10 +71,21 @@ func parseRing(hostname, algo string, replicas int) *hashing.JSONRingType {
 	return ring
 }
 
+// handle registers the handler for pattern with instrumentation.
+func handle(pattern string, h http.HandlerFunc) {
+	http.HandleFunc(pattern, instrumentHandler(pattern, h))
+}
+
 func main() {
 	var replicas int
 	var hashType string
 	var bindAddress string
+	var authFile string
+	var tlsCert, tlsKey, tlsClientCA string
+	var peerAuthFile, peerCA string
+	var peerTLS bool
+	var retention string
+	var graphiteAddr, graphitePrefix, graphiteInterval string
 	hostname, err := os.Hostname()
 	if err != nil {
 		hostname = "UNKNOWN"
@@ -88,8 +108,40 @@ func main() {
 		"Be aware of sparse Whisper DB files.")
 	flag.StringVar(&hashType, "hash", "carbon",
 		fmt.Sprintf("Consistent Hash algorithm to use: %v", SupportedHashTypes))
+	flag.Int64Var(&listMaxBytes, "list-max-bytes", 10<<24,
+		"Maximum size in bytes of a /metrics request body.")
 	flag.IntVar(&replicas, "replicas", 1,
 		"Number of copies of each metric in the cluster.")
+	flag.StringVar(&authFile, "auth-file", "",
+		"File of credentials clients must use.  Empty disables authentication.")
+	flag.BoolVar(&trashEnabled, "trash", false,
+		"Move deleted metrics to the trash rather than removing them.")
+	flag.StringVar(&retention, "trash-retention", "7d",
+		"How long deleted metrics are kept in the trash.")
+	flag.StringVar(&auditFile, "audit-log", "",
+		"Append a JSON record of each change to metrics to this file.")
+	flag.StringVar(&graphiteAddr, "graphite", "",
+		"HOST:PORT of a Graphite plaintext listener to send buckyd's own metrics to.")
+	flag.StringVar(&graphitePrefix, "graphite-prefix", "",
+		"Prefix of the metrics sent to -graphite.  Defaults to buckyd.<node>.")
+	flag.StringVar(&graphiteInterval, "graphite-interval", "60s",
+		"How often metrics are sent to -graphite.")
+	flag.StringVar(&tlsCert, "tls-cert", "",
+		"PEM certificate file.  Serve HTTPS rather than HTTP when set.")
+	flag.StringVar(&tlsKey, "tls-key", "",
+		"PEM private key file for -tls-cert.")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "",
+		"PEM CA bundle.  Require client certificates signed by these CAs.")
+	flag.StringVar(&peerAuthFile, "peer-auth-file", "",
+		"File holding a \"token TOKEN\" or \"key NAME SECRET\" line to push metrics to other buckyd daemons.")
+	flag.BoolVar(&peerTLS, "peer-tls", false,
+		"Use HTTPS to push metrics to other buckyd daemons.")
+	flag.StringVar(&peerCA, "peer-ca", "",
+		"PEM CA bundle to verify other buckyd daemons.  Implies -peer-tls.")
+	flag.StringVar(&jobDir, "job-dir", "",
+		"Directory to keep the state of asynchronous jobs in.  Enables the /jobs API.")
+	flag.IntVar(&jobWorkers, "job-workers", 2,
+		"Number of asynchronous jobs run at once.")
 	flag.Parse()
 
 	i := sort.SearchStrings(SupportedHashTypes, hashType)
@@ -98,14 +150,89 @@ func main() {
 			SupportedHashTypes)
 	}
 	hashring = parseRing(hostname, hashType, replicas)
+	ring, err = hashring.HashRing()
+	if err != nil {
+		log.Fatalf("Error building hashring: %s", err)
+	}
+	if err = checkInstanceRoots(); err != nil {
+		log.Fatal(err)
+	}
+	if authFile != "" {
+		credentials, err = auth.LoadCredentials(authFile)
+		if err != nil {
+			log.Fatalf("Error loading credentials: %s", err)
+		}
+		log.Printf("Loaded %d credentials from %s", len(credentials), authFile)
+	} else {
+		log.Printf("Warning: No -auth-file given, the API is open to anyone")
+	}
+	err = setupPeerClient(peerAuthFile, peerCA, tlsCert, tlsKey, peerTLS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trashRetention, err = metrics.ParseAge(retention)
+	if err != nil {
+		log.Fatalf("Invalid -trash-retention: %s", err)
+	}
+	if trashEnabled {
+		go trashPurger()
+	}
+	if auditFile != "" {
+		if err = openAuditLog(auditFile); err != nil {
+			log.Fatalf("Error opening audit log: %s", err)
+		}
+	}
+	if jobDir != "" {
+		if err = startJobs(); err != nil {
+			log.Fatalf("Error loading jobs: %s", err)
+		}
+	}
+	if graphiteAddr != "" {
+		interval, err := metrics.ParseAge(graphiteInterval)
+		if err != nil || interval < 1 {
+			log.Fatalf("Invalid -graphite-interval: %s", graphiteInterval)
+		}
+		if graphitePrefix == "" {
+			graphitePrefix = "buckyd." + graphiteNode(hostname)
+		}
+		go pushGraphite(graphiteAddr, graphitePrefix, time.Duration(interval)*time.Second)
+	}
+	metricsCache = metrics.NewMetricsCache()
 
-	http.HandleFunc("/", http.NotFound)
-	http.HandleFunc("/metrics", listMetrics)
-	http.HandleFunc("/metrics/", serveMetrics)
-	http.HandleFunc("/hashring", listHashring)
+	handle("/", http.NotFound)
+	handle("/metrics", auditHandler(authHandler(listMetrics)))
+	handle("/metrics/", auditHandler(authHandler(serveMetrics)))
+	handle("/hashring", authHandler(listHashring))
+	handle("/status", authHandler(serveStatus))
+	handle("/batch/", auditHandler(authHandler(serveBatch)))
+	handle("/archive", auditHandler(authHandler(serveArchive)))
+	handle("/push", authHandler(servePush))
+	handle("/jobs", authHandler(serveJobs))
+	handle("/jobs/", authHandler(serveJobs))
+	handle("/trash", authHandler(serveTrash))
+	handle("/trash/", auditHandler(authHandler(serveTrash)))
+	handle("/audit", authHandler(serveAudit))
+	handle("/debug/metrics", authHandler(serveDebugMetrics))
 
-	log.Printf("Starting server on %s", bindAddress)
-	err = http.ListenAndServe(bindAddress, nil)
+	if tlsCert == "" {
+		if tlsKey != "" || tlsClientCA != "" {
+			log.Fatal("The -tls-key and -tls-client-ca flags require -tls-cert")
+		}
+		log.Printf("Starting server on %s", bindAddress)
+		err = http.ListenAndServe(bindAddress, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	server := &http.Server{Addr: bindAddress}
+	server.TLSConfig, err = serverTLSConfig(tlsCert, tlsKey, tlsClientCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Starting TLS server on %s", bindAddress)
+	err = server.ListenAndServeTLS("", "")
 	if err != nil {
 		log.Fatal(err)
 	}
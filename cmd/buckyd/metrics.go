@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -17,9 +18,11 @@ import "github.com/golang/snappy"
 
 import . "github.com/jjneely/buckytools/metrics"
 import "github.com/jjneely/buckytools/fill"
+import "github.com/jjneely/buckytools/whisper"
 
 // listMetrics retrieves a list of metrics on the localhost and sends
-// it to the client.
+// it to the client.  The list is streamed as a JSON array or, if the
+// client asks for it, as NDJSON.
 func listMetrics(w http.ResponseWriter, r *http.Request) {
 	logRequest(r)
 	// Check our methods.  We handle GET/POST.
@@ -28,70 +31,46 @@ func listMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Do we need to init the metricsCache?
-	if metricsCache == nil {
-		metricsCache = NewMetricsCache()
-	}
-
-	// XXX: Calling r.FormValue will set a safety limit on the size of
+	// Calling r.FormValue will set a safety limit on the size of
 	// the body of 10MiB which may be small for the amount of JSON data
-	// included in a list command.  Set the limit higher here.  How
-	// can we do this better?  This is 160MiB.
-	if r.ContentLength >= 10<<24 {
+	// included in a list command.  Set the limit from -list-max-bytes.
+	if r.ContentLength > listMaxBytes {
 		// Query is too big, give the user an error
-		http.Error(w, "Query larger than 160MiB", http.StatusBadRequest)
+		msg := fmt.Sprintf("Query larger than %d bytes", listMaxBytes)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
 		return
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, 10<<24)
+	r.Body = http.MaxBytesReader(w, r.Body, listMaxBytes)
 
 	// Handle case when we are currently building the cache
-	if r.FormValue("force") != "" && metricsCache.IsAvailable() {
-		go metricsCache.RefreshCache()
+	if r.FormValue("force") != "" {
+		metricsCache.Force()
 	}
-	metrics, ok := metricsCache.GetMetrics()
+	idx, ok := metricsCache.GetIndex()
 	if !ok {
 		http.Error(w, "Cache update in progress.", http.StatusAccepted)
 		return
 	}
 
 	// Options
-	if r.FormValue("regex") != "" {
-		m, err := FilterRegex(r.FormValue("regex"), metrics)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		metrics = m
-	}
-	if r.FormValue("list") != "" {
-		filter, err := unmarshalList(r.FormValue("list"))
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		metrics = FilterList(filter, metrics)
-	}
-
-	// Marshal the data back as a JSON list
-	blob, err := json.Marshal(metrics)
+	filter, err := parseMetricFilter(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Error marshaling data: %s", err)
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(blob)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	ndjson := r.FormValue("format") == "ndjson" || isNDJSON(r.Header.Get("Accept"))
+	writeMetricList(w, idx, filter, ndjson)
 }
 
 func serveMetrics(w http.ResponseWriter, r *http.Request) {
 	logRequest(r)
 
 	metric := r.URL.Path[len("/metrics/"):]
-	path := MetricToPath(metric)
 	if len(metric) == 0 {
 		http.Error(w, "Metric name missing.", http.StatusBadRequest)
 		return
 	}
+	path := findMetric(metric)
 
 	switch r.Method {
 	case "HEAD":
@@ -113,18 +92,20 @@ func serveMetrics(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		serveMetric(w, r, path, metric)
 	case "DELETE":
-		// XXX: Auth?  Holodeck safeties are off!
 		deleteMetric(w, path, true)
 	case "PUT":
-		// Replace metric data on disk
-		// XXX: Metric will still be deleted if an error in heal occurs
-		err := deleteMetric(w, path, false)
-		if err == nil {
-			healMetric(w, r, path)
+		// Replace metric data on disk.  The new data is renamed over
+		// the metric so a failed upload leaves the old data intact.
+		err := healMetric(w, r, metricPath(metric), true)
+		if err == nil && path != metricPath(metric) {
+			// Found in another store, remove the stale copy
+			if err := os.Remove(path); err != nil {
+				log.Printf("Error deleting metric %s: %s", path, err)
+			}
 		}
 	case "POST":
 		// Backfill
-		healMetric(w, r, path)
+		healMetric(w, r, path, false)
 	default:
 		http.Error(w, "Bad method request.", http.StatusBadRequest)
 	}
@@ -161,11 +142,12 @@ func setStatHeader(w http.ResponseWriter, metric *MetricData) error {
 	return nil
 }
 
-// deleteMetric removes a metric DB from the file system and handles
-// reporting any associated errors back to the client.  Set fatal to true
+// deleteMetric removes a metric DB from the file system, or moves it to
+// the trash in trash mode, and handles reporting any associated errors
+// back to the client.  Set fatal to true
 // to treat file not found as an error rather than success.
 func deleteMetric(w http.ResponseWriter, path string, fatal bool) error {
-	err := os.Remove(path)
+	err := removeMetric(path)
 	if err != nil {
 		if os.IsNotExist(err) && fatal {
 			http.Error(w, "Metric not found.", http.StatusNotFound)
@@ -179,11 +161,22 @@ func deleteMetric(w http.ResponseWriter, path string, fatal bool) error {
 	return nil
 }
 
+// removeMetric removes the metric at path, or moves it to the trash in
+// trash mode.
+func removeMetric(path string) error {
+	if trashEnabled {
+		return trashMetric(path)
+	}
+	return os.Remove(path)
+}
+
 // healMetric will use the Whisper DB in the body of the request to
 // backfill the metric found at the given filesystem path.  If the metric
 // doesn't exist it will be created as an identical copy of the DB found
-// in the request.
-func healMetric(w http.ResponseWriter, r *http.Request, path string) {
+// in the request.  Set replace to true to always replace the metric with
+// the DB in the request.  New and replaced metrics are written to a temp
+// file and renamed into place so readers never see partial data.
+func healMetric(w http.ResponseWriter, r *http.Request, path string, replace bool) error {
 	var err error
 	var data io.Reader
 
@@ -192,7 +185,7 @@ func healMetric(w http.ResponseWriter, r *http.Request, path string) {
 		http.Error(w, "Content-Type must be application/octet-stream.",
 			http.StatusBadRequest)
 		log.Printf("Got send a content-type of %s, abort!", r.Header.Get("Content-Type"))
-		return
+		return fmt.Errorf("Bad Content-Type")
 	}
 	if r.Header.Get("content-encoding") == "snappy" {
 		data = snappy.NewReader(r.Body)
@@ -204,39 +197,47 @@ func healMetric(w http.ResponseWriter, r *http.Request, path string) {
 	if err != nil {
 		log.Printf("Error decoding X-Metric-Stat header: %s", err)
 		http.Error(w, "Error decoding X-Metric-Stat header", http.StatusBadRequest)
-		return
+		return err
 	}
-	if stat.Size <= 28 {
-		// Whisper file headers are 28 bytes and we need data too.
-		log.Printf("Whisper data in request too small: %d bytes", stat.Size)
-		http.Error(w, "Whisper data in request too small.", http.StatusBadRequest)
-		return
+
+	// Check the header describes a whisper DB of the declared size
+	// before anything reaches the disk
+	header, err := whisper.ReadHeader(data, stat.Size)
+	if err != nil {
+		log.Printf("Invalid whisper data for %s: %s", path, err)
+		http.Error(w, "Invalid whisper data: "+err.Error(), http.StatusBadRequest)
+		return err
 	}
+	data = io.MultiReader(bytes.NewReader(header), data)
 
 	// Does the destination path on dist exist?
 	dstExists := true
-	if _, err := os.Stat(path); err != nil {
+	mode := metricMode
+	if fi, err := os.Stat(path); err == nil {
+		// Replacements keep the permissions of the metric
+		mode = fi.Mode().Perm()
+	} else {
 		if !os.IsNotExist(err) {
 			log.Printf("Error stat'ing file %s: %s", path, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
 		err := os.MkdirAll(filepath.Dir(path), 0755)
 		if err != nil {
 			log.Printf("Error creating %s: %s", filepath.Dir(path), err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
 		dstExists = false
 	}
 
-	if dstExists {
+	if dstExists && !replace {
 		// Write request body to a tmpfile
 		fd, err := ioutil.TempFile(tmpDir, "buckyd")
 		if err != nil {
 			log.Printf("Error creating temp file: %s", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
 		nr, err := io.Copy(fd, data)
 		srcName := fd.Name()
@@ -247,54 +248,110 @@ func healMetric(w http.ResponseWriter, r *http.Request, path string) {
 				log.Printf("Error writing to temp file: %s", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 			} else {
-				log.Printf("Decoded whisper file data does not match size %d != %d",
+				err = fmt.Errorf("Received %d bytes of whisper data rather than %d",
 					nr, stat.Size)
-				http.Error(w, "Malformed whisper data", http.StatusBadRequest)
+				log.Printf("Invalid whisper data for %s: %s", path, err)
+				http.Error(w, "Invalid whisper data: "+err.Error(), http.StatusBadRequest)
 			}
-			return
+			return err
 		}
 
-		// XXX: How can we check the tmpfile for sanity?
-		err = fill.All(srcName, path)
+		err = timeFill(func() error { return fill.All(srcName, path) })
 		if err != nil {
 			log.Printf("Error backfilling %s => %s: %s", srcName, path, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
 		}
+		return err
+	}
+
+	tmp, err := writeTempMetric(w, data, stat, filepath.Dir(path), mode)
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+	if replace {
+		err = os.Rename(name, path)
 	} else {
-		// Open and lock destination
-		dst, err := os.Create(path)
-		if err != nil {
-			log.Printf("Error opening metric file %s: %s", path, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer dst.Close()
-		if err = syscall.Flock(int(dst.Fd()), syscall.LOCK_EX); err != nil {
-			log.Printf("Error locking file %s: %s", path, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		// Link rather than rename so a metric created since the
+		// stat above is not clobbered
+		err = os.Link(name, path)
+	}
+	// Closing releases the lock so fill can open the temp file
+	tmp.Close()
+	if !replace && os.IsExist(err) {
+		err = timeFill(func() error { return fill.All(name, path) })
+	}
+	if !replace || err != nil {
+		// Only a rename takes the temp file away
+		os.Remove(name)
+	}
+	if err != nil {
+		log.Printf("Error moving whisper data into place at %s: %s", path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return err
+}
 
-		var nr int64
-		if sparseFiles {
-			nr, err = copySparse(dst, data)
-		} else {
-			nr, err = io.Copy(dst, data)
-		}
-		if err != nil || nr != stat.Size {
-			if err != nil {
-				log.Printf("Error writing whisper data to %s: %s", path, err)
-				http.Error(w, "Error writing whisper data", http.StatusInternalServerError)
-			} else {
-				log.Printf("Decoded whisper file data does not match size %d != %d",
-					nr, stat.Size)
-				http.Error(w, "Malformed whisper data", http.StatusBadRequest)
-			}
-			defer os.Remove(dst.Name()) // not concerned with errors here
-			return
+// metricMode is the mode of new metrics, as os.Create would give them.
+var metricMode = createMode()
+
+// createMode returns the mode os.Create gives new files under the umask.
+func createMode() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return 0666 &^ os.FileMode(mask)
+}
+
+// writeTempMetric writes the whisper data to a temp file in dir, which
+// must be on the same file system as the metric so the temp file can be
+// renamed over it.  The data must already have a valid header.  The temp
+// file is given mode and returned open and exclusively locked.  The caller
+// must close and remove it.  Errors are reported to the client.
+func writeTempMetric(w http.ResponseWriter, data io.Reader, stat *MetricData, dir string, mode os.FileMode) (*os.File, error) {
+	// The name does not end in .wsp so it is never seen as a metric
+	fd, err := ioutil.TempFile(dir, ".buckyd")
+	if err != nil {
+		log.Printf("Error creating temp file: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	if err = flock(fd); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		log.Printf("Error locking temp file: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	var nr int64
+	if sparseFiles {
+		nr, err = copySparse(fd, data)
+	} else {
+		nr, err = io.Copy(fd, data)
+	}
+	if err == nil {
+		// TempFile creates files only their owner can read
+		err = fd.Chmod(mode)
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err != nil || nr != stat.Size {
+		fd.Close()
+		os.Remove(fd.Name())
+		if err != nil {
+			log.Printf("Error writing whisper data to %s: %s", fd.Name(), err)
+			http.Error(w, "Error writing whisper data", http.StatusInternalServerError)
+			return nil, err
 		}
+		err = fmt.Errorf("Received %d bytes of whisper data rather than %d",
+			nr, stat.Size)
+		log.Printf("Invalid whisper data for %s: %s", stat.Name, err)
+		http.Error(w, "Invalid whisper data: "+err.Error(), http.StatusBadRequest)
+		return nil, err
 	}
+
+	return fd, nil
 }
 
 // serveMetric will serve a GET request for the metric that path
@@ -319,7 +376,7 @@ func serveMetric(w http.ResponseWriter, r *http.Request, path, metric string) {
 		return
 	}
 	defer fd.Close()
-	if err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX); err != nil {
+	if err = flock(fd); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+import "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+// setupTestServer builds a whisper store in a temp directory holding
+// count metrics and starts a buckyd API server on top of it.  The
+// returned function shuts everything down.
+func setupTestServer(t *testing.T, count int) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "buckyd_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPrefix := metrics.Prefix
+	metrics.Prefix = filepath.Join(dir, "whisper")
+	tmpDir = filepath.Join(dir, "tmp")
+	os.MkdirAll(tmpDir, 0755)
+	listMaxBytes = 10 << 20
+
+	retentions, err := whisper.ParseRetentionDefs("1m:30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		path := metrics.MetricToPath(fmt.Sprintf("test.metric%d", i))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		wsp, err := whisper.Create(path, retentions, whisper.Sum, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wsp.Update(float64(i), int(time.Now().Unix()))
+		wsp.Close()
+	}
+
+	hashring = &hashing.JSONRingType{
+		Name:     "test",
+		Nodes:    []hashing.Node{hashing.NewNode("test", 0, "")},
+		Algo:     "carbon",
+		Replicas: 1,
+	}
+	ring, err = hashring.HashRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metricsCache = metrics.NewMetricsCache()
+	if err := metricsCache.RefreshCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", listMetrics)
+	mux.HandleFunc("/metrics/", serveMetrics)
+	mux.HandleFunc("/batch/", serveBatch)
+	server := httptest.NewServer(mux)
+
+	return server, func() {
+		server.Close()
+		metricsCache.RefreshCache() // wait for stray refreshes
+		metrics.Prefix = oldPrefix
+		os.RemoveAll(dir)
+	}
+}
+
+// getList fetches /metrics with the given query and returns the list of
+// metrics.  ok is false if the cache was unavailable.
+func getList(t *testing.T, server *httptest.Server, query string) ([]string, bool) {
+	resp, err := http.Get(server.URL + "/metrics" + query)
+	if err != nil {
+		t.Error(err)
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusAccepted {
+		return nil, false
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /metrics%s returned %s", query, resp.Status)
+		return nil, false
+	}
+
+	list := make([]string, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Error(err)
+		return nil, false
+	}
+	return list, true
+}
+
+func TestListMetrics(t *testing.T) {
+	server, cleanup := setupTestServer(t, 20)
+	defer cleanup()
+
+	list, ok := getList(t, server, "")
+	if !ok || len(list) != 20 {
+		t.Fatalf("Expected 20 metrics, got %d: %v", len(list), list)
+	}
+	list, ok = getList(t, server, "?regex=metric1")
+	if !ok || len(list) != 11 {
+		t.Errorf("Expected 11 metrics matching regex, got %d: %v", len(list), list)
+	}
+	list, ok = getList(t, server, "?glob=test.metric1?")
+	if !ok || len(list) != 10 {
+		t.Errorf("Expected 10 metrics matching glob, got %d: %v", len(list), list)
+	}
+	list, ok = getList(t, server, "?glob=test.metric%7B3,1%5B0-1%5D%7D")
+	if !ok || len(list) != 3 {
+		t.Errorf("Expected 3 metrics matching glob, got %d: %v", len(list), list)
+	}
+}
+
+func TestListMetricsPaged(t *testing.T) {
+	server, cleanup := setupTestServer(t, 25)
+	defer cleanup()
+
+	seen := make([]string, 0)
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		u := server.URL + "/metrics?format=ndjson&limit=10&cursor=" + cursor
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get("Content-Type") != metrics.NDJSON {
+			t.Errorf("Content-Type is %s", resp.Header.Get("Content-Type"))
+		}
+		dec := json.NewDecoder(resp.Body)
+		n := 0
+		for dec.More() {
+			var m string
+			if err := dec.Decode(&m); err != nil {
+				t.Fatal(err)
+			}
+			if m <= cursor {
+				t.Errorf("Metric %s returned after cursor %s", m, cursor)
+			}
+			seen = append(seen, m)
+			cursor = m
+			n++
+		}
+		resp.Body.Close()
+		if n < 10 {
+			break
+		}
+	}
+	if len(seen) != 25 {
+		t.Errorf("Expected 25 metrics over all pages, got %d: %v", len(seen), seen)
+	}
+
+	list, ok := getList(t, server, "?prefix=test.metric2")
+	if !ok || len(list) != 6 {
+		t.Errorf("Expected 6 metrics with prefix, got %v", list)
+	}
+}
+
+func TestConcurrentListForceDelete(t *testing.T) {
+	server, cleanup := setupTestServer(t, 50)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				getList(t, server, "?regex=test")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				getList(t, server, "?force=true")
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i += 2 {
+			u := fmt.Sprintf("%s/metrics/test.metric%d", server.URL, i)
+			r, _ := http.NewRequest("DELETE", u, nil)
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("DELETE %s returned %s", u, resp.Status)
+			}
+		}
+	}()
+	wg.Wait()
+
+	metricsCache.RefreshCache()
+	list, ok := getList(t, server, "")
+	if !ok || len(list) != 25 {
+		t.Errorf("Expected 25 metrics after deletes, got %d: %v", len(list), list)
+	}
+}
+
+func TestInstanceRoots(t *testing.T) {
+	server, cleanup := setupTestServer(t, 0)
+	defer cleanup()
+	defer func() { metrics.InstancePrefixes = make(metrics.PrefixMap) }()
+
+	metrics.InstancePrefixes.Set("a=" + filepath.Join(tmpDir, "a"))
+	metrics.InstancePrefixes.Set("b=" + filepath.Join(tmpDir, "b"))
+	hashring.Nodes = []hashing.Node{
+		hashing.NewNode("test", 0, "a"),
+		hashing.NewNode("test", 0, "b"),
+		hashing.NewNode("other", 0, "a"),
+	}
+	ring, _ = hashring.HashRing()
+	if err := checkInstanceRoots(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find one metric owned by each local instance
+	owned := make(map[string]string)
+	for i := 0; len(owned) < 2 && i < 1000; i++ {
+		m := fmt.Sprintf("instance.metric%d", i)
+		if instance, ok := ownerInstance(m); ok && owned[instance] == "" {
+			owned[instance] = m
+		}
+	}
+	if len(owned) != 2 {
+		t.Fatalf("Could not find metrics owned by both instances: %v", owned)
+	}
+
+	retentions, _ := whisper.ParseRetentionDefs("1m:30m")
+	for instance, m := range owned {
+		path := metricPath(m)
+		root, _ := metrics.InstanceRoot(instance)
+		if path != metrics.MetricToRootPath(root, m) {
+			t.Errorf("Metric %s for instance %s mapped to %s", m, instance, path)
+		}
+		os.MkdirAll(filepath.Dir(path), 0755)
+		wsp, err := whisper.Create(path, retentions, whisper.Sum, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wsp.Close()
+
+		resp, err := http.Head(server.URL + "/metrics/" + m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("HEAD %s returned %s", m, resp.Status)
+		}
+	}
+
+	metricsCache.RefreshCache()
+	list, ok := getList(t, server, "")
+	if !ok || len(list) != 2 {
+		t.Errorf("Expected a metric from each instance, got %v", list)
+	}
+}
+
+func TestListMetricsStatFilters(t *testing.T) {
+	server, cleanup := setupTestServer(t, 10)
+	defer cleanup()
+
+	// Age the first three metrics by 100 days
+	old := time.Now().Add(-100 * 24 * time.Hour)
+	for i := 0; i < 3; i++ {
+		path := metrics.MetricToPath(fmt.Sprintf("test.metric%d", i))
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Grow one metric with a longer retention
+	retentions, _ := whisper.ParseRetentionDefs("1m:1d")
+	path := metrics.MetricToPath("test.large")
+	wsp, err := whisper.Create(path, retentions, whisper.Sum, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsp.Close()
+	metricsCache.RefreshCache()
+
+	list, ok := getList(t, server, "?older_than=90d")
+	if !ok || len(list) != 3 {
+		t.Errorf("Expected 3 metrics older than 90d, got %v", list)
+	}
+	list, ok = getList(t, server, "?newer_than=90d&prefix=test.metric")
+	if !ok || len(list) != 7 {
+		t.Errorf("Expected 7 metrics newer than 90d, got %v", list)
+	}
+	list, ok = getList(t, server, "?min_size=4K")
+	if !ok || len(list) != 1 || list[0] != "test.large" {
+		t.Errorf("Expected only test.large at least 4K, got %v", list)
+	}
+	list, ok = getList(t, server, "?max_size=4K&older_than=90d")
+	if !ok || len(list) != 3 {
+		t.Errorf("Expected 3 small and old metrics, got %v", list)
+	}
+
+	resp, err := http.Get(server.URL + "/metrics?older_than=ninety")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Invalid age returned %s", resp.Status)
+	}
+}
+
+func TestListMetricsNoDataSince(t *testing.T) {
+	server, cleanup := setupTestServer(t, 3)
+	defer cleanup()
+
+	retentions, _ := whisper.ParseRetentionDefs("1m:30m")
+	now := int(time.Now().Unix())
+	for _, m := range []string{"test.empty", "test.stale"} {
+		wsp, err := whisper.Create(metrics.MetricToPath(m), retentions, whisper.Sum, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == "test.stale" {
+			wsp.Update(1, now-20*60)
+		}
+		wsp.Close()
+	}
+	// Selected by modification time without reading the data
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(metrics.MetricToPath("test.metric0"), old, old)
+	metricsCache.RefreshCache()
+
+	list, ok := getList(t, server, "?no_data_since=10m")
+	expected := []string{"test.empty", "test.metric0", "test.stale"}
+	if !ok || fmt.Sprint(list) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v with no data in 10m, got %v", expected, list)
+	}
+	list, ok = getList(t, server, "?no_data_since=25m")
+	expected = []string{"test.empty", "test.metric0"}
+	if !ok || fmt.Sprint(list) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v with no data in 25m, got %v", expected, list)
+	}
+}
+
+// sendMetric uploads data as the whisper DB for metric with the given
+// method and returns the status code.  size is sent in X-Metric-Stat.
+func sendMetric(t *testing.T, server *httptest.Server, method, metric string, data []byte, size int64) int {
+	r, err := http.NewRequest(method, server.URL+"/metrics/"+metric, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := json.Marshal(&metrics.MetricData{Name: metric, Size: size})
+	r.Header.Set("Content-Type", "application/octet-stream")
+	r.Header.Set("X-Metric-Stat", string(blob))
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPutMetricAtomic(t *testing.T) {
+	server, cleanup := setupTestServer(t, 2)
+	defer cleanup()
+
+	path := metrics.MetricToPath("test.metric0")
+	original, _ := ioutil.ReadFile(path)
+	replacement, _ := ioutil.ReadFile(metrics.MetricToPath("test.metric1"))
+
+	// Truncated uploads leave the original in place
+	status := sendMetric(t, server, "PUT", "test.metric0", replacement[:100], int64(len(replacement)))
+	if status != http.StatusBadRequest {
+		t.Errorf("Truncated PUT returned %d", status)
+	}
+	// As do uploads that are not whisper data
+	garbage := make([]byte, len(replacement))
+	status = sendMetric(t, server, "PUT", "test.metric0", garbage, int64(len(garbage)))
+	if status != http.StatusBadRequest {
+		t.Errorf("PUT of garbage returned %d", status)
+	}
+	if data, _ := ioutil.ReadFile(path); !bytes.Equal(data, original) {
+		t.Errorf("Failed PUT modified the metric")
+	}
+
+	os.Chmod(path, 0640)
+	status = sendMetric(t, server, "PUT", "test.metric0", replacement, int64(len(replacement)))
+	if status != http.StatusOK {
+		t.Errorf("PUT returned %d", status)
+	}
+	if data, _ := ioutil.ReadFile(path); !bytes.Equal(data, replacement) {
+		t.Errorf("PUT did not replace the metric")
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0640 {
+		t.Errorf("PUT changed the mode of the metric to %s", fi.Mode())
+	}
+
+	// POST creates new metrics
+	status = sendMetric(t, server, "POST", "test.new", replacement, int64(len(replacement)))
+	if status != http.StatusOK {
+		t.Errorf("POST returned %d", status)
+	}
+	if data, _ := ioutil.ReadFile(metrics.MetricToPath("test.new")); !bytes.Equal(data, replacement) {
+		t.Errorf("POST did not create the metric")
+	}
+	if fi, _ := os.Stat(metrics.MetricToPath("test.new")); fi.Mode().Perm() != metricMode {
+		t.Errorf("POST created the metric with mode %s", fi.Mode())
+	}
+
+	// No temp files are left behind
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".wsp" {
+			t.Errorf("Found stray file %s", f.Name())
+		}
+	}
+}
+
+func TestHealMetricValidation(t *testing.T) {
+	server, cleanup := setupTestServer(t, 1)
+	defer cleanup()
+
+	good, _ := ioutil.ReadFile(metrics.MetricToPath("test.metric0"))
+	bad := append([]byte{}, good...)
+	bad[19]++ // Offset of the first archive
+
+	for _, method := range []string{"PUT", "POST"} {
+		for _, m := range []string{"test.metric0", "test.new"} {
+			status := sendMetric(t, server, method, m, bad, int64(len(bad)))
+			if status != http.StatusBadRequest {
+				t.Errorf("%s of a corrupt header to %s returned %d", method, m, status)
+			}
+			status = sendMetric(t, server, method, m, good, int64(len(good))-1)
+			if status != http.StatusBadRequest {
+				t.Errorf("%s with the wrong size to %s returned %d", method, m, status)
+			}
+		}
+	}
+	if _, err := os.Stat(metrics.MetricToPath("test.new")); err == nil {
+		t.Errorf("Corrupt upload created a metric")
+	}
+	if data, _ := ioutil.ReadFile(metrics.MetricToPath("test.metric0")); !bytes.Equal(data, good) {
+		t.Errorf("Corrupt upload modified a metric")
+	}
+
+	// The reason is reported to the client
+	r, _ := http.NewRequest("PUT", server.URL+"/metrics/test.metric0", bytes.NewReader(bad))
+	blob, _ := json.Marshal(&metrics.MetricData{Name: "test.metric0", Size: int64(len(bad))})
+	r.Header.Set("Content-Type", "application/octet-stream")
+	r.Header.Set("X-Metric-Stat", string(blob))
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Contains(msg, []byte("Archive 0 starts at offset")) {
+		t.Errorf("Unexpected error message: %s", msg)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+import "github.com/jjneely/buckytools/auth"
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// peerScheme is the URL scheme used to reach the other buckyd daemons.
+var peerScheme = "http"
+
+// peerClient is the HTTP client that pushes metrics to the other buckyd
+// daemons.
+var peerClient = http.DefaultClient
+
+// setupPeerClient builds peerClient from the credentials file and TLS
+// files.  Either of caFile or useTLS switches to HTTPS.  The certificate
+// and key, if given, are presented as the client certificate.
+func setupPeerClient(authFile, caFile, certFile, keyFile string, useTLS bool) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if useTLS || caFile != "" {
+		peerScheme = "https"
+		config := new(tls.Config)
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return fmt.Errorf("Error reading peer CA bundle: %s", err)
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("No certificates found in %s", caFile)
+			}
+		}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return fmt.Errorf("Error loading client certificate: %s", err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		transport.TLSClientConfig = config
+	}
+
+	peerClient = &http.Client{Transport: transport}
+	if authFile != "" {
+		token, key, err := auth.ReadClientFile(authFile)
+		if err != nil {
+			return fmt.Errorf("Error reading peer credentials: %s", err)
+		}
+		peerClient.Transport = &auth.Transport{Base: transport, Token: token, Key: key}
+	}
+	return nil
+}
+
+// isPeer returns true if the host of the HOST:PORT dest is a node of the
+// hash ring.  Metrics are only pushed to peers.
+func isPeer(dest string) bool {
+	host, _, err := net.SplitHostPort(dest)
+	if err != nil {
+		return false
+	}
+	for _, n := range hashring.Nodes {
+		if n.Server == host {
+			return true
+		}
+	}
+	return false
+}
+
+// servePush pushes each local metric listed in the body of a POST to the
+// buckyd daemon given by the dest parameter, which backfills them, and
+// streams back a BatchResult for each as NDJSON.  The list holds PushItems
+// either as NDJSON or a JSON array.
+func servePush(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != "POST" {
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+	dest := r.URL.Query().Get("dest")
+	if !isPeer(dest) {
+		http.Error(w, "Destination is not in the hash ring.", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > listMaxBytes {
+		msg := fmt.Sprintf("Query larger than %d bytes", listMaxBytes)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, listMaxBytes)
+
+	items := make([]PushItem, 0)
+	dec := json.NewDecoder(r.Body)
+	var err error
+	if isNDJSON(r.Header.Get("Content-Type")) {
+		for dec.More() {
+			var item PushItem
+			if err = dec.Decode(&item); err != nil {
+				break
+			}
+			items = append(items, item)
+		}
+	} else {
+		err = dec.Decode(&items)
+	}
+	if err != nil {
+		http.Error(w, "Invalid push list: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", NDJSON)
+	enc := json.NewEncoder(w)
+	for _, item := range items {
+		// Unbuffered so the client sees each metric as it completes
+		if err := enc.Encode(pushMetric(dest, item)); err != nil {
+			log.Printf("Error writing push results: %s", err)
+			return
+		}
+	}
+}
+
+// pushMetric backfills the metric into dest.  The metric is locked while
+// it is read and compressed but not while it is sent.
+func pushMetric(dest string, item PushItem) *BatchResult {
+	path := findMetric(item.Name)
+	stat, err := statMetric(item.Name, path)
+	if err != nil {
+		return batchError(item.Name, err)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return batchError(item.Name, err)
+	}
+	err = flock(fd)
+	if err != nil {
+		fd.Close()
+		return batchError(item.Name, err)
+	}
+	blob, err := copySnappy(fd)
+	fd.Close()
+	if err != nil {
+		return batchError(item.Name, err)
+	}
+
+	if item.NewName != "" {
+		stat.Name = item.NewName
+	}
+	stat.Encoding = EncSnappy
+	header, err := json.Marshal(stat)
+	if err != nil {
+		return batchError(item.Name, err)
+	}
+	u := &url.URL{
+		Scheme: peerScheme,
+		Host:   dest,
+		Path:   "/metrics/" + stat.Name,
+	}
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(blob.Bytes()))
+	if err != nil {
+		return batchError(item.Name, err)
+	}
+	req.Header.Set("X-Metric-Stat", string(header))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "snappy")
+
+	// This doesn't return until the backfill operation completes
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		log.Printf("Error pushing %s to %s: %s", item.Name, dest, err)
+		return &BatchResult{Name: item.Name, Status: http.StatusBadGateway,
+			Error: err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("Error pushing %s to %s: %s", item.Name, dest, resp.Status)
+		return &BatchResult{Name: item.Name, Status: http.StatusBadGateway,
+			Error: fmt.Sprintf("%s returned %s: %s", dest, resp.Status,
+				strings.TrimSpace(string(msg)))}
+	}
+	return &BatchResult{Name: item.Name, Status: http.StatusOK}
+}
+
+// digestPeer digests the datapoints of the metric in item on dest.
+func digestPeer(dest string, item *BatchItem) (*MetricDigest, error) {
+	body, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	u := &url.URL{
+		Scheme: peerScheme,
+		Host:   dest,
+		Path:   "/batch/digest",
+	}
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", NDJSON)
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", dest, resp.Status)
+	}
+	result := new(BatchResult)
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	if result.Status != http.StatusOK || result.Digest == nil {
+		return nil, fmt.Errorf("%s returned %d: %s", dest, result.Status, result.Error)
+	}
+	return result.Digest, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+import "github.com/jjneely/buckytools/metrics"
+
+func TestServePush(t *testing.T) {
+	server, cleanup := setupTestServer(t, 2)
+	defer cleanup()
+	u, _ := url.Parse(server.URL)
+	hashring.Nodes = append(hashring.Nodes, hashing.NewNode("127.0.0.1", 0, ""))
+
+	push := func(dest, body string) (int, []metrics.BatchResult) {
+		r := httptest.NewRequest("POST", "/push?dest="+dest, strings.NewReader(body))
+		r.Header.Set("Content-Type", metrics.NDJSON)
+		w := httptest.NewRecorder()
+		servePush(w, r)
+		results := make([]metrics.BatchResult, 0)
+		dec := json.NewDecoder(w.Body)
+		for w.Code == http.StatusOK && dec.More() {
+			var result metrics.BatchResult
+			if err := dec.Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, result)
+		}
+		return w.Code, results
+	}
+
+	status, results := push(u.Host, `{"Name": "test.metric0", "NewName": "test.copy0"}
+{"Name": "test.missing"}
+`)
+	if status != http.StatusOK || len(results) != 2 {
+		t.Fatalf("Push returned %d: %v", status, results)
+	}
+	if results[0].Status != http.StatusOK || results[1].Status != http.StatusNotFound {
+		t.Errorf("Unexpected push results: %v", results)
+	}
+	src, _ := ioutil.ReadFile(metrics.MetricToPath("test.metric0"))
+	dst, err := ioutil.ReadFile(metrics.MetricToPath("test.copy0"))
+	if err != nil || string(src) != string(dst) {
+		t.Errorf("Pushed metric is missing or differs: %v", err)
+	}
+
+	// Pushing again backfills the existing copy
+	status, results = push(u.Host, `{"Name": "test.metric1", "NewName": "test.copy0"}`+"\n")
+	if status != http.StatusOK || len(results) != 1 || results[0].Status != http.StatusOK {
+		t.Errorf("Backfill push returned %d: %v", status, results)
+	}
+
+	if status, _ = push("elsewhere:4242", `{"Name": "test.metric0"}`); status != http.StatusBadRequest {
+		t.Errorf("Push to a host outside the ring returned %d", status)
+	}
+}
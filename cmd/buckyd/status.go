@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+import "github.com/jjneely/buckytools"
+import . "github.com/jjneely/buckytools/metrics"
+
+// startTime is when buckyd started.
+var startTime = time.Now()
+
+// rootStatus returns the disk usage of the file system holding root.
+func rootStatus(root string) (RootStatus, error) {
+	var fs syscall.Statfs_t
+	status := RootStatus{Path: root}
+	if err := syscall.Statfs(root, &fs); err != nil {
+		return status, err
+	}
+	status.Total = int64(fs.Blocks) * int64(fs.Bsize)
+	status.Free = int64(fs.Bavail) * int64(fs.Bsize)
+	status.Inodes = int64(fs.Files)
+	status.FreeInodes = int64(fs.Ffree)
+	return status, nil
+}
+
+// serverStatus builds the status of this daemon.
+func serverStatus(now time.Time) (*ServerStatus, error) {
+	status := &ServerStatus{
+		Name:         hashring.Name,
+		Version:      buckytools.Version,
+		Uptime:       int64(now.Sub(startTime).Seconds()),
+		Roots:        make([]RootStatus, 0),
+		CacheAge:     -1,
+		CacheTimeOut: CacheTimeOut,
+		Refreshing:   metricsCache.Refreshing(),
+	}
+	for _, root := range Roots() {
+		rs, err := rootStatus(root)
+		if err != nil {
+			return nil, err
+		}
+		status.Roots = append(status.Roots, rs)
+	}
+	if idx := metricsCache.Snapshot(); idx != nil {
+		status.Metrics = len(idx.Metrics)
+		status.CacheAge = now.Unix() - idx.Timestamp
+	}
+	return status, nil
+}
+
+// serveStatus sends the status of this daemon as JSON.
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request.", http.StatusBadRequest)
+		return
+	}
+
+	status, err := serverStatus(time.Now())
+	if err != nil {
+		log.Printf("Error building status: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error marshalling data: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools"
+import "github.com/jjneely/buckytools/metrics"
+
+func TestServeStatus(t *testing.T) {
+	_, cleanup := setupTestServer(t, 4)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	serveStatus(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != 200 {
+		t.Fatalf("GET /status returned %d: %s", w.Code, w.Body)
+	}
+	status := new(metrics.ServerStatus)
+	if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Name != "test" || status.Version != buckytools.Version {
+		t.Errorf("Unexpected name or version: %+v", status)
+	}
+	if status.Metrics != 4 || status.CacheAge < 0 || status.CacheAge > 60 || status.Refreshing {
+		t.Errorf("Unexpected cache status: %+v", status)
+	}
+	if len(status.Roots) != 1 || status.Roots[0].Path != metrics.Prefix {
+		t.Fatalf("Unexpected roots: %+v", status.Roots)
+	}
+	root := status.Roots[0]
+	if root.Total <= 0 || root.Free < 0 || root.Free > root.Total || root.FreeInodes > root.Inodes {
+		t.Errorf("Unexpected disk usage: %+v", root)
+	}
+
+	metricsCache = metrics.NewMetricsCache()
+	s, err := serverStatus(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CacheAge != -1 || s.Metrics != 0 {
+		t.Errorf("Status without a cache: %+v", s)
+	}
+
+	w = httptest.NewRecorder()
+	serveStatus(w, httptest.NewRequest("POST", "/status", nil))
+	if w.Code != 400 {
+		t.Errorf("POST /status returned %d", w.Code)
+	}
+}
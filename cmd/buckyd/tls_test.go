@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert creates a certificate signed by parent, or self signed if
+// parent is nil, and writes it and its key as PEM files in dir.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buckyd_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	writeCert(t, dir, "rogue", nil, nil)
+
+	config, err := serverTLSConfig(file("server.pem"), file("server.key"), file("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	get := func(client string) error {
+		config := &tls.Config{RootCAs: roots}
+		if client != "" {
+			cert, err := tls.LoadX509KeyPair(file(client+".pem"), file(client+".key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := c.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get("client"); err != nil {
+		t.Errorf("Client certificate signed by the CA was refused: %s", err)
+	}
+	if err := get(""); err == nil {
+		t.Errorf("Connection without a client certificate was accepted")
+	}
+	if err := get("rogue"); err == nil {
+		t.Errorf("Client certificate from another CA was accepted")
+	}
+
+	if _, err := serverTLSConfig(file("server.pem"), file("server.key"), file("server.key")); err == nil {
+		t.Errorf("CA bundle without certificates was accepted")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// TrashDir is the directory in each whisper store that deleted metrics
+// are moved to when trash mode is on.  It is a dot-directory so the
+// metric scan skips it.
+const TrashDir = ".trash"
+
+// trashDateFormat names the per day directories in TrashDir.
+const trashDateFormat = "2006-01-02"
+
+// trashEnabled moves deleted metrics to the trash rather than removing
+// them.
+var trashEnabled bool
+
+// trashRetention is how long in seconds deleted metrics are kept.
+var trashRetention int64
+
+// trashItem is a TrashEntry with the location of its file.
+type trashItem struct {
+	TrashEntry
+	root string
+	path string
+}
+
+// storeRoot returns the whisper store root that holds path and path
+// relative to it.
+func storeRoot(path string) (string, string, error) {
+	best := ""
+	for _, root := range Roots() {
+		if strings.HasPrefix(path, root+"/") && len(root) > len(best) {
+			best = root
+		}
+	}
+	if best == "" {
+		return "", "", fmt.Errorf("%s is not in a whisper store", path)
+	}
+	return best, path[len(best)+1:], nil
+}
+
+// trashMetric moves the metric at path into today's trash directory of
+// the store holding it.  A metric deleted twice in a day replaces the
+// earlier copy.
+func trashMetric(path string) error {
+	root, rel, err := storeRoot(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	dst := filepath.Join(root, TrashDir, time.Now().Format(trashDateFormat), rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, dst)
+}
+
+// findTrash returns the items in the trash selected by match and date,
+// if not empty, sorted by name and then date.
+func findTrash(match func(string) bool, date string) ([]*trashItem, error) {
+	items := make([]*trashItem, 0)
+	for _, root := range Roots() {
+		days, err := ioutil.ReadDir(filepath.Join(root, TrashDir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, day := range days {
+			if !day.IsDir() || (date != "" && day.Name() != date) {
+				continue
+			}
+			dir := filepath.Join(root, TrashDir, day.Name())
+			err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() || !strings.HasSuffix(p, ".wsp") {
+					return err
+				}
+				name := RelativeToMetric(strings.TrimPrefix(p[len(dir):], "/"))
+				if !match(name) {
+					return nil
+				}
+				items = append(items, &trashItem{
+					TrashEntry: TrashEntry{
+						Name:    name,
+						Date:    day.Name(),
+						Size:    info.Size(),
+						ModTime: info.ModTime().Unix(),
+					},
+					root: root,
+					path: p,
+				})
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Name != items[j].Name {
+			return items[i].Name < items[j].Name
+		}
+		return items[i].Date < items[j].Date
+	})
+	return items, nil
+}
+
+// purgeTrash removes the trash of each day that is wholly older than the
+// retention.
+func purgeTrash(now time.Time) {
+	cutoff := now.Add(-time.Duration(trashRetention) * time.Second)
+	for _, root := range Roots() {
+		days, err := ioutil.ReadDir(filepath.Join(root, TrashDir))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Error reading trash: %s", err)
+			}
+			continue
+		}
+		for _, day := range days {
+			t, err := time.ParseInLocation(trashDateFormat, day.Name(), time.Local)
+			if err != nil || t.AddDate(0, 0, 1).After(cutoff) {
+				continue
+			}
+			dir := filepath.Join(root, TrashDir, day.Name())
+			log.Printf("Purging trash %s", dir)
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("Error purging trash: %s", err)
+			}
+		}
+	}
+}
+
+// trashPurger periodically purges expired trash.  It never returns.
+func trashPurger() {
+	for {
+		purgeTrash(time.Now())
+		time.Sleep(time.Hour)
+	}
+}
+
+// serveTrash lists the trash on GET /trash and restores or purges a
+// metric with POST or DELETE on /trash/<metric.key>.
+func serveTrash(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	metric := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/trash"), "/")
+	date := r.FormValue("date")
+	if date != "" {
+		if _, err := time.Parse(trashDateFormat, date); err != nil {
+			http.Error(w, "Invalid date, use YYYY-MM-DD.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case metric == "" && r.Method == "GET":
+		listTrash(w, r, date)
+	case metric != "" && r.Method == "POST":
+		restoreTrash(w, r, metric, date)
+	case metric != "" && r.Method == "DELETE":
+		deleteTrash(w, metric, date)
+	default:
+		http.Error(w, "Bad method request.", http.StatusBadRequest)
+	}
+}
+
+// listTrash sends the trash entries matching the regex parameter as a
+// JSON array.
+func listTrash(w http.ResponseWriter, r *http.Request, date string) {
+	match := func(string) bool { return true }
+	if r.FormValue("regex") != "" {
+		regex, err := regexp.Compile(r.FormValue("regex"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		match = regex.MatchString
+	}
+
+	items, err := findTrash(match, date)
+	if err != nil {
+		log.Printf("Error listing trash: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries := make([]TrashEntry, len(items))
+	for i, item := range items {
+		entries[i] = item.TrashEntry
+	}
+	blob, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+}
+
+// trashedMetric returns the trash items of metric deleted on date, or on
+// any day if date is empty.  Errors are reported to the client.
+func trashedMetric(w http.ResponseWriter, metric, date string) ([]*trashItem, error) {
+	key := HashKey(metric)
+	items, err := findTrash(func(m string) bool { return m == key }, date)
+	if err != nil {
+		log.Printf("Error reading trash: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	if len(items) == 0 {
+		http.Error(w, "Metric not found in trash.", http.StatusNotFound)
+		return nil, fmt.Errorf("Metric not found in trash")
+	}
+	return items, nil
+}
+
+// restoreTrash moves the most recently deleted copy of the metric back
+// into the store it was deleted from.  An existing metric, in any store,
+// is only replaced if the force parameter is set.
+func restoreTrash(w http.ResponseWriter, r *http.Request, metric, date string) {
+	items, err := trashedMetric(w, metric, date)
+	if err != nil {
+		return
+	}
+	item := items[len(items)-1]
+	force := r.FormValue("force") != ""
+
+	dst := MetricToRootPath(item.root, item.Name)
+	path := findMetric(item.Name)
+	if _, err := os.Stat(path); err == nil {
+		if !force {
+			http.Error(w, "Metric exists, use force to replace it.", http.StatusConflict)
+			return
+		}
+		// Replace the metric where it is rather than leave two copies
+		dst = path
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err == nil && force {
+		err = os.Rename(item.path, dst)
+	} else if err == nil {
+		// Link rather than rename so a metric created since the
+		// check above is not clobbered
+		err = os.Link(item.path, dst)
+		if os.IsExist(err) {
+			http.Error(w, "Metric exists, use force to replace it.", http.StatusConflict)
+			return
+		}
+		if err == nil {
+			err = os.Remove(item.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error restoring %s: %s", item.path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("RESTORED: %s from %s", item.Name, item.Date)
+
+	blob, _ := json.Marshal(item.TrashEntry)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+}
+
+// deleteTrash permanently removes the trashed copies of the metric.
+func deleteTrash(w http.ResponseWriter, metric, date string) {
+	items, err := trashedMetric(w, metric, date)
+	if err != nil {
+		return
+	}
+	for _, item := range items {
+		if err := os.Remove(item.path); err != nil {
+			log.Printf("Error purging %s: %s", item.path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("PURGED: %s from %s", item.Name, item.Date)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestTrash(t *testing.T) {
+	_, cleanup := setupTestServer(t, 3)
+	defer cleanup()
+	trashEnabled = true
+	defer func() { trashEnabled = false }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics/", serveMetrics)
+	mux.HandleFunc("/trash", serveTrash)
+	mux.HandleFunc("/trash/", serveTrash)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	do := func(method, path string) *http.Response {
+		r, _ := http.NewRequest(method, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	list := func(query string) []metrics.TrashEntry {
+		resp := do("GET", "/trash"+query)
+		defer resp.Body.Close()
+		entries := make([]metrics.TrashEntry, 0)
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	path := metrics.MetricToPath("test.metric1")
+	for _, m := range []string{"test.metric1", "test.metric2"} {
+		if resp := do("DELETE", "/metrics/"+m); resp.StatusCode != http.StatusOK {
+			t.Fatalf("DELETE %s returned %s", m, resp.Status)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Deleted metric still exists")
+	}
+
+	entries := list("")
+	today := time.Now().Format(trashDateFormat)
+	if len(entries) != 2 || entries[0].Name != "test.metric1" || entries[0].Date != today {
+		t.Fatalf("Unexpected trash entries: %v", entries)
+	}
+	if entries := list("?regex=metric2"); len(entries) != 1 {
+		t.Errorf("Expected 1 entry matching regex, got %v", entries)
+	}
+
+	if resp := do("POST", "/trash/test.metric1"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Restore returned %s", resp.Status)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Restored metric missing: %s", err)
+	}
+	if resp := do("POST", "/trash/test.metric1"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Second restore returned %s", resp.Status)
+	}
+
+	// Restores do not clobber existing metrics without force
+	do("DELETE", "/metrics/test.metric1")
+	f, _ := os.Create(path)
+	f.Close()
+	if resp := do("POST", "/trash/test.metric1"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Restore over an existing metric returned %s", resp.Status)
+	}
+	if resp := do("POST", "/trash/test.metric1?force=true"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Forced restore returned %s", resp.Status)
+	}
+
+	if resp := do("DELETE", "/trash/test.metric2?date="+today); resp.StatusCode != http.StatusOK {
+		t.Errorf("Purge returned %s", resp.Status)
+	}
+	if entries := list(""); len(entries) != 0 {
+		t.Errorf("Trash not empty after restore and purge: %v", entries)
+	}
+	if resp := do("GET", "/trash?date=yesterday"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Invalid date returned %s", resp.Status)
+	}
+
+	// Expired days are removed
+	trashRetention = 7 * 86400
+	old := filepath.Join(metrics.Prefix, TrashDir, time.Now().AddDate(0, 0, -9).Format(trashDateFormat))
+	recent := filepath.Join(metrics.Prefix, TrashDir, time.Now().AddDate(0, 0, -6).Format(trashDateFormat))
+	os.MkdirAll(old, 0755)
+	os.MkdirAll(recent, 0755)
+	purgeTrash(time.Now())
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Expired trash was not purged")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("Trash within the retention was purged")
+	}
+}
+
+func TestRestoreTrashOtherStore(t *testing.T) {
+	_, cleanup := setupTestServer(t, 0)
+	defer cleanup()
+	defer func() { metrics.InstancePrefixes = make(metrics.PrefixMap) }()
+
+	a, b := filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b")
+	metrics.InstancePrefixes.Set("a=" + a)
+	metrics.InstancePrefixes.Set("b=" + b)
+	write := func(path string, data string) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restore := func(query string) int {
+		w := httptest.NewRecorder()
+		serveTrash(w, httptest.NewRequest("POST", "/trash/test.metric"+query, nil))
+		return w.Code
+	}
+
+	// The metric was deleted from store a and has since been created in b
+	today := time.Now().Format(trashDateFormat)
+	trashed := filepath.Join(a, TrashDir, today, "test", "metric.wsp")
+	live := metrics.MetricToRootPath(b, "test.metric")
+	write(trashed, "trashed")
+	write(live, "live")
+
+	if code := restore(""); code != http.StatusConflict {
+		t.Errorf("Restore over a metric in another store returned %d", code)
+	}
+	if _, err := os.Stat(metrics.MetricToRootPath(a, "test.metric")); !os.IsNotExist(err) {
+		t.Errorf("Restore without force created a second copy")
+	}
+	if code := restore("?force=true"); code != http.StatusOK {
+		t.Errorf("Forced restore returned %d", code)
+	}
+	if data, _ := ioutil.ReadFile(live); string(data) != "trashed" {
+		t.Errorf("Forced restore left %q in place", data)
+	}
+	if _, err := os.Stat(metrics.MetricToRootPath(a, "test.metric")); !os.IsNotExist(err) {
+		t.Errorf("Forced restore created a second copy")
+	}
+
+	// Without a live metric the trashed copy goes back to its own store
+	os.Remove(live)
+	write(trashed, "trashed")
+	if code := restore(""); code != http.StatusOK {
+		t.Errorf("Restore returned %d", code)
+	}
+	if data, _ := ioutil.ReadFile(metrics.MetricToRootPath(a, "test.metric")); string(data) != "trashed" {
+		t.Errorf("Restored metric holds %q", data)
+	}
+	if _, err := os.Stat(trashed); !os.IsNotExist(err) {
+		t.Errorf("Restored metric left in the trash")
+	}
+}
@@ -41,3 +41,21 @@ func FindValidDataPoints(wsp *whisper.Whisper) ([]*whisper.TimeSeriesPoint, int,
 
 	return points, count, nil
 }
+
+// LastValidDataPoint returns the Unix timestamp of the most recent valid
+// data point in the Whisper database or 0 if there are no valid data
+// points.
+func LastValidDataPoint(wsp *whisper.Whisper) (int, error) {
+	points, _, err := FindValidDataPoints(wsp)
+	if err != nil {
+		return 0, err
+	}
+
+	last := 0
+	for _, p := range points {
+		if p.Time > last {
+			last = p.Time
+		}
+	}
+	return last, nil
+}
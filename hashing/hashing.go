@@ -58,6 +58,28 @@ type HashRing interface {
 	Nodes() []Node
 }
 
+// ReplicaNodes returns the nodes that store key when each key is stored
+// on replicas servers.  As with carbon's diverse replicas, nodes on a
+// server already chosen are skipped so the replicas land on distinct
+// servers.
+func ReplicaNodes(ring HashRing, key string, replicas int) []Node {
+	if replicas < 1 {
+		replicas = 1
+	}
+	nodes := make([]Node, 0, replicas)
+	seen := make(map[string]bool)
+	for _, n := range ring.GetNodes(key) {
+		if len(nodes) >= replicas {
+			break
+		}
+		if !seen[n.Server] {
+			seen[n.Server] = true
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
 // RingEntry is used to record the position of Nodes in the ring.  Not used
 // in all implementations.
 type RingEntry struct {
@@ -81,6 +103,33 @@ func (j *JSONRingType) String() string {
 	return string(blob)
 }
 
+// NewHashRing returns an empty HashRing implementing the named algorithm.
+// The replicas value is the replication factor of the cluster which only
+// some algorithms make use of.
+func NewHashRing(algo string, replicas int) (HashRing, error) {
+	switch algo {
+	case "carbon":
+		return NewCarbonHashRing(), nil
+	case "fnv1a":
+		return NewFNV1aHashRing(), nil
+	case "jump_fnv1a":
+		return NewJumpHashRing(replicas), nil
+	}
+	return nil, fmt.Errorf("Unknown consistent hash algorithm: %s", algo)
+}
+
+// HashRing builds the HashRing described by this JSONRingType.
+func (j *JSONRingType) HashRing() (HashRing, error) {
+	ring, err := NewHashRing(j.Algo, j.Replicas)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range j.Nodes {
+		ring.AddNode(n)
+	}
+	return ring, nil
+}
+
 // NewCarbonHashRing sets up a new CarbonHashRing and returns it.
 func NewCarbonHashRing() *CarbonHashRing {
 	var chr = new(CarbonHashRing)
@@ -1,14 +1,18 @@
 package metrics
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +23,10 @@ const (
 	EncMax
 )
 
+// NDJSON is the MIME type of newline delimited JSON used to stream lists
+// of metrics.
+const NDJSON = "application/x-ndjson"
+
 // MetricData represents an individual metric and its raw data.
 type MetricData struct {
 	Name     string
@@ -29,15 +37,268 @@ type MetricData struct {
 	Data     []byte `json:"-"` // We never JSON encode metric data
 }
 
+// TrashEntry describes a deleted metric held in the trash of a buckyd
+// daemon.  Date is the day it was deleted as YYYY-MM-DD.
+type TrashEntry struct {
+	Name    string
+	Date    string
+	Size    int64
+	ModTime int64
+}
+
+// AuditEntry is a record in the audit log of a buckyd daemon.  Time is
+// Unix time, User is the authenticated credential if any and the sizes are
+// those of the metric before and after the request, or -1 if it did not
+// exist.  Status is the HTTP status of the response and Error the message
+// sent with a failure.  Force is set for requests that forced a refresh of
+// the metric cache.
+type AuditEntry struct {
+	Time       int64
+	Client     string
+	User       string `json:",omitempty"`
+	Method     string
+	Path       string
+	Metric     string `json:",omitempty"`
+	Force      bool   `json:",omitempty"`
+	SizeBefore int64
+	SizeAfter  int64
+	Status     int
+	Error      string `json:",omitempty"`
+}
+
+// BatchItem names a metric of a buckyd batch request.  From and Until
+// give the time span of a digest in Unix seconds, overriding those of the
+// request.  A JSON string is read as an item of just the Name.
+type BatchItem struct {
+	Name  string
+	From  int64 `json:",omitempty"`
+	Until int64 `json:",omitempty"`
+}
+
+// UnmarshalJSON reads a metric name or an object of the item's fields.
+func (i *BatchItem) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*i = BatchItem{}
+		return json.Unmarshal(b, &i.Name)
+	}
+	type item BatchItem
+	return json.Unmarshal(b, (*item)(i))
+}
+
+// BatchResult is the outcome for one metric of a buckyd batch request.
+// Status is the HTTP status code the request for the single metric would
+// have returned and Error its message if it failed.  Stat is set by
+// successful stat requests and Digest by digest requests.
+type BatchResult struct {
+	Name   string
+	Status int
+	Error  string        `json:",omitempty"`
+	Stat   *MetricData   `json:",omitempty"`
+	Digest *MetricDigest `json:",omitempty"`
+}
+
+// MetricDigest summarizes the datapoints of each archive of a metric
+// between From and Until, inclusive, so copies of the metric can be
+// compared without transferring them.
+type MetricDigest struct {
+	From     int64
+	Until    int64
+	Archives []ArchiveDigest
+}
+
+// ArchiveDigest summarizes the datapoints of one archive.  Sum is the hex
+// SHA-1 of the timestamp and value of each point that is not null and
+// First and Last are the timestamps of the first and last such point.
+type ArchiveDigest struct {
+	Step   int
+	Points int
+	First  int64 `json:",omitempty"`
+	Last   int64 `json:",omitempty"`
+	Sum    string
+}
+
+// Equal returns true if the digests cover the same archives and points.
+func (d *MetricDigest) Equal(o *MetricDigest) bool {
+	if len(d.Archives) != len(o.Archives) {
+		return false
+	}
+	for i := range d.Archives {
+		if d.Archives[i] != o.Archives[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PointSpan returns the time span of the points of the digest, from the
+// first point of any archive to the end of the interval of the newest.
+// The last interval of a coarser archive, which is still being filled
+// from the newest points, lies outside of it.  ok is false if there are
+// no points.
+func (d *MetricDigest) PointSpan() (from, until int64, ok bool) {
+	var newest int64
+	for _, a := range d.Archives {
+		if a.Points == 0 {
+			continue
+		}
+		if !ok || a.First < from {
+			from = a.First
+		}
+		// Archives are in order of precision so ties keep the finest
+		if !ok || a.Last > newest {
+			newest, until = a.Last, a.Last+int64(a.Step)
+		}
+		ok = true
+	}
+	return from, until, ok
+}
+
+// PushItem names a local metric for a buckyd daemon to push to another
+// and the name it is given there.  An empty NewName keeps the name.
+type PushItem struct {
+	Name    string
+	NewName string `json:",omitempty"`
+}
+
+// The states of a Job.
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// Job is an asynchronous operation run by a buckyd daemon on a list of its
+// metrics.  Type is one of move, delete, fill or resize.  Fill pushes each
+// metric to Dest as /push does and move also deletes the metric once Dest
+// holds the same points.  Move and delete count a metric already gone as
+// done.  Resize rewrites each metric with the Retention given in the
+// format of carbon's storage-schemas.conf.  Done counts the items
+// processed, of which Failed did not succeed, and Error is the last
+// failure.  Times are Unix times.
+type Job struct {
+	ID        string
+	Type      string
+	State     string
+	Client    string     `json:",omitempty"`
+	User      string     `json:",omitempty"`
+	Dest      string     `json:",omitempty"`
+	Retention string     `json:",omitempty"`
+	Items     []PushItem `json:",omitempty"`
+	Total     int
+	Done      int
+	Failed    int
+	Error     string `json:",omitempty"`
+	Created   int64
+	Updated   int64
+}
+
+// ServerStatus is the health of a buckyd daemon as reported by /status.
+// Uptime and CacheAge are in seconds.  CacheAge is -1 if the metric cache
+// has not been built and Metrics is then 0.  CacheTimeOut is the age at
+// which the daemon considers its cache stale.
+type ServerStatus struct {
+	Name         string
+	Version      string
+	Uptime       int64
+	Roots        []RootStatus
+	Metrics      int
+	CacheAge     int64
+	CacheTimeOut int64
+	Refreshing   bool
+}
+
+// RootStatus is the disk usage of the file system holding a whisper
+// store.  Sizes are in bytes.  Free is what is available to buckyd rather
+// than the root user.
+type RootStatus struct {
+	Path       string
+	Total      int64
+	Free       int64
+	Inodes     int64
+	FreeInodes int64
+}
+
+// MetricIndex is an immutable view of the local metric keyspace as found
+// by a single scan of the file system.  Metrics is sorted and Size and
+// ModTime hold the size in bytes and modification time of the metric at
+// the same index as of the scan.  Once published by a MetricsCacheType
+// nothing may modify it, so it can be handed to any number of concurrent
+// readers.
+type MetricIndex struct {
+	Metrics []string
+	Size    []int64
+	ModTime []int64
+
+	// Timestamp is the Unix time the scan completed
+	Timestamp int64
+
+	// Duration is how long the scan took
+	Duration time.Duration
+
+	err error
+}
+
+// Len, Swap and Less sort the index by metric name
+func (idx *MetricIndex) Len() int {
+	return len(idx.Metrics)
+}
+
+func (idx *MetricIndex) Swap(i, j int) {
+	idx.Metrics[i], idx.Metrics[j] = idx.Metrics[j], idx.Metrics[i]
+	idx.Size[i], idx.Size[j] = idx.Size[j], idx.Size[i]
+	idx.ModTime[i], idx.ModTime[j] = idx.ModTime[j], idx.ModTime[i]
+}
+
+func (idx *MetricIndex) Less(i, j int) bool {
+	return idx.Metrics[i] < idx.Metrics[j]
+}
+
+// MetricsCacheType caches the list of metrics found in the local whisper
+// store.  Readers always see a complete snapshot which is replaced as a
+// whole when a refresh finishes.  Only one refresh runs at a time.
 type MetricsCacheType struct {
-	metrics   []string
-	timestamp int64
-	lock      sync.Mutex
-	updating  bool
+	// snapshot holds the current *MetricIndex or nil
+	snapshot atomic.Value
+
+	// lock protects updating and done which implement the single
+	// flight refresh.  done is closed when the running refresh completes.
+	lock     sync.Mutex
+	updating bool
+	done     chan struct{}
 }
 
 var Prefix string
 
+// InstancePrefixes maps the names of hash ring instances on this node to
+// the whisper database store that carbon-cache instance writes to.  When
+// empty all metrics live under Prefix.
+var InstancePrefixes = make(PrefixMap)
+
+// PrefixMap is a flag.Value holding INSTANCE=PATH pairs.
+type PrefixMap map[string]string
+
+// String returns the INSTANCE=PATH pairs sorted by instance.
+func (p PrefixMap) String() string {
+	pairs := make([]string, 0)
+	for instance, root := range p {
+		pairs = append(pairs, instance+"="+root)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set parses an INSTANCE=PATH pair and adds it to the map.
+func (p PrefixMap) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 1 || i == len(value)-1 {
+		return fmt.Errorf("Expected INSTANCE=PATH, got %s", value)
+	}
+	p[value[:i]] = path.Clean(value[i+1:])
+	return nil
+}
+
 // CacheTimeOut is the time in seconds that a metrics cache is considered
 // fresh.  If the update timestamp is less than time.Now() - timeout then
 // the cache must be refreshed.
@@ -51,19 +312,61 @@ func init() {
 		"The root of the whisper database store.")
 	flag.StringVar(&Prefix, "p", "/opt/graphite/storage/whisper",
 		"The root of the whisper database store.")
+	flag.Var(InstancePrefixes, "instance-prefix",
+		"INSTANCE=PATH root of the whisper database store for a hash ring instance.  May be repeated.")
+}
+
+// Roots returns the absolute paths of every whisper database store on
+// this node.  This is the --prefix flag unless --instance-prefix is used.
+func Roots() []string {
+	if len(InstancePrefixes) == 0 {
+		return []string{Prefix}
+	}
+
+	seen := make(map[string]bool)
+	roots := make([]string, 0)
+	for _, root := range InstancePrefixes {
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// InstanceRoot returns the whisper store root for the given hash ring
+// instance.  ok is false if the instance has no root configured in which
+// case the --prefix flag is returned.
+func InstanceRoot(instance string) (root string, ok bool) {
+	root, ok = InstancePrefixes[instance]
+	if !ok {
+		return Prefix, false
+	}
+	return root, true
 }
 
 // MetricToPath takes a metric name and return an absolute path
 // using the --prefix flag.
 func MetricToPath(metric string) string {
+	return MetricToRootPath(Prefix, metric)
+}
+
+// MetricToRootPath takes a metric name and returns an absolute path to
+// its Whisper DB in the store rooted at root.
+func MetricToRootPath(root, metric string) string {
 	p := MetricToRelative(metric)
-	return path.Join(Prefix, p)
+	return path.Join(root, p)
 }
 
 // MetricToRelative take a metric name and returns a relative path
 // to the Whisper DB.  This path combined with the root path to the
-// DB store would create a proper absolute path.
+// DB store would create a proper absolute path.  Tagged series are found
+// under the hashed TaggedDir layout used by carbon.
 func MetricToRelative(metric string) string {
+	if IsTagged(metric) {
+		return taggedToRelative(metric)
+	}
 	p := strings.Replace(metric, ".", "/", -1) + ".wsp"
 	return path.Clean(p)
 }
@@ -79,21 +382,24 @@ func MetricsToPaths(metrics []string) []string {
 	return p
 }
 
-// PathToMetric takes an absolute path that begins with the --prefix flag
-// and returns the metric name.  The path is path.Clean()'d before
-// transformed.
+// PathToMetric takes an absolute path that begins with the --prefix flag,
+// or one of the --instance-prefix roots, and returns the metric name.  The
+// path is path.Clean()'d before transformed.
 func PathToMetric(p string) string {
 	// XXX: What do we do with absolute paths that don't begin with Prefix?
 	p = path.Clean(p)
-	if strings.HasPrefix(p, Prefix) {
-		p = p[len(Prefix):]
+	root := ""
+	for _, r := range append(Roots(), Prefix) {
+		if len(r) > len(root) && strings.HasPrefix(p, r) {
+			root = r
+		}
 	}
+	p = p[len(root):]
 	if strings.HasPrefix(p, "/") {
 		p = p[1:]
 	}
 
-	p = strings.Replace(p, ".wsp", "", 1)
-	return strings.Replace(p, "/", ".", -1)
+	return RelativeToMetric(p)
 }
 
 // RelativeToMetric takes a relative path from the root of your DB store
@@ -101,6 +407,9 @@ func PathToMetric(p string) string {
 // transformed.
 func RelativeToMetric(p string) string {
 	p = path.Clean(p)
+	if isTaggedPath(p) {
+		return relativeToTagged(p)
+	}
 	p = strings.Replace(p, ".wsp", "", 1)
 	return strings.Replace(p, "/", ".", -1)
 }
@@ -117,12 +426,13 @@ func PathsToMetrics(p []string) []string {
 }
 
 // FilterList returns a slice of strings that contain only the string found
-// in both arguments.  Set intersection.
+// in both arguments.  Set intersection.  Tagged series in filter are
+// normalized before comparison.
 func FilterList(filter, metrics []string) []string {
 	result := make([]string, 0)
 	hash := make(map[string]bool)
 	for _, v := range filter {
-		hash[v] = true
+		hash[HashKey(v)] = true
 	}
 
 	for _, v := range metrics {
@@ -184,68 +494,157 @@ func checkWalk(path string, info os.FileInfo, err error) (bool, error) {
 
 // NewMetricsCache creates and returns a MetricsCacheType object
 func NewMetricsCache() *MetricsCacheType {
-	m := new(MetricsCacheType)
-	m.metrics = nil
-	m.updating = false
-	return m
+	return new(MetricsCacheType)
+}
+
+// current returns the published snapshot or nil if the cache has never
+// been built.
+func (m *MetricsCacheType) current() *MetricIndex {
+	snap, _ := m.snapshot.Load().(*MetricIndex)
+	return snap
+}
+
+// isUpdating returns true while a refresh is running.
+func (m *MetricsCacheType) isUpdating() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.updating
 }
 
 // IsAvailable returns a boolean true value if the MetricsCache is avaliable
 // for use.  Rebuilding the cache can take some time.
 func (m *MetricsCacheType) IsAvailable() bool {
-	return m.metrics != nil && !m.updating
+	return m.current() != nil && !m.isUpdating()
 }
 
 // TimedOut returns true if the cache hasn't been refreshed recently.
 func (m *MetricsCacheType) TimedOut() bool {
-	return time.Now().Unix()-m.timestamp > CacheTimeOut
+	snap := m.current()
+	if snap == nil {
+		return true
+	}
+	return time.Now().Unix()-snap.Timestamp > CacheTimeOut
 }
 
-// RefreshCache updates the list of metric names in the cache from the local
-// file store.  Blocks until completion.  Does not check cache freshness
-// so use with care.
-func (m *MetricsCacheType) RefreshCache() error {
+// startRefresh begins a refresh of the cache in a new goroutine unless
+// one is already running.  The returned channel is closed when the
+// running refresh completes.
+func (m *MetricsCacheType) startRefresh() <-chan struct{} {
 	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.updating {
+		return m.done
+	}
+
 	m.updating = true
+	m.done = make(chan struct{})
+	go m.refresh(m.done)
+	return m.done
+}
+
+// refresh scans the file system, publishes the new snapshot and then
+// wakes up anyone waiting on done.
+func (m *MetricsCacheType) refresh(done chan struct{}) {
+	m.snapshot.Store(scanMetrics())
+
+	m.lock.Lock()
+	m.updating = false
+	close(done)
+	m.lock.Unlock()
+}
 
-	examine := func(path string, info os.FileInfo, err error) error {
-		ok, err := checkWalk(path, info, err)
-		if err != nil {
-			return err
+// scanMetrics walks each whisper store and returns a new MetricIndex of
+// the metrics found.  A metric present in more than one store is only
+// listed once.
+func scanMetrics() *MetricIndex {
+	start := time.Now()
+	idx := new(MetricIndex)
+	seen := make(map[string]bool)
+	for _, root := range Roots() {
+		examine := func(path string, info os.FileInfo, err error) error {
+			ok, err := checkWalk(path, info, err)
+			if err != nil {
+				return err
+			}
+			if ok {
+				m := RelativeToMetric(strings.TrimPrefix(path[len(root):], "/"))
+				if !seen[m] {
+					seen[m] = true
+					idx.Metrics = append(idx.Metrics, m)
+					idx.Size = append(idx.Size, info.Size())
+					idx.ModTime = append(idx.ModTime, info.ModTime().Unix())
+				}
+			}
+			return nil
 		}
-		if ok {
-			//log.Printf("Found %s or %s", path, PathToMetric(path))
-			m.metrics = append(m.metrics, PathToMetric(path))
+
+		log.Printf("Scaning %s for metrics...", root)
+		if err := filepath.Walk(root, examine); err != nil {
+			log.Printf("Scan of %s returned an Error: %s", root, err)
+			idx.err = err
 		}
-		return nil
 	}
-
-	// Create new empty slice
-	log.Printf("Scaning %s for metrics...", Prefix)
-	m.metrics = make([]string, 0)
-	err := filepath.Walk(Prefix, examine)
 	log.Printf("Scan complete.")
-	if err != nil {
-		log.Printf("Scan returned an Error: %s", err)
+	if idx.Metrics == nil {
+		idx.Metrics = make([]string, 0)
 	}
+	sort.Sort(idx)
+	idx.Timestamp = time.Now().Unix()
+	idx.Duration = time.Since(start)
 
-	m.timestamp = time.Now().Unix()
-	m.updating = false
-	m.lock.Unlock()
-	return nil
+	return idx
+}
+
+// RefreshCache updates the list of metric names in the cache from the local
+// file store.  Blocks until completion.  Does not check cache freshness
+// so use with care.  If a refresh is already running this waits for it
+// rather than starting another.
+func (m *MetricsCacheType) RefreshCache() error {
+	<-m.startRefresh()
+	return m.current().err
+}
+
+// Force begins rebuilding the cache in the background if it isn't
+// already being rebuilt.  The cache is unavailable until the rebuild
+// completes.
+func (m *MetricsCacheType) Force() {
+	m.startRefresh()
+}
+
+// Snapshot returns the result of the last completed scan, which may be
+// out of date, or nil if there has been none.  Unlike GetIndex it never
+// starts a refresh.
+func (m *MetricsCacheType) Snapshot() *MetricIndex {
+	return m.current()
+}
+
+// Refreshing returns true while the cache is being rebuilt.
+func (m *MetricsCacheType) Refreshing() bool {
+	return m.isUpdating()
 }
 
 // GetMetrics returns a slice of metric key names and an ok boolean.
 // This function returns immediately even if the metric cache is out of
 // date and is being refreshed.  In this case ok will be false until
-// the cache is rebuilt.
+// the cache is rebuilt.  The returned slice is sorted, shared with other
+// callers and must not be modified.
 func (m *MetricsCacheType) GetMetrics() ([]string, bool) {
-	if m.IsAvailable() && !m.TimedOut() {
-		return m.metrics, true
+	idx, ok := m.GetIndex()
+	if !ok {
+		return nil, false
 	}
+	return idx.Metrics, true
+}
 
-	if !m.updating {
-		go m.RefreshCache()
+// GetIndex is like GetMetrics but returns the full MetricIndex including
+// the size and modification time of each metric.  The index is shared
+// with other callers and must not be modified.
+func (m *MetricsCacheType) GetIndex() (*MetricIndex, bool) {
+	snap := m.current()
+	if snap != nil && !m.isUpdating() && !m.TimedOut() {
+		return snap, true
 	}
+
+	m.startRefresh()
 	return nil, false
 }
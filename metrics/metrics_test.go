@@ -1,6 +1,10 @@
 package metrics
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -24,3 +28,122 @@ func TestPathToMetric(t *testing.T) {
 			"bobby.sue.foo.bar")
 	}
 }
+
+// makeStore creates an empty whisper store layout in a temp directory
+// with the given metrics and points Prefix at it.  The returned function
+// restores Prefix and removes the directory.
+func makeStore(t *testing.T, metrics []string) func() {
+	dir, err := ioutil.TempDir("", "metrics_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPrefix := Prefix
+	Prefix = dir
+
+	for _, m := range metrics {
+		p := MetricToPath(m)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("wsp"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return func() {
+		Prefix = oldPrefix
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMetricsCacheRefresh(t *testing.T) {
+	defer makeStore(t, []string{"foo.bar", "foo.baz", "qux"})()
+
+	cache := NewMetricsCache()
+	if cache.IsAvailable() {
+		t.Fatalf("New cache reports available before the first scan")
+	}
+	if _, ok := cache.GetMetrics(); ok {
+		t.Fatalf("GetMetrics returned ok before the first scan")
+	}
+
+	if err := cache.RefreshCache(); err != nil {
+		t.Fatal(err)
+	}
+	metrics, ok := cache.GetMetrics()
+	if !ok {
+		t.Fatalf("GetMetrics not ok after RefreshCache")
+	}
+	if len(metrics) != 3 {
+		t.Errorf("Cache holds %d metrics rather than 3: %v", len(metrics), metrics)
+	}
+}
+
+func TestMetricsCacheConcurrent(t *testing.T) {
+	defer makeStore(t, []string{"foo.bar", "foo.baz", "qux"})()
+
+	cache := NewMetricsCache()
+	cache.RefreshCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if metrics, ok := cache.GetMetrics(); ok {
+					FilterRegex("^foo", metrics)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				cache.Force()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				cache.RefreshCache()
+				cache.IsAvailable()
+				cache.TimedOut()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := cache.RefreshCache(); err != nil {
+		t.Fatal(err)
+	}
+	if metrics, ok := cache.GetMetrics(); !ok || len(metrics) != 3 {
+		t.Errorf("Cache inconsistent after concurrent refreshes: %v %v", ok, metrics)
+	}
+}
+
+func TestInstancePrefixes(t *testing.T) {
+	defer func() { InstancePrefixes = make(PrefixMap) }()
+
+	if err := InstancePrefixes.Set("a"); err == nil {
+		t.Errorf("PrefixMap accepted a value without a path")
+	}
+	InstancePrefixes.Set("a=/data/a/whisper/")
+	InstancePrefixes.Set("b=/data/b/whisper")
+
+	roots := Roots()
+	if len(roots) != 2 || roots[0] != "/data/a/whisper" || roots[1] != "/data/b/whisper" {
+		t.Errorf("Roots returned %v", roots)
+	}
+	if root, ok := InstanceRoot("c"); ok || root != Prefix {
+		t.Errorf("InstanceRoot for an unknown instance returned %s, %v", root, ok)
+	}
+
+	metric := PathToMetric("/data/b/whisper/bobby/sue.wsp")
+	if metric != "bobby.sue" {
+		t.Errorf("PathToMetric returned %s rather than bobby.sue", metric)
+	}
+	path := MetricToRootPath("/data/a/whisper", "bobby.sue")
+	if path != "/data/a/whisper/bobby/sue.wsp" {
+		t.Errorf("MetricToRootPath returned %s", path)
+	}
+}
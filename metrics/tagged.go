@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// TaggedDir is the top level directory in the whisper store that carbon
+// and go-carbon keep tagged series under.
+const TaggedDir = "_tagged"
+
+// taggedDot replaces "." in the file names of tagged series so that they
+// do not create further subdirectories.
+const taggedDot = "_DOT_"
+
+// IsTagged returns true if the metric name is a Graphite tagged series such
+// as "cpu;host=a;dc=b".
+func IsTagged(metric string) bool {
+	return strings.Contains(metric, ";")
+}
+
+// ParseTagged splits a tagged series into its name and tags.  The same
+// validation that carbon applies is done here and an error is returned
+// for names carbon would refuse.
+func ParseTagged(metric string) (string, map[string]string, error) {
+	parts := strings.Split(metric, ";")
+	name := parts[0]
+	if name == "" {
+		return "", nil, fmt.Errorf("Tagged series %s has no name", metric)
+	}
+
+	tags := make(map[string]string)
+	for _, t := range parts[1:] {
+		i := strings.Index(t, "=")
+		if i < 1 {
+			return "", nil, fmt.Errorf("Malformed tag %s in %s", t, metric)
+		}
+		k, v := t[:i], t[i+1:]
+		if strings.ContainsAny(k, "!^=") {
+			return "", nil, fmt.Errorf("Invalid tag name %s in %s", k, metric)
+		}
+		if v == "" || strings.HasPrefix(v, "~") {
+			return "", nil, fmt.Errorf("Invalid value for tag %s in %s", k, metric)
+		}
+		tags[k] = v
+	}
+
+	// The series name always wins over a name tag
+	delete(tags, "name")
+	return name, tags, nil
+}
+
+// NormalizeTagged returns the canonical form of a tagged series which is
+// its name followed by its tags sorted by tag name.  This is the form
+// carbon uses to hash and store the series.
+func NormalizeTagged(metric string) (string, error) {
+	name, tags, err := ParseTagged(metric)
+	if err != nil {
+		return "", err
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{name}
+	for _, k := range keys {
+		parts = append(parts, k+"="+tags[k])
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// HashKey returns the key the carbon relays hash to place the given metric
+// in the hash ring.  Tagged series are normalized, other metrics are
+// returned unchanged.
+func HashKey(metric string) string {
+	if !IsTagged(metric) {
+		return metric
+	}
+	if n, err := NormalizeTagged(metric); err == nil {
+		return n
+	}
+	return metric
+}
+
+// taggedToRelative returns the relative path carbon stores a tagged series
+// at.  The first six hex digits of the SHA256 of the normalized name give
+// two levels of directories.
+func taggedToRelative(metric string) string {
+	metric = HashKey(metric)
+	sum := sha256.Sum256([]byte(metric))
+	digest := hex.EncodeToString(sum[:])
+	file := strings.Replace(metric, ".", taggedDot, -1) + ".wsp"
+	return path.Join(TaggedDir, digest[0:3], digest[3:6], file)
+}
+
+// relativeToTagged returns the tagged series name stored at the given
+// relative path, which must begin with TaggedDir.
+func relativeToTagged(p string) string {
+	file := strings.TrimSuffix(path.Base(p), ".wsp")
+	return strings.Replace(file, taggedDot, ".", -1)
+}
+
+// isTaggedPath returns true if the relative path is within TaggedDir.
+func isTaggedPath(p string) bool {
+	return strings.HasPrefix(p, TaggedDir+"/")
+}
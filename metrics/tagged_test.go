@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestNormalizeTagged(t *testing.T) {
+	tests := map[string]string{
+		"cpu;host=a;dc=b":         "cpu;dc=b;host=a",
+		"cpu;dc=b;host=a":         "cpu;dc=b;host=a",
+		"cpu;name=foo;host=a":     "cpu;host=a",
+		"disk.used;path=/a=b;x=y": "disk.used;path=/a=b;x=y",
+	}
+	for in, expected := range tests {
+		n, err := NormalizeTagged(in)
+		if err != nil {
+			t.Errorf("NormalizeTagged(%s) returned error: %s", in, err)
+		} else if n != expected {
+			t.Errorf("NormalizeTagged(%s) = %s rather than %s", in, n, expected)
+		}
+	}
+
+	bad := []string{";host=a", "cpu;host", "cpu;=a", "cpu;host=", "cpu;host=~a", "cpu;ho!st=a"}
+	for _, in := range bad {
+		if _, err := NormalizeTagged(in); err == nil {
+			t.Errorf("NormalizeTagged(%s) accepted an invalid series", in)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	if HashKey("foo.bar") != "foo.bar" {
+		t.Errorf("HashKey altered an untagged metric: %s", HashKey("foo.bar"))
+	}
+	if HashKey("cpu;host=a;dc=b") != "cpu;dc=b;host=a" {
+		t.Errorf("HashKey did not normalize: %s", HashKey("cpu;host=a;dc=b"))
+	}
+}
+
+func TestTaggedPaths(t *testing.T) {
+	// This example is from carbon's TaggedSeries.encode() documentation
+	metric := "some.metric;tag1=value2;tag2=value.2"
+	relative := "_tagged/eff/aae/some_DOT_metric;tag1=value2;tag2=value_DOT_2.wsp"
+
+	if p := MetricToRelative(metric); p != relative {
+		t.Errorf("MetricToRelative(%s) = %s rather than %s", metric, p, relative)
+	}
+	if m := RelativeToMetric(relative); m != metric {
+		t.Errorf("RelativeToMetric(%s) = %s rather than %s", relative, m, metric)
+	}
+	if m := PathToMetric(MetricToPath(metric)); m != metric {
+		t.Errorf("PathToMetric did not round trip %s: %s", metric, m)
+	}
+
+	// Unsorted tags are stored at the normalized location
+	if MetricToRelative("cpu;host=a;dc=b") != MetricToRelative("cpu;dc=b;host=a") {
+		t.Errorf("Tag order changed the storage path")
+	}
+
+	filtered := FilterList([]string{"cpu;host=a;dc=b"}, []string{"cpu;dc=b;host=a", "cpu"})
+	if len(filtered) != 1 || filtered[0] != "cpu;dc=b;host=a" {
+		t.Errorf("FilterList did not match a normalized tagged series: %v", filtered)
+	}
+}
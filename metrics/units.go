@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ageUnits are the suffixes understood by ParseAge in seconds.  These
+// match the units of whisper retention definitions.
+var ageUnits = map[string]int64{
+	"s": 1,
+	"m": 60,
+	"h": 3600,
+	"d": 86400,
+	"w": 86400 * 7,
+	"y": 86400 * 365,
+}
+
+// sizeUnits are the suffixes understood by ParseSize in bytes.
+var sizeUnits = map[string]int64{
+	"B": 1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// splitUnit splits a string such as "90d" into its number and unit.
+func splitUnit(s string) (int64, string, error) {
+	i := len(s)
+	for i > 0 && (s[i-1] < '0' || s[i-1] > '9') {
+		i--
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil || n < 0 {
+		return 0, "", fmt.Errorf("Invalid value: %s", s)
+	}
+	return n, s[i:], nil
+}
+
+// ParseAge parses an age such as "90d" and returns it in seconds.  The
+// units s, m, h, d, w and y are understood.  A number without a unit is
+// in seconds.
+func ParseAge(s string) (int64, error) {
+	n, unit, err := splitUnit(s)
+	if err != nil {
+		return 0, err
+	}
+	if unit == "" {
+		return n, nil
+	}
+	multiplier, ok := ageUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("Invalid unit in age: %s", s)
+	}
+	return n * multiplier, nil
+}
+
+// ParseSize parses a size such as "50M" and returns it in bytes.  The
+// units K, M, G and T are powers of 1024 and may be followed by "B" or
+// "iB".  A number without a unit is in bytes.
+func ParseSize(s string) (int64, error) {
+	n, unit, err := splitUnit(s)
+	if err != nil {
+		return 0, err
+	}
+	unit = strings.TrimSuffix(strings.ToUpper(unit), "IB")
+	if len(unit) > 1 {
+		unit = strings.TrimSuffix(unit, "B")
+	}
+	if unit == "" {
+		return n, nil
+	}
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("Invalid unit in size: %s", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := map[string]int64{
+		"0":   0,
+		"30":  30,
+		"30s": 30,
+		"5m":  300,
+		"2h":  7200,
+		"90d": 90 * 86400,
+		"1w":  7 * 86400,
+		"1y":  365 * 86400,
+	}
+	for in, expected := range tests {
+		age, err := ParseAge(in)
+		if err != nil {
+			t.Errorf("ParseAge(%s) returned error: %s", in, err)
+		} else if age != expected {
+			t.Errorf("ParseAge(%s) = %d rather than %d", in, age, expected)
+		}
+	}
+
+	bad := []string{"", "d", "-5d", "5x", "5dd", "1.5h"}
+	for _, in := range bad {
+		if _, err := ParseAge(in); err == nil {
+			t.Errorf("ParseAge(%s) accepted an invalid age", in)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"0":    0,
+		"512":  512,
+		"512B": 512,
+		"4K":   4096,
+		"4k":   4096,
+		"4KB":  4096,
+		"4KiB": 4096,
+		"50M":  50 << 20,
+		"2G":   2 << 30,
+		"1T":   1 << 40,
+	}
+	for in, expected := range tests {
+		size, err := ParseSize(in)
+		if err != nil {
+			t.Errorf("ParseSize(%s) returned error: %s", in, err)
+		} else if size != expected {
+			t.Errorf("ParseSize(%s) = %d rather than %d", in, size, expected)
+		}
+	}
+
+	bad := []string{"", "M", "-5M", "5X", "5MM", "1.5G"}
+	for _, in := range bad {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%s) accepted an invalid size", in)
+		}
+	}
+}
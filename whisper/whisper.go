@@ -6,6 +6,7 @@ package whisper
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"regexp"
@@ -23,6 +24,9 @@ const (
 	PointSize       = 12
 	MetadataSize    = 16
 	ArchiveInfoSize = 12
+
+	// MaxArchives bounds the archive count ReadHeader accepts
+	MaxArchives = 64
 )
 
 const (
@@ -265,6 +269,67 @@ func Open(path string) (whisper *Whisper, err error) {
 	return whisper, nil
 }
 
+/*
+  ReadHeader reads the metadata and archive info of a Whisper database
+  from r and checks that it describes a valid database of exactly size
+  bytes.  The bytes read are returned so the caller can reassemble the
+  stream.
+*/
+func ReadHeader(r io.Reader, size int64) ([]byte, error) {
+	b := make([]byte, MetadataSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("Error reading whisper metadata: %s", err)
+	}
+	aggregationMethod := AggregationMethod(unpackInt(b[0:IntSize]))
+	maxRetention := unpackInt(b[IntSize : IntSize*2])
+	xFilesFactor := unpackFloat32(b[IntSize*2 : IntSize*3])
+	archiveCount := unpackInt(b[IntSize*3 : MetadataSize])
+
+	if aggregationMethod < Average || aggregationMethod > Min {
+		return nil, fmt.Errorf("Unknown aggregation method %d", aggregationMethod)
+	}
+	if !(xFilesFactor >= 0 && xFilesFactor <= 1) {
+		return nil, fmt.Errorf("Invalid xFilesFactor %v", xFilesFactor)
+	}
+	// The size is declared by the client so bound the archive count
+	// before allocating for it
+	if archiveCount < 1 || archiveCount > MaxArchives ||
+		int64(archiveCount) > (size-MetadataSize)/ArchiveInfoSize {
+		return nil, fmt.Errorf("Invalid archive count %d for %d bytes", archiveCount, size)
+	}
+
+	info := make([]byte, ArchiveInfoSize*archiveCount)
+	if _, err := io.ReadFull(r, info); err != nil {
+		return nil, fmt.Errorf("Error reading whisper archive info: %s", err)
+	}
+	retentions := make(Retentions, archiveCount)
+	offset := int64(MetadataSize + ArchiveInfoSize*archiveCount)
+	for i := 0; i < archiveCount; i++ {
+		archive := unpackArchiveInfo(info[i*ArchiveInfoSize : (i+1)*ArchiveInfoSize])
+		if archive.Offset() != offset {
+			return nil, fmt.Errorf("Archive %d starts at offset %d rather than %d",
+				i, archive.offset, offset)
+		}
+		if archive.secondsPerPoint < 1 || archive.numberOfPoints < 1 {
+			return nil, fmt.Errorf("Archive %d has an invalid retention %d:%d",
+				i, archive.secondsPerPoint, archive.numberOfPoints)
+		}
+		offset += int64(archive.numberOfPoints * PointSize)
+		retentions[i] = &Retention{archive.secondsPerPoint, archive.numberOfPoints}
+	}
+	if offset != size {
+		return nil, fmt.Errorf("Archives describe %d bytes rather than %d", offset, size)
+	}
+	if err := validateRetentions(retentions); err != nil {
+		return nil, err
+	}
+	if maxRetention != retentions[archiveCount-1].MaxRetention() {
+		return nil, fmt.Errorf("Maximum retention %d does not match the archives", maxRetention)
+	}
+
+	return append(b, info...), nil
+}
+
 func (whisper *Whisper) writeHeader() (err error) {
 	b := make([]byte, whisper.MetadataSize())
 	i := 0
@@ -325,6 +390,22 @@ func (whisper *Whisper) Retentions() (retentions Retentions) {
 	return retentions
 }
 
+/*
+  AggregationMethod returns the method used to aggregate points into the
+  lower precision archives.
+*/
+func (whisper *Whisper) AggregationMethod() AggregationMethod {
+	return whisper.aggregationMethod
+}
+
+/*
+  XFilesFactor returns the fraction of points that must be known to
+  aggregate them into a lower precision archive.
+*/
+func (whisper *Whisper) XFilesFactor() float32 {
+	return whisper.xFilesFactor
+}
+
 /*
   Update a value in the database.
 
@@ -607,9 +688,55 @@ func (whisper *Whisper) Fetch(fromTime, untilTime int) (timeSeries *TimeSeries,
 		}
 	}
 
+	return whisper.fetchArchive(&archive, fromTime, untilTime), nil
+}
+
+/*
+  FetchArchive returns a TimeSeries for a given time span from the archive
+  at index, in the order of Retentions().  Unlike Fetch the archive is not
+  chosen by the time span, the span is clipped to the archive instead.
+*/
+func (whisper *Whisper) FetchArchive(index, fromTime, untilTime int) (timeSeries *TimeSeries, err error) {
+	now := int(time.Now().Unix()) // TODO: danger of 2030 something overflow
+	return whisper.FetchArchiveAt(index, fromTime, untilTime, now)
+}
+
+/*
+  FetchArchiveAt is FetchArchive with the span clipped to the retention of
+  the archive as of the time now rather than the current time, so copies
+  of a file read at different times return the same points.
+*/
+func (whisper *Whisper) FetchArchiveAt(index, fromTime, untilTime, now int) (timeSeries *TimeSeries, err error) {
+	if index < 0 || index >= len(whisper.archives) {
+		return nil, fmt.Errorf("Invalid archive index: %d", index)
+	}
+	if fromTime > untilTime {
+		return nil, fmt.Errorf("Invalid time interval: from time '%d' is after until time '%d'", fromTime, untilTime)
+	}
+	archive := whisper.archives[index]
+	oldestTime := now - archive.MaxRetention()
+	if fromTime < oldestTime {
+		fromTime = oldestTime
+	}
+	if untilTime > now {
+		untilTime = now
+	}
+	if fromTime > untilTime {
+		return nil, nil
+	}
+	if interval := archive.Interval(fromTime); interval == archive.Interval(untilTime) {
+		// An empty span, which readSeries would read as the whole archive
+		return &TimeSeries{interval, interval, archive.secondsPerPoint, []float64{}}, nil
+	}
+	return whisper.fetchArchive(&archive, fromTime, untilTime), nil
+}
+
+// fetchArchive reads the points of the archive between the times, which
+// must be within its retention.
+func (whisper *Whisper) fetchArchive(archive *archiveInfo, fromTime, untilTime int) *TimeSeries {
 	fromInterval := archive.Interval(fromTime)
 	untilInterval := archive.Interval(untilTime)
-	baseInterval := whisper.getBaseInterval(&archive)
+	baseInterval := whisper.getBaseInterval(archive)
 
 	if baseInterval == 0 {
 		step := archive.secondsPerPoint
@@ -618,13 +745,12 @@ func (whisper *Whisper) Fetch(fromTime, untilTime int) (timeSeries *TimeSeries,
 		for i, _ := range values {
 			values[i] = math.NaN()
 		}
-		return &TimeSeries{fromInterval, untilInterval, step, values}, nil
+		return &TimeSeries{fromInterval, untilInterval, step, values}
 	}
-
 	fromOffset := archive.PointOffset(baseInterval, fromInterval)
 	untilOffset := archive.PointOffset(baseInterval, untilInterval)
 
-	series := whisper.readSeries(fromOffset, untilOffset, &archive)
+	series := whisper.readSeries(fromOffset, untilOffset, archive)
 
 	values := make([]float64, len(series))
 	for i, _ := range values {
@@ -640,7 +766,7 @@ func (whisper *Whisper) Fetch(fromTime, untilTime int) (timeSeries *TimeSeries,
 		currentInterval += step
 	}
 
-	return &TimeSeries{fromInterval, untilInterval, step, values}, nil
+	return &TimeSeries{fromInterval, untilInterval, step, values}
 }
 
 func (whisper *Whisper) readInt(offset int64) (int, error) {
@@ -1,6 +1,7 @@
 package whisper
 
 import (
+	"bytes"
 	"fmt"
 	"math"
 	"os"
@@ -345,6 +346,84 @@ func TestFetchEmptyTimeseries(t *testing.T) {
 	tearDown()
 }
 
+func TestFetchArchive(t *testing.T) {
+	path, _, archiveList, tearDown := setUpCreate()
+	defer tearDown()
+	whisper, err := Create(path, archiveList, Sum, 0.5)
+	if err != nil {
+		t.Fatalf("Failed create: %v", err)
+	}
+	defer whisper.Close()
+	now := int(time.Now().Unix())
+	whisper.UpdateMany(makeGoodPoints(100, 1, func(i int) float64 { return 1 }))
+
+	for i, step := range []int{1, 60, 300} {
+		timeSeries, err := whisper.FetchArchive(i, now-200, now)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if timeSeries.Step() != step {
+			t.Errorf("Archive %d has step %d rather than %d", i, timeSeries.Step(), step)
+		}
+	}
+
+	timeSeries, _ := whisper.FetchArchive(0, now-200, now)
+	known := 0
+	for _, v := range timeSeries.Values() {
+		if !math.IsNaN(v) {
+			known++
+		}
+	}
+	if known != 100 {
+		t.Errorf("Expected 100 points in the first archive, found %d", known)
+	}
+
+	// The span is clipped to the retention of the archive
+	timeSeries, _ = whisper.FetchArchive(0, now-10000, now)
+	if len(timeSeries.Values()) != 300 {
+		t.Errorf("Expected 300 values, found %d", len(timeSeries.Values()))
+	}
+
+	if timeSeries, _ = whisper.FetchArchive(2, now, now); len(timeSeries.Values()) != 0 {
+		t.Errorf("Expected no values within a single interval, found %d", len(timeSeries.Values()))
+	}
+	if _, err = whisper.FetchArchive(3, now-200, now); err == nil {
+		t.Errorf("Expected an error for an invalid archive index")
+	}
+}
+
+func TestFetchArchiveAt(t *testing.T) {
+	path, _, archiveList, tearDown := setUpCreate()
+	defer tearDown()
+	whisper, err := Create(path, archiveList, Sum, 0.5)
+	if err != nil {
+		t.Fatalf("Failed create: %v", err)
+	}
+	defer whisper.Close()
+	now := int(time.Now().Unix())
+	whisper.UpdateMany(makeGoodPoints(100, 1, func(i int) float64 { return 1 }))
+
+	// The retention is as of the time given, not the current time
+	for _, test := range []struct{ at, known int }{
+		{now, 100},
+		{now + 250, 50},
+	} {
+		timeSeries, err := whisper.FetchArchiveAt(0, now-400, now, test.at)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		known := 0
+		for _, v := range timeSeries.Values() {
+			if !math.IsNaN(v) {
+				known++
+			}
+		}
+		if known != test.known {
+			t.Errorf("Expected %d points as of %d, found %d", test.known, test.at-now, known)
+		}
+	}
+}
+
 func TestCreateUpdateFetch(t *testing.T) {
 	var timeSeries *TimeSeries
 	timeSeries = testCreateUpdateFetch(t, Average, 0.5, 3500, 3500, 1000, 300, 0.5, 0.2)
@@ -593,3 +672,61 @@ func TestTimeSeriesPoints(t *testing.T) {
 		t.Fatalf("Unexpected number of points in time series, %v", length)
 	}
 }
+
+func TestReadHeader(t *testing.T) {
+	header := func() []byte {
+		return []byte{
+			0x00, 0x00, 0x00, 0x01, // Aggregation type
+			0x00, 0x00, 0x0e, 0x10, // Max retention
+			0x3f, 0x00, 0x00, 0x00, // xFilesFactor
+			0x00, 0x00, 0x00, 0x03, // Retention count
+			0x00, 0x00, 0x00, 0x34, // offset
+			0x00, 0x00, 0x00, 0x01, // secondsPerPoint
+			0x00, 0x00, 0x01, 0x2c, // numberOfPoints
+			0x00, 0x00, 0x0e, 0x44, // offset
+			0x00, 0x00, 0x00, 0x3c, // secondsPerPoint
+			0x00, 0x00, 0x00, 0x1e, // numberOfPoints
+			0x00, 0x00, 0x0f, 0xac, // offset
+			0x00, 0x00, 0x01, 0x2c, // secondsPerPoint
+			0x00, 0x00, 0x00, 0x0c} // numberOfPoints
+	}
+	size := int64(52 + (300+30+12)*PointSize)
+
+	b, err := ReadHeader(bytes.NewReader(header()), size)
+	if err != nil {
+		t.Fatalf("Valid header rejected: %s", err)
+	}
+	checkBytes(t, header(), b)
+
+	if _, err := ReadHeader(bytes.NewReader(header()), size+PointSize); err == nil {
+		t.Errorf("Header accepted for the wrong file size")
+	}
+	if _, err := ReadHeader(bytes.NewReader(header()[:30]), size); err == nil {
+		t.Errorf("Truncated header accepted")
+	}
+
+	corrupt := map[string]func(b []byte){
+		"aggregation":   func(b []byte) { b[3] = 0x09 },
+		"xFilesFactor":  func(b []byte) { b[8] = 0x7f },
+		"no archives":   func(b []byte) { b[15] = 0x00 },
+		"many archives": func(b []byte) { b[12] = 0xff },
+		"offset":        func(b []byte) { b[19] = 0x40 },
+		"precision":     func(b []byte) { b[23] = 0x00 },
+		"retention":     func(b []byte) { b[7] = 0x11 },
+		"order":         func(b []byte) { b[35] = 0x3d },
+	}
+	for name, f := range corrupt {
+		b := header()
+		f(b)
+		if _, err := ReadHeader(bytes.NewReader(b), size); err == nil {
+			t.Errorf("Header with corrupt %s accepted", name)
+		}
+	}
+
+	// A huge declared size does not allow a huge archive count
+	b = header()
+	b[13] = 0xff
+	if _, err := ReadHeader(bytes.NewReader(b), 1<<40); err == nil {
+		t.Errorf("Header with %d archives accepted", unpackInt(b[12:16]))
+	}
+}